@@ -0,0 +1,90 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//单次请求超时
+const CLIENT_TIMEOUT = 30 * time.Second
+
+var (
+	ErrRunning    = errors.New("companion is already running")
+	ErrNotRunning = errors.New("companion is not running")
+)
+
+//管理接口客户端
+type Client struct {
+	path   string
+	client *http.Client
+}
+
+func NewClient(path string) *Client {
+	return &Client{
+		path: path,
+		client: &http.Client{
+			Timeout: CLIENT_TIMEOUT,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+//单次请求超时，0表示不限制
+func (c *Client) SetTimeout(d time.Duration) {
+	c.client.Timeout = d
+}
+
+func (c *Client) Get(path string, params url.Values, result interface{}) error {
+	u := "http://admin" + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	return c.do(http.MethodGet, u, "", result)
+}
+
+func (c *Client) Post(path string, params url.Values, result interface{}) error {
+	return c.do(http.MethodPost, "http://admin"+path, params.Encode(), result)
+}
+
+func (c *Client) do(method, u, body string, result interface{}) error {
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		//socket不存在或无人监听
+		if opErr, ok := err.(*url.Error); ok {
+			if _, ok = opErr.Err.(*net.OpError); ok {
+				return ErrNotRunning
+			}
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	rsp := &Response{}
+	if err = json.NewDecoder(resp.Body).Decode(rsp); err != nil {
+		return err
+	}
+	if !rsp.OK {
+		return errors.New(rsp.Err)
+	}
+	if result != nil && len(rsp.Result) > 0 {
+		return json.Unmarshal(rsp.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package admin
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+//写入当前进程号，文件中的进程仍存活时返回ErrRunning
+func WritePidFile(path string) error {
+	if pid, err := ReadPidFile(path); err == nil && pid != os.Getpid() {
+		return fmt.Errorf("%v: pid %d", ErrRunning, pid)
+	} else if err != nil && err != ErrNotRunning {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+//读取进程号，文件不存在或进程已退出时返回ErrNotRunning
+func ReadPidFile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, ErrNotRunning
+	} else if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return 0, fmt.Errorf("illegal pid file %s: %v", path, err)
+	}
+	if !Alive(pid) {
+		return 0, ErrNotRunning
+	}
+	return pid, nil
+}
+
+//仅删除本进程写入的pid文件
+func RemovePidFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(bytes.TrimSpace(data)) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+//进程是否存活
+func Alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
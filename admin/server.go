@@ -0,0 +1,107 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
+)
+
+//退出时等待请求结束的最长时间
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
+//接口返回
+type Response struct {
+	OK     bool            `json:"ok"`
+	Err    string          `json:"err,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+//管理接口处理，返回结果以json输出
+type HandlerFunc func(r *http.Request) (interface{}, error)
+
+//本地管理服务，http over unix socket，socket文件仅当前用户可访问
+type Server struct {
+	path string
+	mux  *http.ServeMux
+	srv  *http.Server
+}
+
+func NewServer(path string) *Server {
+	mux := http.NewServeMux()
+	return &Server{path: path, mux: mux, srv: &http.Server{Handler: mux}}
+}
+
+//注册接口，method为空时不限制
+func (s *Server) Handle(method, pattern string, h HandlerFunc) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if method != "" && r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(&Response{Err: "method not allowed"})
+			return
+		}
+		rsp := &Response{OK: true}
+		result, err := h(r)
+		if err == nil && result != nil {
+			rsp.Result, err = json.Marshal(result)
+		}
+		if err != nil {
+			rsp.OK, rsp.Err, rsp.Result = false, err.Error(), nil
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(rsp)
+	})
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := listen(s.path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(s.path)
+
+	errCh := make(chan error, 1)
+	go func() {
+		logger.Info("admin server listen on %s", s.path)
+		errCh <- s.srv.Serve(listener)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		return s.srv.Shutdown(shutdownCtx)
+	}
+}
+
+//监听socket，清理上次异常退出遗留的socket文件
+func listen(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, ErrRunning
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	//创建socket时即限制为0600，避免chmod前被其他用户连接
+	mask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenMode(t *testing.T) {
+	//宽松的umask下socket仍只对当前用户可见
+	mask := syscall.Umask(0)
+	defer syscall.Umask(mask)
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	listener, err := listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("mode: got %o, want 600", perm)
+	}
+	if _, err = listen(path); err != ErrRunning {
+		t.Fatalf("got %v, want %v", err, ErrRunning)
+	}
+}
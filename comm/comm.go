@@ -45,6 +45,10 @@ const (
 	Err_UNENABLE_AMOUNT   = "103" //非法金额
 	Err_HASH_EXSITS       = "104" //hash已确认
 	Err_UNENABLE_CATEGORY = "105" //非法转账类型
+	Err_DB                = "106" //落地失败
+	Err_NOT_FOUND         = "107" //记录不存在
+	Err_PAGE              = "108" //非法分页参数
+	Err_AUTH              = "401" //签名验证失败
 )
 
 //db key
@@ -55,6 +59,22 @@ const (
 	HASH_ENABLE_PREFIX      = "he_"
 	HASH_DISABLE_PREFIX     = "hd_"
 	WITHDRAW_APPLY_PREFIX   = "wa_"
+	NONCE_NEXT_PREFIX       = "nn_"  //nn_ACCOUNT 下一个待分配nonce
+	NONCE_GAP_PREFIX        = "ng_"  //ng_ACCOUNT_NONCE 空洞nonce，优先复用
+	NONCE_PENDING_PREFIX    = "np_"  //np_ACCOUNT_NONCE 已发送未确认交易hash
+	TX_QUEUE_PREFIX         = "txq_" //txq_REQTYPE_HASH_WDHASH 私链交易发送记录
+	TX_INDEX_PREFIX         = "txi_" //txi_HASH_ID 私链交易记录索引，审批流为hash，提现为wdHash
+	REQ_QUEUE_PREFIX        = "rq_"  //rq_REQTYPE_HASH_WDHASH 已接收未入发送队列的请求
+	BLOCK_HASH_PREFIX       = "bh_"  //bh_BLOCK 近期区块hash，用于分叉检测
+	EVENT_LOG_PREFIX        = "evt_" //evt_BLOCK_TXHASH_LOGINDEX 已上报的私链log
+	DEAD_LETTER_PREFIX      = "dlq_" //dlq_BLOCK_TXHASH_LOGINDEX 解析失败的私链log
+	VREQ_QUEUE_PREFIX       = "vr_"  //vr_REQTYPE_WDHASH_TXHASH 待上报web的请求
+	TOKEN_PREFIX            = "tk_"  //tk_CONTRACTADDR token信息
+	COIN_PREFIX             = "cn_"  //cn_CATEGORY 币种信息
+	VOUCHER_OPR_PREFIX      = "vo_"  //vo_TYPE_HASH 签名机操作记录
+	CONFIRM_PREFIX          = "cf_"  //cf_REQTYPE_HASH[_WDHASH] 各节点确认记录
+	CONFIRM_DONE_PREFIX     = "cfd_" //cfd_REQTYPE_HASH[_WDHASH] 该阶段最近上报的区块，此前的确认失效
+	QUORUM_PENDING_PREFIX   = "qp_"  //qp_BLOCK_TXHASH_LOGINDEX 确认数未达门限的私链log，新区块时重新检查
 )
 
 //转账类型区间
@@ -67,10 +87,26 @@ const (
 	CHAN_MAX_SIZE = 100000
 )
 
+//签名方式
 const (
-	HASH_STATUS_APPLY   = "1" //申请
-	HASH_STATUS_ENABLE  = "2" //确认
-	HASH_STATUS_DISABLE = "3" //禁用
+	SIGNER_KEYSTORE = "keystore" //keystore文件，启动时解锁
+	SIGNER_RAWKEY   = "rawkey"   //明文私钥文件，仅测试
+	SIGNER_REMOTE   = "remote"   //远程签名服务
+)
+
+//私链交易状态
+const (
+	TX_STATUS_QUEUED    = "0" //待发送
+	TX_STATUS_SENT      = "1" //已发送，等待确认
+	TX_STATUS_CONFIRMED = "2" //已确认
+	TX_STATUS_FAILED    = "3" //失败
+)
+
+const (
+	HASH_STATUS_APPLY    = "1" //申请
+	HASH_STATUS_ENABLE   = "2" //确认
+	HASH_STATUS_DISABLE  = "3" //禁用
+	HASH_STATUS_REVERTED = "4" //链重组，已上报log失效
 )
 
 //
@@ -100,12 +136,19 @@ const (
 	GRPC_COIN_LIST_WEB    = "16" //coin上报
 	GRPC_HASH_ENABLE_WEB  = "17" //hash enable 公链log
 	GRPC_HASH_DISABLE_WEB = "18" //hash enable 公链log
+	GRPC_STREAM_ACK       = "19" //voucher确认已收到上报，Seq为上报序号
 )
 
 const (
 	//grpc_0_TYPE_hash 发送失败
 	//grpc_1_TYPE_hash 发送成功
 	GRPC_DB_PREFIX = "grpc_"
+
+	OUTBOX_SEQ_KEY      = "obs_" //上报序号
+	OUTBOX_PREFIX       = "ob_"  //ob_SEQ 待确认上报
+	OUTBOX_ACKED_PREFIX = "oba_" //oba_SEQ 已确认上报，按保留时间清理
+	OUTBOX_INDEX_PREFIX = "obi_" //obi_HASH_SEQ 上报记录索引，审批流log为hash，提现log为wdHash
+	QUERY_INDEX_KEY     = "qix_" //查询索引(txi_/obi_)已建立
 )
 
 const (
@@ -135,6 +178,7 @@ type RequestModel struct {
 }
 
 type GrpcStream struct {
+	Seq            uint64 //上报序号，voucher按序号去重及确认
 	Type           string
 	BlockNumber    uint64 //区块号
 	AppId          string //申请人
@@ -212,9 +256,6 @@ type GrpcStreamModel struct {
 //request chan
 var ReqChan chan *RequestModel = make(chan *RequestModel, CHAN_MAX_SIZE)
 
-//grpc 流数据
-var GrpcStreamChan chan *GrpcStream = make(chan *GrpcStream, CHAN_MAX_SIZE)
-
 //请求channel
 var VReqChan chan *VReq = make(chan *VReq, CHAN_MAX_SIZE)
 
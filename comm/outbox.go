@@ -0,0 +1,347 @@
+package comm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/db"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//上报记录
+type OutboxEntry struct {
+	Seq        uint64
+	Stream     *GrpcStream
+	Attempts   int   //已发送次数
+	NextTime   int64 //下次发送时间
+	CreateTime int64
+	AckTime    int64
+}
+
+var outboxLock sync.Mutex
+
+//发件箱计数，首次读取时统计，之后随落地、确认及清理更新；Ldb变化时重新统计
+var outboxCount struct {
+	ldb     *db.Ldb
+	pending int
+	acked   int
+}
+
+//有新的上报时通知发送
+var OutboxNotify = make(chan struct{}, 1)
+
+func outboxKey(prefix string, seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", prefix, seq))
+}
+
+//上报落地，分配递增序号
+func PushStream(stream *GrpcStream) (uint64, error) {
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+
+	var seq uint64
+	if data, err := Ldb.GetByte([]byte(OUTBOX_SEQ_KEY)); err == nil {
+		seq = binary.BigEndian.Uint64(data)
+	} else if err != leveldb.ErrNotFound {
+		return 0, err
+	}
+	seq++
+	stream.Seq = seq
+
+	now := time.Now().Unix()
+	data, err := json.Marshal(&OutboxEntry{Seq: seq, Stream: stream, NextTime: now, CreateTime: now})
+	if err != nil {
+		return 0, err
+	}
+	seqBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqBytes, seq)
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(OUTBOX_SEQ_KEY), seqBytes)
+	batch.Put(outboxKey(OUTBOX_PREFIX, seq), data)
+	if key := streamIndexKey(stream); key != nil {
+		batch.Put(key, nil)
+	}
+	if err = Ldb.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	if outboxCount.ldb == Ldb {
+		outboxCount.pending++
+	}
+
+	select {
+	case OutboxNotify <- struct{}{}:
+	default:
+	}
+	return seq, nil
+}
+
+//按序号顺序取到期待发送的上报
+func DueStreams(now int64, limit int) ([]*OutboxEntry, error) {
+	iter := Ldb.NewIterator(util.BytesPrefix([]byte(OUTBOX_PREFIX)), nil)
+	defer iter.Release()
+	entries := make([]*OutboxEntry, 0)
+	for iter.Next() && len(entries) < limit {
+		entry := &OutboxEntry{}
+		if err := json.Unmarshal(iter.Value(), entry); err != nil {
+			logger.Error("outbox[%s] unmarshal err: %v", string(iter.Key()), err)
+			continue
+		}
+		if entry.NextTime <= now {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, iter.Error()
+}
+
+//全部上报记录（待确认及保留中的已确认），按序号排序，供查询使用
+func ListStreams() ([]*OutboxEntry, error) {
+	entries := make([]*OutboxEntry, 0)
+	for _, prefix := range []string{OUTBOX_PREFIX, OUTBOX_ACKED_PREFIX} {
+		iter := Ldb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+		for iter.Next() {
+			entry := &OutboxEntry{}
+			if err := json.Unmarshal(iter.Value(), entry); err != nil {
+				logger.Error("outbox[%s] unmarshal err: %v", string(iter.Key()), err)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	return entries, nil
+}
+
+//按hash（提现为wdHash）经索引查询上报记录，按序号排序
+func StreamsOf(hash common.Hash) ([]*OutboxEntry, error) {
+	prefix := OUTBOX_INDEX_PREFIX + hash.Hex() + "_"
+	iter := Ldb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	entries := make([]*OutboxEntry, 0)
+	for iter.Next() {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(string(iter.Key()), prefix), 10, 64)
+		if err != nil {
+			logger.Error("illegal outbox index: %s", string(iter.Key()))
+			continue
+		}
+		entry, err := getStream(seq)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, iter.Error()
+}
+
+//待确认及已确认上报数
+func OutboxCounts() (pending, acked int, err error) {
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+	if outboxCount.ldb != Ldb {
+		if pending, err = countPrefix(OUTBOX_PREFIX); err != nil {
+			return 0, 0, err
+		}
+		if acked, err = countPrefix(OUTBOX_ACKED_PREFIX); err != nil {
+			return 0, 0, err
+		}
+		outboxCount.ldb, outboxCount.pending, outboxCount.acked = Ldb, pending, acked
+	}
+	return outboxCount.pending, outboxCount.acked, nil
+}
+
+func countPrefix(prefix string) (int, error) {
+	iter := Ldb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	count := 0
+	for iter.Next() {
+		count++
+	}
+	return count, iter.Error()
+}
+
+//待确认或已确认的上报
+func getStream(seq uint64) (*OutboxEntry, error) {
+	data, err := Ldb.GetByte(outboxKey(OUTBOX_PREFIX, seq))
+	if err == leveldb.ErrNotFound {
+		data, err = Ldb.GetByte(outboxKey(OUTBOX_ACKED_PREFIX, seq))
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := &OutboxEntry{}
+	if err = json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+//为已有上报记录建立索引，旧版本升级时使用
+func IndexStreams() error {
+	entries, err := ListStreams()
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for _, entry := range entries {
+		if key := streamIndexKey(entry.Stream); key != nil {
+			batch.Put(key, nil)
+		}
+	}
+	return Ldb.Write(batch, nil)
+}
+
+//上报记录索引：审批流log按hash，提现log按wdHash，其他类型不建索引
+func streamIndexKey(stream *GrpcStream) []byte {
+	if stream == nil {
+		return nil
+	}
+	var hash common.Hash
+	switch stream.Type {
+	case GRPC_HASH_ADD_LOG, GRPC_HASH_ENABLE_LOG, GRPC_HASH_DISABLE_LOG:
+		hash = stream.Hash
+	case GRPC_WITHDRAW_LOG:
+		hash = stream.WdHash
+	default:
+		return nil
+	}
+	return []byte(fmt.Sprintf("%s%s_%020d", OUTBOX_INDEX_PREFIX, hash.Hex(), stream.Seq))
+}
+
+//更新发送状态，已确认的不再写回
+func SaveStream(entry *OutboxEntry) error {
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+
+	key := outboxKey(OUTBOX_PREFIX, entry.Seq)
+	if has, err := Ldb.Has(key, nil); err != nil || !has {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return Ldb.PutByte(key, data)
+}
+
+//voucher确认，retention<=0时直接删除
+func AckStream(seq uint64, retention time.Duration) error {
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+
+	key := outboxKey(OUTBOX_PREFIX, seq)
+	data, err := Ldb.GetByte(key)
+	if err == leveldb.ErrNotFound {
+		logger.Debug("outbox[%d] already acked", seq)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	entry := &OutboxEntry{}
+	if err = json.Unmarshal(data, entry); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(key)
+	if retention <= 0 {
+		if key := streamIndexKey(entry.Stream); key != nil {
+			batch.Delete(key)
+		}
+	} else {
+		entry.AckTime = time.Now().Unix()
+		if data, err = json.Marshal(entry); err != nil {
+			return err
+		}
+		batch.Put(outboxKey(OUTBOX_ACKED_PREFIX, seq), data)
+	}
+	if err = Ldb.Write(batch, nil); err != nil {
+		return err
+	}
+	if outboxCount.ldb == Ldb {
+		outboxCount.pending--
+		if retention > 0 {
+			outboxCount.acked++
+		}
+	}
+	return nil
+}
+
+//清理超过保留时间的已确认上报
+func PruneStreams(retention time.Duration) (int, error) {
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+
+	deadline := time.Now().Add(-retention).Unix()
+	iter := Ldb.NewIterator(util.BytesPrefix([]byte(OUTBOX_ACKED_PREFIX)), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	pruned := 0
+	for iter.Next() {
+		entry := &OutboxEntry{}
+		if err := json.Unmarshal(iter.Value(), entry); err != nil {
+			batch.Delete(append([]byte{}, iter.Key()...))
+			pruned++
+		} else if entry.AckTime < deadline {
+			batch.Delete(append([]byte{}, iter.Key()...))
+			pruned++
+			if key := streamIndexKey(entry.Stream); key != nil {
+				batch.Delete(key)
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+	if err := Ldb.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	//批次中含索引key，按已确认记录数扣减
+	if outboxCount.ldb == Ldb {
+		outboxCount.acked -= pruned
+	}
+	return pruned, nil
+}
+
+//旧版本 grpc_0_/grpc_1_ 记录：未发送的转入发件箱，已发送的删除
+func MigrateGrpcStream() error {
+	resMap, err := Ldb.GetPrifix([]byte(GRPC_DB_PREFIX))
+	if err != nil {
+		return err
+	}
+	for key, value := range resMap {
+		if strings.HasPrefix(key, GRPC_DB_PREFIX+"0_") {
+			stream := &GrpcStream{}
+			if err := json.Unmarshal([]byte(value), stream); err != nil {
+				logger.Error("grpc[%s] unmarshal err: %v", key, err)
+				continue
+			}
+			if _, err := PushStream(stream); err != nil {
+				return err
+			}
+			logger.Info("migrate grpc stream: %s", key)
+		}
+		if err := Ldb.DelKey([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package comm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boxproject/companion/db"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func expectCounts(t *testing.T, pending, acked int) {
+	t.Helper()
+	p, a, err := OutboxCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != pending || a != acked {
+		t.Fatalf("outbox counts: got %d/%d, want %d/%d", p, a, pending, acked)
+	}
+}
+
+func TestOutboxCounts(t *testing.T) {
+	ldb, err := db.InitDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+	Ldb = ldb
+
+	//统计之前已落地的上报
+	seqs := make([]uint64, 0)
+	for i := 0; i < 3; i++ {
+		seq, err := PushStream(&GrpcStream{Type: GRPC_WITHDRAW_LOG, WdHash: common.Hash{byte(i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+	}
+	expectCounts(t, 3, 0)
+
+	if _, err = PushStream(&GrpcStream{Type: GRPC_HASH_ADD_LOG, Hash: common.Hash{9}}); err != nil {
+		t.Fatal(err)
+	}
+	expectCounts(t, 4, 0)
+
+	//保留确认记录、直接删除及重复确认
+	if err = AckStream(seqs[0], time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = AckStream(seqs[1], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = AckStream(seqs[1], time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	expectCounts(t, 2, 1)
+
+	//清理已确认记录，连同索引
+	if n, err := PruneStreams(-time.Hour); err != nil || n != 1 {
+		t.Fatalf("prune: got %d, %v, want 1", n, err)
+	}
+	expectCounts(t, 2, 0)
+	if entries, err := StreamsOf(common.Hash{0}); err != nil || len(entries) != 0 {
+		t.Fatalf("pruned stream still indexed: %v, %v", entries, err)
+	}
+	if entries, err := StreamsOf(common.Hash{2}); err != nil || len(entries) != 1 || entries[0].Seq != seqs[2] {
+		t.Fatalf("streams of %d: %v, %v", seqs[2], entries, err)
+	}
+}
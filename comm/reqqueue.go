@@ -0,0 +1,128 @@
+package comm
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	logger "github.com/alecthomas/log4go"
+)
+
+var reqQueueLock sync.Mutex
+
+//请求唯一标识
+func ReqKey(req *RequestModel) string {
+	return req.ReqType + "_" + req.Hash + "_" + req.WdHash
+}
+
+//请求预写入db后再投递，同一请求已接收或已入发送队列时不重复接收
+func PushReq(req *RequestModel) error {
+	isNew, err := landReq(req)
+	if err != nil || !isNew {
+		return err
+	}
+	//投递可能阻塞，不占用锁
+	ReqChan <- req
+	return nil
+}
+
+//请求落地，重复请求返回false
+func landReq(req *RequestModel) (bool, error) {
+	reqQueueLock.Lock()
+	defer reqQueueLock.Unlock()
+
+	id := ReqKey(req)
+	//rq_在转入发送队列(txq_)后才删除，两者均不存在时为新请求
+	for _, prefix := range []string{REQ_QUEUE_PREFIX, TX_QUEUE_PREFIX} {
+		if has, err := Ldb.Has([]byte(prefix+id), nil); err != nil {
+			logger.Error("check request failed: %v", err)
+			return false, err
+		} else if has {
+			logger.Info("duplicate request: %s", id)
+			return false, nil
+		}
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	if err = Ldb.PutByte([]byte(REQ_QUEUE_PREFIX+id), data); err != nil {
+		logger.Error("land request to db failed: %v", err)
+		return false, err
+	}
+	return true, nil
+}
+
+//请求已转入发送队列，删除预写记录
+func AckReq(req *RequestModel) error {
+	return Ldb.DelKey([]byte(REQ_QUEUE_PREFIX + ReqKey(req)))
+}
+
+//启动时重新投递未处理的请求，ctx取消后返回
+func ReplayReq(ctx context.Context) error {
+	resMap, err := Ldb.GetPrifix([]byte(REQ_QUEUE_PREFIX))
+	if err != nil {
+		return err
+	}
+	for key, value := range resMap {
+		req := &RequestModel{}
+		if err := json.Unmarshal([]byte(value), req); err != nil {
+			logger.Error("request[%s] unmarshal err: %v", key, err)
+			continue
+		}
+		logger.Info("replay request: %s", key)
+		select {
+		case ReqChan <- req:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+//上报请求唯一标识
+func VReqKey(req *VReq) string {
+	return req.ReqType + "_" + req.WdHash + "_" + req.TxHash
+}
+
+//上报请求写入db后再投递
+func PushVReq(req *VReq) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err = Ldb.PutByte([]byte(VREQ_QUEUE_PREFIX+VReqKey(req)), data); err != nil {
+		logger.Error("land vreq to db failed: %v", err)
+		return err
+	}
+	VReqChan <- req
+	return nil
+}
+
+//上报完成，删除记录
+func AckVReq(req *VReq) error {
+	return Ldb.DelKey([]byte(VREQ_QUEUE_PREFIX + VReqKey(req)))
+}
+
+//启动时重新投递未完成的上报，ctx取消后返回
+func ReplayVReq(ctx context.Context) error {
+	resMap, err := Ldb.GetPrifix([]byte(VREQ_QUEUE_PREFIX))
+	if err != nil {
+		return err
+	}
+	for key, value := range resMap {
+		req := &VReq{}
+		if err := json.Unmarshal([]byte(value), req); err != nil {
+			logger.Error("vreq[%s] unmarshal err: %v", key, err)
+			continue
+		}
+		logger.Info("replay vreq: %s", key)
+		select {
+		case VReqChan <- req:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/boxproject/companion/admin"
+	"github.com/boxproject/companion/handler"
+	"github.com/boxproject/companion/metrics"
+	"github.com/boxproject/companion/watcher"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const (
+	STOP_TIMEOUT       = SHUTDOWN_TIMEOUT + 10*time.Second //等待进程退出的最长时间
+	STOP_POLL_INTERVAL = 200 * time.Millisecond
+)
+
+//运行状态
+type AdminStatus struct {
+	Pid    int                   `json:"pid"`
+	Paused bool                  `json:"paused"` //交易发送是否暂停
+	Head   uint64                `json:"head"`
+	Cursor uint64                `json:"cursor"`
+	Ready  *metrics.HealthReport `json:"ready"`
+}
+
+//注册管理接口
+func registerAdmin(srv *admin.Server, stopCh chan<- struct{}, asyHandler *handler.PriAsyEthHandler, logWatcher *watcher.EthEventLogWatcher) {
+	srv.Handle(http.MethodGet, "/status", func(r *http.Request) (interface{}, error) {
+		head, cursor := metrics.Blocks()
+		return &AdminStatus{
+			Pid:    os.Getpid(),
+			Paused: asyHandler.Paused(),
+			Head:   head,
+			Cursor: cursor,
+			Ready:  metrics.RunChecks(false),
+		}, nil
+	})
+	srv.Handle(http.MethodPost, "/stop", func(r *http.Request) (interface{}, error) {
+		select {
+		case stopCh <- struct{}{}:
+		default:
+		}
+		return nil, nil
+	})
+	srv.Handle(http.MethodPost, "/pause", func(r *http.Request) (interface{}, error) {
+		asyHandler.Pause()
+		return nil, nil
+	})
+	srv.Handle(http.MethodPost, "/resume", func(r *http.Request) (interface{}, error) {
+		asyHandler.Resume()
+		return nil, nil
+	})
+	srv.Handle(http.MethodGet, "/txs", func(r *http.Request) (interface{}, error) {
+		return asyHandler.Txs(r.URL.Query()["status"]...)
+	})
+	srv.Handle(http.MethodPost, "/txs/retry", func(r *http.Request) (interface{}, error) {
+		return asyHandler.Retry(r.FormValue("id"))
+	})
+	srv.Handle(http.MethodPost, "/cursor", func(r *http.Request) (interface{}, error) {
+		var target uint64
+		if set := r.FormValue("set"); set != "" {
+			n, err := strconv.ParseUint(set, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("illegal set: %v", err)
+			}
+			target = n
+		} else {
+			n, err := strconv.ParseUint(r.FormValue("rewind"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("illegal rewind: %v", err)
+			}
+			cursor, err := logWatcher.Cursor()
+			if err != nil {
+				return nil, err
+			}
+			target = rewind(cursor, n)
+		}
+		logWatcher.SetCursor(target)
+		head, _ := metrics.Blocks()
+		return &CursorInfo{Cursor: target, Head: head, Running: true}, nil
+	})
+	//仅指定from时回退游标，指定to或dry_run时重新处理区间内的log
+	srv.Handle(http.MethodPost, "/rescan", func(r *http.Request) (interface{}, error) {
+		from, err := strconv.ParseUint(r.FormValue("from"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("illegal from: %v", err)
+		}
+		dryRun := r.FormValue("dry_run") == "true"
+		if r.FormValue("to") == "" && !dryRun {
+			return nil, logWatcher.RescanFrom(from)
+		}
+		var to uint64
+		if r.FormValue("to") != "" {
+			if to, err = strconv.ParseUint(r.FormValue("to"), 10, 64); err != nil {
+				return nil, fmt.Errorf("illegal to: %v", err)
+			}
+		} else if to, err = logWatcher.Cursor(); err != nil {
+			return nil, err
+		}
+		return logWatcher.RescanRange(from, to, dryRun)
+	})
+}
+
+func adminClient(c *cli.Context) (*admin.Client, error) {
+	cfg, err := LoadConfig(c.String("c"), "config.json")
+	if err != nil {
+		return nil, err
+	}
+	return admin.NewClient(cfg.AdminSocket), nil
+}
+
+//通过管理接口通知退出，管理接口不可用时按pid文件发送SIGINT，等待进程退出
+func StopCmd(c *cli.Context) error {
+	cfg, err := LoadConfig(c.String("c"), "config.json")
+	if err != nil {
+		return err
+	}
+	pid, pidErr := admin.ReadPidFile(cfg.PidFile)
+	err = admin.NewClient(cfg.AdminSocket).Post("/stop", nil, nil)
+	if err == admin.ErrNotRunning {
+		if pidErr != nil {
+			return pidErr
+		}
+		if err = syscall.Kill(pid, syscall.SIGINT); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if pidErr != nil {
+		fmt.Println("companion is stopping")
+		return nil
+	}
+
+	deadline := time.Now().Add(STOP_TIMEOUT)
+	for admin.Alive(pid) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("companion[%d] not exited after %v", pid, STOP_TIMEOUT)
+		}
+		time.Sleep(STOP_POLL_INTERVAL)
+	}
+	fmt.Printf("companion[%d] stopped\n", pid)
+	return nil
+}
+
+//暂停发送私链交易
+func PauseCmd(c *cli.Context) error {
+	client, err := adminClient(c)
+	if err != nil {
+		return err
+	}
+	if err = client.Post("/pause", nil, nil); err != nil {
+		return err
+	}
+	fmt.Println("tx sender paused")
+	return nil
+}
+
+//恢复发送私链交易
+func ResumeCmd(c *cli.Context) error {
+	client, err := adminClient(c)
+	if err != nil {
+		return err
+	}
+	if err = client.Post("/resume", nil, nil); err != nil {
+		return err
+	}
+	fmt.Println("tx sender resumed")
+	return nil
+}
@@ -1,10 +1,12 @@
 package commands
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -15,15 +17,17 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/AlecAivazis/survey"
 	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
 	"github.com/boxproject/companion/config"
-)
-
-const (
-	ServiceName_HASH    = "/companion/hash"    //上链
-	ServiceName_APPLY   = "/companion/apply"   //提现
+	"github.com/boxproject/companion/handler"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/urfave/cli.v1"
 )
 
 var (
@@ -47,8 +51,38 @@ var (
 		},
 	}
 
-	ErrAESTextSize = errors.New("ciphertext is not a multiple of the block size")
-	ErrAESPadding  = errors.New("cipher padding size error")
+	passphraseQs = []*survey.Question{
+		{
+			Name: "passphrase",
+			Prompt: &survey.Password{
+				Message: "Input keystore passphrase: ",
+			},
+			Validate: survey.Required,
+		},
+		{
+			Name: "passphraseConfirm",
+			Prompt: &survey.Password{
+				Message: "Input keystore passphrase again: ",
+			},
+			Validate: survey.Required,
+		},
+	}
+
+	ErrAESTextSize      = errors.New("ciphertext is not a multiple of the block size")
+	ErrAESPadding       = errors.New("cipher padding size error")
+	ErrPassphraseFormat = errors.New("illegal creator_passphrase format")
+	ErrPassphraseAuth   = errors.New("wrong password or creator_passphrase corrupted")
+	ErrPasswordMismatch = errors.New("the two inputs are inconsistent")
+)
+
+//creator_passphrase 加密参数
+const (
+	passphraseVersion = "v1"
+	passphraseSaltLen = 32
+	passphraseKeyLen  = 32
+	passphraseScryptN = 1 << 18
+	passphraseScryptR = 8
+	passphraseScryptP = 1
 )
 
 type answers struct {
@@ -93,21 +127,12 @@ func DefaultConfigDir() string {
 	return ""
 }
 
+//读取配置，见config.Load
 func LoadConfig(configPath, defaultFileName string) (*config.Config, error) {
 	configPath = GetConfigFilePath(configPath, defaultFileName)
 
 	logger.Debug("config path: %s", configPath)
-	data, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		return nil, err
-	}
-
-	var cfg config.Config
-	if err = json.Unmarshal(data, &cfg); err != nil {
-		return nil, err
-	}
-
-	return &cfg, nil
+	return config.Load(configPath)
 }
 
 // configPath 不为空时，不检查fileName
@@ -156,7 +181,165 @@ func InitLogger() {
 	logger.LoadConfiguration(logFile)
 }
 
-// AES解密
+//密文格式: v1$hex(salt)$hex(nonce)$hex(ciphertext)
+//scrypt 派生密钥，AES-256-GCM 加密
+func encryptPassphrase(password, passphrase []byte) (string, error) {
+	salt := make([]byte, passphraseSaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	aead, err := newPassphraseAEAD(password, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	cipherText := aead.Seal(nil, nonce, passphrase, []byte(passphraseVersion))
+	return strings.Join([]string{passphraseVersion, hex.EncodeToString(salt), hex.EncodeToString(nonce), hex.EncodeToString(cipherText)}, "$"), nil
+}
+
+//解密keystore密码，兼容旧版CBC格式
+func decryptPassphrase(password []byte, encrypted string) ([]byte, error) {
+	if !strings.HasPrefix(encrypted, passphraseVersion+"$") {
+		src, err := hex.DecodeString(encrypted)
+		if err != nil {
+			return nil, ErrPassphraseFormat
+		}
+		logger.Warn("creator_passphrase uses the legacy cipher format, please re-encrypt it with `companion encrypt`")
+		return aesDecrypt(password, src)
+	}
+
+	parts := strings.Split(encrypted, "$")
+	if len(parts) != 4 {
+		return nil, ErrPassphraseFormat
+	}
+	var fields [3][]byte
+	for i, part := range parts[1:] {
+		data, err := hex.DecodeString(part)
+		if err != nil {
+			return nil, ErrPassphraseFormat
+		}
+		fields[i] = data
+	}
+	aead, err := newPassphraseAEAD(password, fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fields[1]) != aead.NonceSize() {
+		return nil, ErrPassphraseFormat
+	}
+	plainText, err := aead.Open(nil, fields[1], fields[2], []byte(passphraseVersion))
+	if err != nil {
+		return nil, ErrPassphraseAuth
+	}
+	return plainText, nil
+}
+
+func newPassphraseAEAD(password, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(password, salt, passphraseScryptN, passphraseScryptR, passphraseScryptP, passphraseKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(aesBlock)
+}
+
+//启动密码: --password-file、--password-fd，否则终端输入
+func readPassword(c *cli.Context) ([]byte, error) {
+	if file := c.String("password-file"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+
+	if c.IsSet("password-fd") {
+		f := os.NewFile(uintptr(c.Int("password-fd")), "password-fd")
+		defer f.Close()
+		line, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+
+	var password string
+	if err := survey.AskOne(qs[0].Prompt, &password, survey.Required); err != nil {
+		return nil, err
+	}
+	return []byte(password), nil
+}
+
+//解密creator_passphrase并解锁keystore，返回解密后的私钥
+func unlockKeystore(c *cli.Context, cfg *config.EthCfg) (*keystore.Key, error) {
+	password, err := readPassword(c)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := decryptPassphrase(password, cfg.CreatorPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	keyJson, err := ioutil.ReadFile(cfg.CreatorKeystorePath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keystore.DecryptKey(keyJson, string(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Creator != "" && !bytes.Equal(key.Address.Bytes(), common.HexToAddress(cfg.Creator).Bytes()) {
+		return nil, fmt.Errorf("keystore address %s mismatch creator %s", key.Address.Hex(), cfg.Creator)
+	}
+	return key, nil
+}
+
+//按配置创建creator签名者，keystore方式先解密keystore密码，解锁后的私钥直接用于签名，不重复解密
+func loadSigner(c *cli.Context, cfg *config.Config) (handler.Signer, error) {
+	var signer handler.Signer
+	var err error
+	if signerType := cfg.PriEthCfg.SignerType; signerType == "" || signerType == comm.SIGNER_KEYSTORE {
+		key, err := unlockKeystore(c, &cfg.PriEthCfg)
+		if err != nil {
+			logger.Error("Unlock keystore failed. cause: %v", err)
+			return nil, err
+		}
+		signer = handler.NewKeystoreSignerFromKey(key)
+	} else {
+		signer, err = handler.NewSigner(cfg.PriEthCfg)
+	}
+	//密码不再保留
+	cfg.PriEthCfg.CreatorPassphrase = ""
+	if err != nil {
+		logger.Error("Init signer failed. cause: %v", err)
+		return nil, err
+	}
+	return signer, nil
+}
+
+//私链节点列表，geth_api在前，去重
+func gethEndpoints(cfg config.EthCfg) []string {
+	urls := make([]string, 0, len(cfg.GethAPIs)+1)
+	seen := make(map[string]bool)
+	for _, url := range append([]string{cfg.GethAPI}, cfg.GethAPIs...) {
+		url = strings.TrimSpace(url)
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// AES解密，旧版CBC格式
 func aesDecrypt(password, src []byte) ([]byte, error) {
 	// 长度不能小于aes.Blocksize
 	if len(src) < aes.BlockSize*2 || len(src)%aes.BlockSize != 0 {
@@ -181,40 +364,9 @@ func aesDecrypt(password, src []byte) ([]byte, error) {
 	mode.CryptBlocks(decryptText, src[:srcLen])
 	paddingLen := int(decryptText[srcLen-1])
 
-	if paddingLen > 16 {
+	if paddingLen > 16 || paddingLen == 0 {
 		return nil, ErrAESPadding
 	}
 
 	return decryptText[:srcLen-paddingLen], nil
 }
-
-// AES加密
-func aesEncrypt(password, src []byte) ([]byte, error) {
-	padLen := aes.BlockSize - (len(src) % aes.BlockSize)
-	for i := 0; i < padLen; i++ {
-		src = append(src, byte(padLen))
-	}
-
-	padLen = aes.BlockSize - (len(password) % aes.BlockSize)
-	for i := 0; i < padLen; i++ {
-		password = append(password, byte(padLen))
-	}
-
-	aesBlock, err := aes.NewCipher(password)
-	if err != nil {
-		fmt.Printf("aes new cipher error: %v\n", err)
-		return nil, err
-	}
-
-	srcLen := len(src)
-	encryptText := make([]byte, srcLen+aes.BlockSize)
-	iv := encryptText[srcLen:]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return nil, err
-	}
-
-	mode := cipher.NewCBCEncrypter(aesBlock, iv)
-	mode.CryptBlocks(encryptText[:srcLen], src)
-
-	return encryptText, nil
-}
@@ -0,0 +1,157 @@
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/config"
+	"github.com/boxproject/companion/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const CHECK_TIMEOUT = 5 * time.Second
+
+var (
+	ErrConfigCheck  = errors.New("config check failed")
+	ErrNoContract   = errors.New("no contract code at address")
+	ErrNoGethOnline = errors.New("no reachable geth endpoint")
+)
+
+//校验配置，并检查keystore、证书、geth及sink合约是否可用
+func ConfigCheckCmd(c *cli.Context) error {
+	report := &metrics.HealthReport{OK: true}
+	check := func(name string, err error) {
+		result := &metrics.CheckResult{Name: name, OK: err == nil}
+		if err != nil {
+			result.Err = err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	//无法解析时不再继续检查
+	cfg, err := LoadConfig(c.String("c"), "config.json")
+	if err != nil {
+		check("config", err)
+		printJSON(report)
+		return ErrConfigCheck
+	}
+	check("config", cfg.Validate())
+	check("signer", checkSignerKey(&cfg.PriEthCfg))
+	check("client_cert", checkKeyPair(cfg.ClientCert, cfg.ClientKey))
+	if cfg.ServerCert != "" {
+		check("server_cert", checkKeyPair(cfg.ServerCert, cfg.ServerKey))
+	}
+
+	//各节点连通，sink合约在首个可用节点上检查
+	var client *ethclient.Client
+	for _, url := range gethEndpoints(cfg.PriEthCfg) {
+		ec, head, err := dialGeth(url)
+		if err != nil {
+			check("geth "+url, err)
+			continue
+		}
+		check(fmt.Sprintf("geth %s (head %d)", url, head), nil)
+		if client == nil {
+			client = ec
+			defer client.Close()
+		} else {
+			ec.Close()
+		}
+	}
+	if client == nil {
+		check("sink", ErrNoGethOnline)
+	} else {
+		check("sink", checkContract(client, cfg.SinkAddress))
+		if cfg.PriEthCfg.OracleAddress != "" {
+			check("oracle", checkContract(client, cfg.PriEthCfg.OracleAddress))
+		}
+	}
+
+	if err = printJSON(report); err != nil {
+		return err
+	}
+	if !report.OK {
+		return ErrConfigCheck
+	}
+	return nil
+}
+
+//签名私钥可读且与creator一致，keystore不解密
+func checkSignerKey(cfg *config.EthCfg) error {
+	var address common.Address
+	switch cfg.SignerType {
+	case comm.SIGNER_KEYSTORE:
+		data, err := ioutil.ReadFile(cfg.CreatorKeystorePath)
+		if err != nil {
+			return err
+		}
+		key := &struct {
+			Address string `json:"address"`
+		}{}
+		if err = json.Unmarshal(data, key); err != nil {
+			return fmt.Errorf("%s: %v", cfg.CreatorKeystorePath, err)
+		}
+		if !common.IsHexAddress(key.Address) {
+			return fmt.Errorf("%s: illegal keystore address %q", cfg.CreatorKeystorePath, key.Address)
+		}
+		address = common.HexToAddress(key.Address)
+	case comm.SIGNER_RAWKEY:
+		key, err := crypto.LoadECDSA(cfg.SignerKeyPath)
+		if err != nil {
+			return err
+		}
+		address = crypto.PubkeyToAddress(key.PublicKey)
+	default:
+		//远程签名启动时校验
+		return nil
+	}
+	if address != common.HexToAddress(cfg.Creator) {
+		return fmt.Errorf("key address %s mismatch creator %s", address.Hex(), cfg.Creator)
+	}
+	return nil
+}
+
+func checkKeyPair(certFile, keyFile string) error {
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+	return err
+}
+
+//连接节点并获取最新区块
+func dialGeth(url string) (*ethclient.Client, uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CHECK_TIMEOUT)
+	defer cancel()
+	client, err := ethclient.DialContext(ctx, url)
+	if err != nil {
+		return nil, 0, err
+	}
+	head, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		client.Close()
+		return nil, 0, err
+	}
+	return client, head.Number.Uint64(), nil
+}
+
+//合约已部署
+func checkContract(client *ethclient.Client, address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), CHECK_TIMEOUT)
+	defer cancel()
+	code, err := client.CodeAt(ctx, common.HexToAddress(address), nil)
+	if err != nil {
+		return err
+	}
+	if len(code) == 0 {
+		return fmt.Errorf("%v: %s", ErrNoContract, address)
+	}
+	return nil
+}
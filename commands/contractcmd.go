@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/config"
+	"github.com/boxproject/companion/handler"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//等待交易回执超时
+const RECEIPT_TIMEOUT = 5 * time.Minute
+
+var ErrTxFailed = errors.New("transaction failed")
+
+//合约操作结果
+type txResult struct {
+	TxHash      string `json:"txHash"`
+	BlockNumber uint64 `json:"blockNumber"`
+	Status      bool   `json:"status"`
+	GasUsed     uint64 `json:"gasUsed"`
+	Contract    string `json:"contract,omitempty"`
+}
+
+//合约管理上下文：配置、私链连接、creator交易参数
+type contractCtx struct {
+	cfg    *config.Config
+	client *ethclient.Client
+}
+
+func newContractCtx(c *cli.Context) (*contractCtx, error) {
+	cfg, err := LoadConfig(c.String("c"), "config.json")
+	if err != nil {
+		logger.Error("Load config failed. cause: %v", err)
+		return nil, err
+	}
+	client, err := ethclient.Dial(cfg.PriEthCfg.GethAPI)
+	if err != nil {
+		logger.Error("Dial to the geth node failed. cause: %v", err)
+		return nil, err
+	}
+	return &contractCtx{cfg: cfg, client: client}, nil
+}
+
+//creator签名的交易参数
+func (ctx *contractCtx) transactor(c *cli.Context) (*bind.TransactOpts, error) {
+	signer, err := loadSigner(c, ctx.cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts := handler.NewTransactOpts(signer)
+	opts.GasLimit = uint64(ctx.cfg.PriEthCfg.GasLimit)
+	return opts, nil
+}
+
+//等待交易上链并输出结果
+func (ctx *contractCtx) waitAndPrint(tx *types.Transaction) error {
+	result, err := ctx.wait(tx)
+	if err != nil {
+		return err
+	}
+	if err = printJSON(result); err != nil {
+		return err
+	}
+	if !result.Status {
+		return ErrTxFailed
+	}
+	return nil
+}
+
+func (ctx *contractCtx) wait(tx *types.Transaction) (*txResult, error) {
+	logger.Info("wait for tx %s mined...", tx.Hash().Hex())
+	timeout, cancel := context.WithTimeout(context.Background(), RECEIPT_TIMEOUT)
+	defer cancel()
+	receipt, err := bind.WaitMined(timeout, ctx.client, tx)
+	if err != nil {
+		return nil, err
+	}
+	result := &txResult{
+		TxHash:      tx.Hash().Hex(),
+		BlockNumber: receipt.BlockNumber.Uint64(),
+		Status:      receipt.Status == types.ReceiptStatusSuccessful,
+		GasUsed:     receipt.GasUsed,
+	}
+	if receipt.ContractAddress != (common.Address{}) {
+		result.Contract = receipt.ContractAddress.Hex()
+	}
+	return result, nil
+}
+
+//合约地址，命令行优先
+func addressArg(c *cli.Context, name, def string) (common.Address, error) {
+	addr := c.String(name)
+	if addr == "" {
+		addr = def
+	}
+	if !common.IsHexAddress(addr) {
+		return common.Address{}, fmt.Errorf("illegal %s address: %q", name, addr)
+	}
+	return common.HexToAddress(addr), nil
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
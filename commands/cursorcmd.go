@@ -0,0 +1,218 @@
+package commands
+
+import (
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/boxproject/companion/admin"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/config"
+	"github.com/boxproject/companion/db"
+	"github.com/boxproject/companion/ethcli"
+	"github.com/boxproject/companion/watcher"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//手动重新扫描超时
+const RESCAN_TIMEOUT = 10 * time.Minute
+
+//游标信息
+type CursorInfo struct {
+	Cursor  uint64 `json:"cursor"`
+	Head    uint64 `json:"head,omitempty"`
+	File    string `json:"file,omitempty"`
+	Running bool   `json:"running"` //运行中时设置游标在下一个新区块时生效
+}
+
+//游标文件，--block-file优先
+func cursorFile(c *cli.Context, cfg *config.Config) string {
+	if f := c.String("block-file"); f != "" {
+		return f
+	}
+	return cfg.PriEthCfg.CursorFilePath
+}
+
+func readCursor(path string) (uint64, error) {
+	cursor, err := watcher.ReadBlockNumberFromFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return cursor.Uint64(), nil
+}
+
+//查看游标，运行中时通过管理接口查询
+func CursorShowCmd(c *cli.Context) error {
+	cfg, err := LoadConfig(c.String("c"), "config.json")
+	if err != nil {
+		return err
+	}
+	status := &AdminStatus{}
+	err = admin.NewClient(cfg.AdminSocket).Get("/status", nil, status)
+	if err == nil {
+		return printJSON(&CursorInfo{Cursor: status.Cursor, Head: status.Head, Running: true})
+	} else if err != admin.ErrNotRunning {
+		return err
+	}
+	path := cursorFile(c, cfg)
+	cursor, err := readCursor(path)
+	if err != nil {
+		return err
+	}
+	return printJSON(&CursorInfo{Cursor: cursor, File: path})
+}
+
+//设置游标
+func CursorSetCmd(c *cli.Context) error {
+	n, err := strconv.ParseUint(c.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("usage: cursor set BLOCK: %v", err)
+	}
+	return moveCursor(c, url.Values{"set": {strconv.FormatUint(n, 10)}}, func(uint64) uint64 {
+		return n
+	})
+}
+
+//游标回退N个区块
+func CursorRewindCmd(c *cli.Context) error {
+	n, err := strconv.ParseUint(c.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("usage: cursor rewind N: %v", err)
+	}
+	return moveCursor(c, url.Values{"rewind": {strconv.FormatUint(n, 10)}}, func(cursor uint64) uint64 {
+		return rewind(cursor, n)
+	})
+}
+
+func rewind(cursor, n uint64) uint64 {
+	if n > cursor {
+		return 0
+	}
+	return cursor - n
+}
+
+//运行中时通过管理接口设置，否则直接写游标文件
+func moveCursor(c *cli.Context, params url.Values, target func(cursor uint64) uint64) error {
+	cfg, err := LoadConfig(c.String("c"), "config.json")
+	if err != nil {
+		return err
+	}
+	info := &CursorInfo{Running: true}
+	err = admin.NewClient(cfg.AdminSocket).Post("/cursor", params, info)
+	if err == nil {
+		return printJSON(info)
+	} else if err != admin.ErrNotRunning {
+		return err
+	}
+	return writeCursor(c, cfg, target)
+}
+
+//直接写游标文件
+func writeCursor(c *cli.Context, cfg *config.Config, target func(cursor uint64) uint64) error {
+	path := cursorFile(c, cfg)
+	cursor, err := readCursor(path)
+	if err != nil {
+		return err
+	}
+	info := &CursorInfo{Cursor: target(cursor), File: path}
+	if err = watcher.WriteCheckpointBlockNumberToFile(path, new(big.Int).SetUint64(info.Cursor)); err != nil {
+		return err
+	}
+	return printJSON(info)
+}
+
+//重新扫描：仅指定--from时回退游标至from-1；指定--to或--dry-run时重新处理[from, to]区块，不移动游标。
+//运行中时通过管理接口执行，否则在本地打开leveldb执行，上报在下次启动时发送
+func RescanCmd(c *cli.Context) error {
+	if !c.IsSet("from") {
+		return fmt.Errorf("--from is required")
+	}
+	from := c.Uint64("from")
+	ranged := c.IsSet("to") || c.Bool("dry-run")
+	cfg, err := LoadConfig(c.String("c"), "config.json")
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{"from": {strconv.FormatUint(from, 10)}}
+	if c.IsSet("to") {
+		params.Set("to", strconv.FormatUint(c.Uint64("to"), 10))
+	}
+	if c.Bool("dry-run") {
+		params.Set("dry_run", "true")
+	}
+	client := admin.NewClient(cfg.AdminSocket)
+	client.SetTimeout(RESCAN_TIMEOUT)
+	result := &watcher.RescanResult{}
+	err = client.Post("/rescan", params, result)
+	if err == nil {
+		if !ranged {
+			fmt.Printf("rescan from block %d at next head\n", from)
+			return nil
+		}
+		return printJSON(result)
+	} else if err != admin.ErrNotRunning {
+		return err
+	}
+
+	if !ranged {
+		if from == 0 {
+			from = 1
+		}
+		return writeCursor(c, cfg, func(uint64) uint64 {
+			return from - 1
+		})
+	}
+	logW, closeFn, err := localWatcher(c, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	to := c.Uint64("to")
+	if !c.IsSet("to") {
+		if to, err = logW.Cursor(); err != nil {
+			return err
+		}
+	}
+	result, err = logW.RescanRange(from, to, c.Bool("dry-run"))
+	if result != nil {
+		if printErr := printJSON(result); printErr != nil {
+			return printErr
+		}
+	}
+	return err
+}
+
+//未运行时用于重新扫描的watcher
+func localWatcher(c *cli.Context, cfg *config.Config) (*watcher.EthEventLogWatcher, func(), error) {
+	ldb, err := db.InitDb(cfg.LevelDbPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	comm.Ldb = ldb
+	client, err := ethcli.Dial(gethEndpoints(cfg.PriEthCfg)...)
+	if err != nil {
+		ldb.Close()
+		return nil, nil, err
+	}
+	closeFn := func() {
+		client.Close()
+		ldb.Close()
+	}
+	addresses, err := watchAddresses(cfg)
+	if err != nil {
+		closeFn()
+		return nil, nil, err
+	}
+	logW, err := watcher.NewEthEventLogWatcher(client, &cfg.PriEthCfg, cursorFile(c, cfg), ldb, addresses)
+	if err == nil {
+		err = logW.SetEvents(watcher.PriEventMap)
+	}
+	if err != nil {
+		closeFn()
+		return nil, nil, err
+	}
+	return logW, closeFn, nil
+}
@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/AlecAivazis/survey"
+	logger "github.com/alecthomas/log4go"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//加密keystore密码，输出写入config.json的creator_passphrase
+func EncryptCmd(c *cli.Context) error {
+	var ans answers
+	if err := survey.Ask(passphraseQs, &ans); err != nil {
+		return err
+	}
+	if ans.Passphrase != ans.PassphraseConfirm {
+		return ErrPasswordMismatch
+	}
+
+	//指定了配置文件时校验keystore密码
+	if c.String("c") != "" {
+		cfg, err := LoadConfig(c.String("c"), "config.json")
+		if err != nil {
+			logger.Error("Load config failed. cause: %v", err)
+			return err
+		}
+		keyJson, err := ioutil.ReadFile(cfg.PriEthCfg.CreatorKeystorePath)
+		if err != nil {
+			return err
+		}
+		if _, err = keystore.DecryptKey(keyJson, ans.Passphrase); err != nil {
+			return err
+		}
+	}
+
+	if err := survey.Ask(qs, &ans); err != nil {
+		return err
+	}
+	if ans.Password != ans.Confirm {
+		return ErrPasswordMismatch
+	}
+
+	encrypted, err := encryptPassphrase([]byte(ans.Password), []byte(ans.Passphrase))
+	if err != nil {
+		return err
+	}
+
+	if out := c.String("output"); out != "" {
+		return ioutil.WriteFile(out, []byte(encrypted+"\n"), 0600)
+	}
+	fmt.Println(encrypted)
+	return nil
+}
@@ -0,0 +1,149 @@
+package commands
+
+import (
+	"math/big"
+
+	"github.com/boxproject/companion/contract"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//oracle节点
+type oracleNode struct {
+	Index   int64  `json:"index"`
+	Signer  string `json:"signer"`
+	Enabled bool   `json:"enabled"`
+}
+
+//oracle状态
+type oracleStatus struct {
+	Oracle            string `json:"oracle"`
+	Boss              string `json:"boss"`
+	Count             int64  `json:"count"`
+	TotalEnabledNodes int64  `json:"totalEnabledNodes"`
+	Creator           string `json:"creator"`
+	CreatorIsSigner   bool   `json:"creatorIsSigner"`
+}
+
+//部署oracle合约，creator成为boss
+func OracleDeployCmd(c *cli.Context) error {
+	ctx, err := newContractCtx(c)
+	if err != nil {
+		return err
+	}
+	defer ctx.client.Close()
+	opts, err := ctx.transactor(c)
+	if err != nil {
+		return err
+	}
+	_, tx, _, err := contract.DeployOracle(opts, ctx.client)
+	if err != nil {
+		return err
+	}
+	return ctx.waitAndPrint(tx)
+}
+
+//授权节点签名人，仅boss可执行
+func OracleAddSignerCmd(c *cli.Context) error {
+	return oracleTransact(c, (*contract.Oracle).AddSigner)
+}
+
+//停用节点签名人，仅boss可执行
+func OracleDisableSignerCmd(c *cli.Context) error {
+	return oracleTransact(c, (*contract.Oracle).DisableSigner)
+}
+
+//列出节点签名人
+func OracleListCmd(c *cli.Context) error {
+	ctx, oracle, err := loadOracle(c)
+	if err != nil {
+		return err
+	}
+	defer ctx.client.Close()
+	count, err := oracle.Count(nil)
+	if err != nil {
+		return err
+	}
+	nodes := make([]*oracleNode, 0)
+	//0号为占位节点
+	for i := int64(1); i < count.Int64(); i++ {
+		signer, enabled, err := oracle.IndexOf(nil, big.NewInt(i))
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, &oracleNode{Index: i, Signer: signer.Hex(), Enabled: enabled})
+	}
+	return printJSON(nodes)
+}
+
+//oracle合约状态
+func OracleStatusCmd(c *cli.Context) error {
+	ctx, oracle, err := loadOracle(c)
+	if err != nil {
+		return err
+	}
+	defer ctx.client.Close()
+	oracleAddr, _ := addressArg(c, "oracle", ctx.cfg.PriEthCfg.OracleAddress)
+	status := &oracleStatus{Oracle: oracleAddr.Hex(), Creator: ctx.cfg.PriEthCfg.Creator}
+	boss, err := oracle.Boss(nil)
+	if err != nil {
+		return err
+	}
+	status.Boss = boss.Hex()
+	count, err := oracle.Count(nil)
+	if err != nil {
+		return err
+	}
+	status.Count = count.Int64()
+	total, err := oracle.TotalEnabledNodes(nil)
+	if err != nil {
+		return err
+	}
+	status.TotalEnabledNodes = total.Int64()
+	if common.IsHexAddress(status.Creator) {
+		if status.CreatorIsSigner, err = oracle.IsSigner(nil, common.HexToAddress(status.Creator)); err != nil {
+			return err
+		}
+	}
+	return printJSON(status)
+}
+
+func loadOracle(c *cli.Context) (*contractCtx, *contract.Oracle, error) {
+	ctx, err := newContractCtx(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	oracleAddr, err := addressArg(c, "oracle", ctx.cfg.PriEthCfg.OracleAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	oracle, err := contract.NewOracle(oracleAddr, ctx.client)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctx, oracle, nil
+}
+
+//以--signer为参数执行oracle写操作
+func oracleTransact(c *cli.Context, fn func(*contract.Oracle, *bind.TransactOpts, common.Address) (*types.Transaction, error)) error {
+	ctx, oracle, err := loadOracle(c)
+	if err != nil {
+		return err
+	}
+	defer ctx.client.Close()
+	signer, err := addressArg(c, "signer", "")
+	if err != nil {
+		return err
+	}
+	opts, err := ctx.transactor(c)
+	if err != nil {
+		return err
+	}
+	tx, err := fn(oracle, opts, signer)
+	if err != nil {
+		return err
+	}
+	return ctx.waitAndPrint(tx)
+}
@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/config"
+	"github.com/boxproject/companion/grpcserver"
+	"github.com/boxproject/companion/handler"
+	"github.com/boxproject/companion/watcher"
+)
+
+//可热加载的配置项，其余配置项变更需重启
+var reloadableFields = map[string]bool{
+	"pri_eth.gas_limit":          true,
+	"pri_eth.gas_price":          true,
+	"pri_eth.check_block_before": true,
+	"router_info.ser_voucher":    true,
+	"router_info.ser_companion":  true,
+	"router_info.companion_name": true,
+	"client_cert":                true,
+	"client_key":                 true,
+	"grpc_ser_host":              true,
+}
+
+//SIGHUP时重新读取配置文件及log.xml，应用可热加载的配置项
+type reloader struct {
+	path       string
+	lock       sync.Mutex
+	cfg        *config.Config //当前生效的文件配置，不含解密后的密码
+	grpcCancel context.CancelFunc
+	asyHandler *handler.PriAsyEthHandler
+	logWatcher *watcher.EthEventLogWatcher
+}
+
+func newReloader(path string, cfg *config.Config, asyHandler *handler.PriAsyEthHandler, logWatcher *watcher.EthEventLogWatcher) *reloader {
+	return &reloader{path: path, cfg: cfg, asyHandler: asyHandler, logWatcher: logWatcher}
+}
+
+//重新加载，存在不可热加载的变更时整体拒绝
+func (r *reloader) reload() {
+	InitLogger()
+	logger.Info("[RELOAD] log.xml reloaded")
+
+	cfg, err := config.Load(r.path)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		logger.Error("[RELOAD] load %s failed, keep current config. cause: %v", r.path, err)
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	changes := config.Diff(r.cfg, cfg)
+	if len(changes) == 0 {
+		logger.Info("[RELOAD] config unchanged")
+		return
+	}
+	rejected := false
+	for _, c := range changes {
+		if !reloadableFields[c.Field] {
+			rejected = true
+			logger.Error("[RELOAD] %s, restart required", c)
+		} else {
+			logger.Info("[RELOAD] %s", c)
+		}
+	}
+	if rejected {
+		logger.Error("[RELOAD] config rejected, keep current config")
+		return
+	}
+
+	grpcChanged := false
+	for _, c := range changes {
+		if c.Field == "client_cert" || c.Field == "client_key" || c.Field == "grpc_ser_host" || strings.HasPrefix(c.Field, "router_info.") {
+			grpcChanged = true
+		}
+	}
+	//新证书不可用时不断开当前连接
+	if grpcChanged {
+		if err = grpcserver.CheckCredential(cfg); err != nil {
+			for _, c := range changes {
+				logger.Error("[RELOAD] %s", c)
+			}
+			logger.Error("[RELOAD] load grpc credential failed, keep current config. cause: %v", err)
+			return
+		}
+	}
+	r.cfg = cfg
+	r.asyHandler.Reload(cfg.PriEthCfg)
+	r.logWatcher.SetCheckBefore(cfg.PriEthCfg.CheckBlockBefore)
+	if grpcChanged && r.grpcCancel != nil {
+		logger.Info("[RELOAD] reconnect grpc to %s", cfg.GrpcSerHost)
+		r.grpcCancel()
+	}
+	logger.Info("[RELOAD] config applied")
+}
+
+//gRPC连接，热加载gRPC配置时以新配置重连
+func (r *reloader) runGrpc(ctx context.Context) error {
+	for {
+		connCtx, cancel := context.WithCancel(ctx)
+		r.lock.Lock()
+		r.grpcCancel = cancel
+		cfg := r.cfg
+		r.lock.Unlock()
+
+		err := initGrpcSer(connCtx, cfg)
+		reloaded := connCtx.Err() != nil && ctx.Err() == nil
+		cancel()
+		if err != nil || !reloaded {
+			return err
+		}
+	}
+}
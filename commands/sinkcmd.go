@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"github.com/boxproject/companion/contract"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//部署sink合约，绑定oracle
+func SinkDeployCmd(c *cli.Context) error {
+	ctx, err := newContractCtx(c)
+	if err != nil {
+		return err
+	}
+	defer ctx.client.Close()
+	oracleAddr, err := addressArg(c, "oracle", ctx.cfg.PriEthCfg.OracleAddress)
+	if err != nil {
+		return err
+	}
+	opts, err := ctx.transactor(c)
+	if err != nil {
+		return err
+	}
+	_, tx, _, err := contract.DeploySink(opts, ctx.client, oracleAddr)
+	if err != nil {
+		return err
+	}
+	return ctx.waitAndPrint(tx)
+}
+
+//更换sink合约的oracle，仅原oracle的boss可执行
+func SinkChangeOracleCmd(c *cli.Context) error {
+	ctx, err := newContractCtx(c)
+	if err != nil {
+		return err
+	}
+	defer ctx.client.Close()
+	sinkAddr, err := addressArg(c, "sink", ctx.cfg.SinkAddress)
+	if err != nil {
+		return err
+	}
+	oracleAddr, err := addressArg(c, "oracle", "")
+	if err != nil {
+		return err
+	}
+	sink, err := contract.NewSink(sinkAddr, ctx.client)
+	if err != nil {
+		return err
+	}
+	opts, err := ctx.transactor(c)
+	if err != nil {
+		return err
+	}
+	tx, err := sink.ChangeOracle(opts, oracleAddr)
+	if err != nil {
+		return err
+	}
+	return ctx.waitAndPrint(tx)
+}
@@ -1,24 +1,41 @@
 package commands
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/common"
 
 	logger "github.com/alecthomas/log4go"
-	//"github.com/astaxie/beego"
+	"github.com/boxproject/companion/admin"
 	"github.com/boxproject/companion/comm"
 	"github.com/boxproject/companion/config"
-	//"github.com/boxproject/companion/controllers"
+	"github.com/boxproject/companion/controllers"
 	"github.com/boxproject/companion/db"
+	"github.com/boxproject/companion/ethcli"
 	"github.com/boxproject/companion/grpcserver"
 	"github.com/boxproject/companion/handler"
+	"github.com/boxproject/companion/httpcli"
+	"github.com/boxproject/companion/metrics"
+	"github.com/boxproject/companion/util"
 	"github.com/boxproject/companion/watcher"
 	"gopkg.in/urfave/cli.v1"
 )
 
+const (
+	SHUTDOWN_TIMEOUT       = 30 * time.Second //退出时等待各服务结束的最长时间
+	DEF_HTTP_READ_TIMEOUT  = 10 * time.Second
+	DEF_HTTP_WRITE_TIMEOUT = 10 * time.Second
+)
+
+var ErrNoHttpSecret = errors.New("http_secret is required when http_bind is set")
+
 func StartCmd(c *cli.Context) error {
 	logger.Debug("Starting companion service...")
 	cfg, err := LoadConfig(c.String("c"), "config.json")
@@ -26,7 +43,25 @@ func StartCmd(c *cli.Context) error {
 		logger.Error("Load config failed. cause: %v", err)
 		return err
 	}
+	if err = cfg.Validate(); err != nil {
+		logger.Error("Check config failed. cause: %v", err)
+		return err
+	}
 	logger.Info("Load config.  %v", cfg)
+	//热加载比对使用文件中的配置，loadSigner会清除密码
+	fileCfg := *cfg
+
+	//单实例运行
+	if err = admin.WritePidFile(cfg.PidFile); err != nil {
+		logger.Error("Write pid file failed. cause: %v", err)
+		return err
+	}
+	defer admin.RemovePidFile(cfg.PidFile)
+
+	signer, err := loadSigner(c, cfg)
+	if err != nil {
+		return err
+	}
 
 	//init db
 	db, err := initDb(cfg.LevelDbPath)
@@ -35,69 +70,125 @@ func StartCmd(c *cli.Context) error {
 		return err
 	}
 	comm.Ldb = db
+	if err = handler.BuildQueryIndex(db); err != nil {
+		logger.Error("Build query index failed. cause: %v", err)
+		return err
+	}
 
-	//prichain conn
-	priLogWatcher, err := connPriChain(c, cfg, db)
+	//私链连接，watcher及handler共用，节点异常或落后时自动切换
+	ethClient, err := ethcli.Dial(gethEndpoints(cfg.PriEthCfg)...)
 	if err != nil {
 		logger.Error("Dial to the pri geth node failed. cause: %v", err)
 		return err
 	}
+	defer ethClient.Close()
 
-	//init grpc
-	go initGrpcSer(cfg, priLogWatcher)
-
-	// monitor log
-	go priLogWatcher.Listen()
+	//prichain conn
+	priLogWatcher, err := connPriChain(c, cfg, db, ethClient)
+	if err != nil {
+		logger.Error("Init pri chain watcher failed. cause: %v", err)
+		return err
+	}
 
 	//sink合约同步处理
-	handler.PriSynEth, err = handler.InitPriSynEthHandler(cfg.SinkAddress, cfg.PriEthCfg)
+	handler.PriSynEth = handler.InitPriSynEthHandler(cfg.SinkAddress, cfg.PriEthCfg, ethClient)
+	asyEthHandler := handler.NewPriAsyEthHandler(cfg, db, signer, ethClient)
+
+	httpSrv, err := newHttpServer(cfg.HttpServer)
 	if err != nil {
-		logger.Error("Init Syn EthHandler failed . cause: %v", err)
+		logger.Error("Init http server failed. cause: %v", err)
 		return err
 	}
-	asyEthHandler := handler.NewPriAsyEthHandler(cfg, db)
-	go asyEthHandler.Start()
+
+	reloader := newReloader(GetConfigFilePath(c.String("c"), "config.json"), &fileCfg, asyEthHandler, priLogWatcher)
+
+	supervisor := util.NewSupervisor()
+	supervisor.Go("ethcli", ethClient.Run)
+	//init grpc
+	supervisor.Go("grpc", reloader.runGrpc)
+	// monitor log
+	supervisor.Go("watcher", priLogWatcher.Listen)
+	supervisor.Go("asyEthHandler", asyEthHandler.Run)
+	//重新投递未处理请求
+	supervisor.Go("replay", replay)
 	//提供http服务
-	//go httpServer()
+	if httpSrv != nil {
+		supervisor.Go("http", httpSrv.run)
+	}
 
-	////上报程序
-	//repCli := httpcli.NewRepCli(cfg)
-	//repCli.Start()
+	//上报程序
+	supervisor.Go("repCli", httpcli.NewRepCli(cfg).Run)
+	//监控
+	registerChecks(cfg, db, ethClient, priLogWatcher, signer)
+	if cfg.MetricsBind != "" {
+		supervisor.Go("metrics", metrics.NewServer(cfg.MetricsBind).Run)
+	}
+	//本地管理接口
+	stopCh := make(chan struct{}, 1)
+	adminSrv := admin.NewServer(cfg.AdminSocket)
+	registerAdmin(adminSrv, stopCh, asyEthHandler, priLogWatcher)
+	supervisor.Go("admin", adminSrv.Run)
 
-	signalCh := make(chan os.Signal)
+	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh,
 		syscall.SIGINT, syscall.SIGTERM,
-		syscall.SIGHUP, syscall.SIGKILL,
 		syscall.SIGUSR1, syscall.SIGUSR2)
-	<-signalCh
+	//SIGHUP重新加载配置
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	for stopping := false; !stopping; {
+		select {
+		case <-hupCh:
+			logger.Info("receive signal: SIGHUP, reloading config...")
+			reloader.reload()
+		case sig := <-signalCh:
+			logger.Info("receive signal: %v, shutting down...", sig)
+			stopping = true
+		case <-stopCh:
+			logger.Info("receive stop command, shutting down...")
+			stopping = true
+		}
+	}
 
-	asyEthHandler.Close()
 	priLogWatcher.Stop()
-	//repCli.Stop()
+	if !supervisor.Stop(SHUTDOWN_TIMEOUT) {
+		//未退出的服务仍可能写db，不关闭，由进程退出释放
+		logger.Warn("wait for services exit timeout after %v, leave db open", SHUTDOWN_TIMEOUT)
+	} else if err = db.Close(); err != nil {
+		logger.Error("close db failed. cause: %v", err)
+	}
 
 	logger.Info("companion has already been shutdown...")
 	return nil
 }
 
+//启动时重新投递未处理的请求及上报，完成后退出
+func replay(ctx context.Context) error {
+	if err := comm.ReplayReq(ctx); err != nil {
+		logger.Error("Replay request failed. cause: %v", err)
+		return err
+	}
+	if err := comm.ReplayVReq(ctx); err != nil {
+		logger.Error("Replay vreq failed. cause: %v", err)
+		return err
+	}
+	return nil
+}
+
 //connect private chain
-func connPriChain(c *cli.Context, cfg *config.Config, ldb *db.Ldb) (*watcher.EthEventLogWatcher, error) {
+func connPriChain(c *cli.Context, cfg *config.Config, ldb *db.Ldb, priClient *ethcli.Client) (*watcher.EthEventLogWatcher, error) {
 	logger.Info("conn pri eth start........")
-	priClient, err := rpc.Dial(cfg.PriEthCfg.GethAPI)
+
+	blkFile := cursorFile(c, cfg)
+	logger.Debug("Blockfile: %s", blkFile)
+
+	addresses, err := watchAddresses(cfg)
 	if err != nil {
-		logger.Error("Dial to the geth node failed, cause: %v", err)
+		logger.Error("Illegal watch addresses, cause: %v", err)
 		return nil, err
 	}
 
-	//cursorPath := c.String("b") //priority
-	//if cursorPath == "" {
-	//	cursorPath = cfg.PriEthCfg.CursorFilePath
-	//}
-
-	//blkFile := GetConfigFilePath(cursorPath, comm.DEF_CURSOR_FILE_PATH)
-	blkFile := cfg.PriEthCfg.CursorFilePath
-	logger.Debug("Blockfile: %s", blkFile)
-
-	logWatcher, err := watcher.NewEthEventLogWatcher(priClient, &cfg.PriEthCfg, blkFile, ldb)
+	logWatcher, err := watcher.NewEthEventLogWatcher(priClient, &cfg.PriEthCfg, blkFile, ldb, addresses)
 	if err != nil {
 		logger.Error("New ETH Event log watcher failed. cause: %v", err)
 		return nil, err
@@ -111,20 +202,88 @@ func connPriChain(c *cli.Context, cfg *config.Config, ldb *db.Ldb) (*watcher.Eth
 
 }
 
+//监控的合约地址：sink合约及配置的其他合约
+func watchAddresses(cfg *config.Config) ([]common.Address, error) {
+	hexes := append([]string{cfg.SinkAddress}, cfg.PriEthCfg.WatchAddresses...)
+	addresses := make([]common.Address, 0, len(hexes))
+	seen := make(map[common.Address]bool)
+	for _, h := range hexes {
+		if !common.IsHexAddress(h) {
+			return nil, fmt.Errorf("illegal contract address: %s", h)
+		}
+		addr := common.HexToAddress(h)
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addresses = append(addresses, addr)
+	}
+	return addresses, nil
+}
+
 //init db
 func initDb(path string) (*db.Ldb, error) {
 	return db.InitDb(path)
 }
 
 //init grpc
-func initGrpcSer(cfg *config.Config, watcher *watcher.EthEventLogWatcher) error {
-	return grpcserver.InitConn(cfg, watcher)
+func initGrpcSer(ctx context.Context, cfg *config.Config) error {
+	return grpcserver.InitConn(ctx, cfg)
 }
 
 //http
-func httpServer() {
-	//beego.Router(ServiceName_HASH, &controllers.HashController{}, "get,post:Hash")
-	//beego.Router(ServiceName_APPLY, &controllers.ApplyController{}, "get,post:Apply")
-	//
-	//beego.Run()
+type httpServer struct {
+	srv *http.Server
+}
+
+//未配置http_bind时返回nil，不提供http服务
+func newHttpServer(cfg config.HttpServer) (*httpServer, error) {
+	if cfg.HttpBind == "" {
+		return nil, nil
+	}
+	if cfg.HttpSecret == "" {
+		return nil, ErrNoHttpSecret
+	}
+	readTimeout, err := parseTimeout(cfg.HttpReadTimeOut, DEF_HTTP_READ_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	writeTimeout, err := parseTimeout(cfg.HttpWriteTimeOut, DEF_HTTP_WRITE_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return &httpServer{srv: &http.Server{
+		Addr:         cfg.HttpBind,
+		Handler:      controllers.NewRouter(cfg.HttpSecret),
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+	}}, nil
+}
+
+func (h *httpServer) run(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		logger.Info("http server listen on %s", h.srv.Addr)
+		errCh <- h.srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		return h.srv.Shutdown(shutdownCtx)
+	}
+}
+
+//超时配置为duration格式，如"10s"，为空时使用默认值
+func parseTimeout(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("illegal http timeout %q: %v", s, err)
+	}
+	return d, nil
 }
@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/boxproject/companion/config"
+	"github.com/boxproject/companion/db"
+	"github.com/boxproject/companion/ethcli"
+	"github.com/boxproject/companion/grpcserver"
+	"github.com/boxproject/companion/handler"
+	"github.com/boxproject/companion/metrics"
+	"github.com/boxproject/companion/watcher"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const PING_TIMEOUT = 3 * time.Second
+
+var ErrNotReady = errors.New("companion not ready")
+
+//注册健康检查项
+func registerChecks(cfg *config.Config, ldb *db.Ldb, ethClient *ethcli.Client, logWatcher *watcher.EthEventLogWatcher, signer handler.Signer) {
+	maxHeadAge := time.Duration(orDefault(cfg.Health.MaxHeadAge, config.DEF_MAX_HEAD_AGE)) * time.Second
+	maxBlockLag := orDefault(cfg.Health.MaxBlockLag, config.DEF_MAX_BLOCK_LAG)
+	heartTimeout := time.Duration(orDefault(cfg.Health.HeartTimeout, config.DEF_HEART_TIMEOUT)) * time.Second
+
+	metrics.RegisterCheck("leveldb", true, func() error {
+		_, err := ldb.GetProperty("leveldb.stats")
+		return err
+	})
+	metrics.RegisterCheck("geth", false, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), PING_TIMEOUT)
+		defer cancel()
+		return ethClient.Ping(ctx)
+	})
+	metrics.RegisterCheck("watcher", false, func() error {
+		return logWatcher.Health(maxHeadAge, maxBlockLag)
+	})
+	metrics.RegisterCheck("grpc", false, func() error {
+		return grpcserver.Health(heartTimeout)
+	})
+	//本地签名检查私钥仍可签名，远程签名检查clef可访问且管理creator账户
+	metrics.RegisterCheck("signer", false, func() error {
+		if signer == nil {
+			return handler.ErrSignerLocked
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), PING_TIMEOUT)
+		defer cancel()
+		return signer.Ping(ctx)
+	})
+}
+
+func orDefault(v, def int64) int64 {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+//通过管理接口查询运行状态
+func StatusCmd(c *cli.Context) error {
+	client, err := adminClient(c)
+	if err != nil {
+		return err
+	}
+	status := &AdminStatus{}
+	if err = client.Get("/status", nil, status); err != nil {
+		return err
+	}
+	if err = printJSON(status); err != nil {
+		return err
+	}
+	if status.Ready == nil || !status.Ready.OK {
+		return ErrNotReady
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"fmt"
+	"net/url"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/admin"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/handler"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var txStatusName = map[string]string{
+	comm.TX_STATUS_QUEUED:    "queued",
+	comm.TX_STATUS_SENT:      "sent",
+	comm.TX_STATUS_CONFIRMED: "confirmed",
+	comm.TX_STATUS_FAILED:    "failed",
+}
+
+//查看待处理及失败的私链交易，运行中时通过管理接口查询，否则直接读取发送队列
+func TxsCmd(c *cli.Context) error {
+	cfg, err := LoadConfig(c.String("c"), "config.json")
+	if err != nil {
+		logger.Error("Load config failed. cause: %v", err)
+		return err
+	}
+
+	statuses := []string{comm.TX_STATUS_QUEUED, comm.TX_STATUS_SENT, comm.TX_STATUS_FAILED}
+	if c.Bool("all") {
+		statuses = nil
+	}
+	//运行中时leveldb被进程锁定，通过管理接口查询
+	var records []*handler.TxRecord
+	err = admin.NewClient(cfg.AdminSocket).Get("/txs", url.Values{"status": statuses}, &records)
+	if err == admin.ErrNotRunning {
+		ldb, err := initDb(cfg.LevelDbPath)
+		if err != nil {
+			logger.Error("Init Db failed . cause: %v", err)
+			return err
+		}
+		defer ldb.Close()
+		if records, err = handler.NewTxQueue(ldb).List(statuses...); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-10s %-8s %-7s %-66s %s\n", "STATUS", "NONCE", "RETRIES", "TXHASH", "REQUEST")
+	for _, rec := range records {
+		fmt.Printf("%-10s %-8d %-7d %-66s %s\n", txStatusName[rec.Status], rec.Nonce, rec.Retries, rec.TxHash, rec.Id)
+		if rec.Err != "" {
+			fmt.Printf("%-10s error: %s\n", "", rec.Err)
+		}
+	}
+	return nil
+}
+
+//失败交易重新入队，运行中时通过管理接口执行，否则直接修改发送队列，下次启动时发送
+func TxsRetryCmd(c *cli.Context) error {
+	id := c.Args().First()
+	if id == "" {
+		return fmt.Errorf("usage: txs retry REQUEST")
+	}
+	cfg, err := LoadConfig(c.String("c"), "config.json")
+	if err != nil {
+		return err
+	}
+
+	rec := &handler.TxRecord{}
+	err = admin.NewClient(cfg.AdminSocket).Post("/txs/retry", url.Values{"id": {id}}, rec)
+	if err == admin.ErrNotRunning {
+		ldb, err := initDb(cfg.LevelDbPath)
+		if err != nil {
+			return err
+		}
+		defer ldb.Close()
+		if rec, err = handler.NewTxQueue(ldb).Retry(id); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("tx[%s] queued for retry\n", rec.Id)
+	return nil
+}
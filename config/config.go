@@ -15,6 +15,19 @@ type Config struct {
 	DepositUrl    string `json:"deposit_url,omitempty"`
 	WithDrawUrl   string `json:"withdraw_url,omitempty"`
 	WithDrawTxUrl string `json:"withdraw_tx_url,omitempty"`
+	OutboxAckTimeout int64 `json:"outbox_ack_timeout,omitempty"` // 上报等待voucher确认秒数，超时重发，默认30
+	OutboxRetention  int64 `json:"outbox_retention,omitempty"`   // 已确认上报保留小时数，默认72，小于0不保留
+	HttpServer       HttpServer `json:"http_server,omitempty"`   // http接口，未配置http_bind时不启动
+	MetricsBind      string     `json:"metrics_bind,omitempty"`  // 监控接口地址(/metrics、/healthz、/readyz)，为空时不启动
+	Health           HealthCfg  `json:"health,omitempty"`        // 就绪检查门限
+	PidFile          string     `json:"pid_file,omitempty"`      // 进程号文件，默认companion.pid
+	AdminSocket      string     `json:"admin_socket,omitempty"`  // 本地管理接口unix socket，默认companion.sock
+}
+
+type HealthCfg struct {
+	MaxHeadAge   int64 `json:"max_head_age,omitempty"`   // 未收到新区块的最长秒数，默认60
+	MaxBlockLag  int64 `json:"max_block_lag,omitempty"`  // 游标落后(除check_block_before外)的最大区块数，默认100
+	HeartTimeout int64 `json:"heart_timeout,omitempty"`  // gRPC心跳成功的最长间隔秒数，默认30
 }
 
 type EthCfg struct {
@@ -22,10 +35,22 @@ type EthCfg struct {
 	Creator             string `json:"creator"`               // Creator 创建者的地址
 	CreatorPassphrase   string `json:"creator_passphrase"`    // Creator 创建者的keystore密钥
 	CreatorKeystorePath string `json:"creator_keystore_path"` // Creator 创建者keystore 路径
-	GethAPI             string `json:"geth_api"`              // GethAPI 以太坊接口地址，要支持websocket
+	SignerType          string `json:"signer_type,omitempty"`     // SignerType 签名方式 keystore|rawkey|remote，默认keystore
+	SignerKeyPath       string `json:"signer_key_path,omitempty"` // SignerKeyPath rawkey方式的私钥文件
+	SignerURL           string `json:"signer_url,omitempty"`      // SignerURL remote方式的签名服务地址
+	GethAPI             string `json:"geth_api"`              // GethAPI 以太坊接口地址，websocket；http/ipc时按scan_interval轮询
+	GethAPIs            []string `json:"geth_apis,omitempty"`      // GethAPIs 备用节点地址，按区块高度及延迟自动切换
+	CrossCheckLogs      bool     `json:"cross_check_logs,omitempty"` // CrossCheckLogs 扫描log时与另一节点比对，一致后再处理
 	CheckBlockBefore    int64  `json:"check_block_before"`    // CheckBlockBefore 设置当前块向前推若干个块做校验
+	ScanInterval        int64  `json:"scan_interval,omitempty"` // ScanInterval 无法订阅新区块(http/ipc)时轮询间隔秒数，默认5
+	ReorgWindow         int64  `json:"reorg_window,omitempty"` // ReorgWindow 保留近期区块hash数，用于分叉检测，默认128
+	EventRetention      int64  `json:"event_retention,omitempty"` // EventRetention 已上报log记录保留区块数，用于分叉回滚及重新扫描去重，默认100000
+	WatchAddresses      []string `json:"watch_addresses,omitempty"` // WatchAddresses 除sink合约外需要监控的合约地址
+	WatchTopics         []string `json:"watch_topics,omitempty"`    // WatchTopics 监控的事件，事件签名或topic hash，为空时监控全部
+	OracleAddress       string   `json:"oracle_address,omitempty"`  // OracleAddress oracle合约地址，配置后按多节点确认数上报
+	ConfirmThreshold    int64    `json:"confirm_threshold,omitempty"` // ConfirmThreshold 确认节点数门限，默认与sink合约一致
 	CursorFilePath      string `json:"cursor_file_path"`      // CursorFilePath 设置当前块处理游标
-	NonceFilePath       string `json:"nonce_file_path,omitempty"`//NonceFilePath记录当前块处理nonce
+	NonceFilePath       string `json:"nonce_file_path,omitempty"` // NonceFilePath 已废弃，nonce改存leveldb，配置时忽略
 	GasLimit            int64  `json:"gas_limit"`             //执行方法gaslimit
 	GasPrice            int64  `json:"gas_price"`             //执行gasprice
 	WalletGas           int    `json:"wallet_gas"`            // 部署wallet所需gas
@@ -36,6 +61,7 @@ type HttpServer struct {
 	HttpBind         string `json:"http_bind"`
 	HttpReadTimeOut  string `json:"http_read_timeout"`
 	HttpWriteTimeOut string `json:"http_write_timeout"`
+	HttpSecret       string `json:"http_secret"` // 请求签名HMAC-SHA256密钥
 }
 
 type RouterInfo struct {
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+//配置项变更，Field为json字段路径，如 pri_eth.gas_limit
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (c *Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, c.Old, c.New)
+}
+
+//比较两份配置，返回变更项，密钥类字段不输出内容
+func Diff(a, b *Config) []*Change {
+	changes := make([]*Change, 0)
+	diffValue(reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem(), "", &changes)
+	return changes
+}
+
+func diffValue(a, b reflect.Value, prefix string, changes *[]*Change) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == "" {
+			tag = field.Name
+		}
+		name := prefix + tag
+		fa, fb := a.Field(i), b.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			diffValue(fa, fb, name+".", changes)
+			continue
+		}
+		if reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			continue
+		}
+		change := &Change{Field: name, Old: fmt.Sprintf("%v", fa.Interface()), New: fmt.Sprintf("%v", fb.Interface())}
+		if isSecret(tag) {
+			change.Old, change.New = "***", "***"
+		}
+		*changes = append(*changes, change)
+	}
+}
+
+func isSecret(tag string) bool {
+	return strings.Contains(tag, "passphrase") || strings.Contains(tag, "secret")
+}
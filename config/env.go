@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//环境变量前缀
+const ENV_PREFIX = "COMPANION"
+
+//环境变量覆盖配置，变量名为前缀加json字段路径的大写，以_连接，
+//如 COMPANION_SINK_ADDRESS、COMPANION_PRI_ETH_GAS_PRICE、COMPANION_HTTP_SERVER_HTTP_SECRET；
+//列表以逗号分隔
+func ApplyEnv(cfg *Config) error {
+	return applyEnv(reflect.ValueOf(cfg).Elem(), ENV_PREFIX)
+}
+
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		name, ok := envName(prefix, field)
+		if !ok {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(value, name); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setValue(value, s); err != nil {
+			return fmt.Errorf("env %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+//按json字段名生成变量名
+func envName(prefix string, field reflect.StructField) (string, bool) {
+	tag := strings.Split(field.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return "", false
+	}
+	if tag == "" {
+		tag = field.Name
+	}
+	return prefix + "_" + strings.ToUpper(tag), true
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %v", v.Type())
+		}
+		list := make([]string, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+)
+
+//未配置时的默认值
+const (
+	DEF_SCAN_INTERVAL      = 5      //轮询间隔秒数
+	DEF_REORG_WINDOW       = 128    //保留近期区块hash数
+	DEF_EVENT_RETENTION    = 100000 //已上报log记录保留区块数
+	DEF_OUTBOX_ACK_TIMEOUT = 30     //等待voucher确认秒数
+	DEF_OUTBOX_RETENTION   = 72     //已确认上报保留小时数
+	DEF_MAX_HEAD_AGE       = 60     //未收到新区块的最长秒数
+	DEF_MAX_BLOCK_LAG      = 100    //游标最大落后区块数
+	DEF_HEART_TIMEOUT      = 30     //gRPC心跳最长间隔秒数
+
+	DEF_PID_FILE     = "companion.pid"
+	DEF_ADMIN_SOCKET = "companion.sock"
+)
+
+//读取配置文件：不允许未知字段，COMPANION_*环境变量覆盖文件配置，最后填充默认值
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	//旧版本配置项，保留字段以免升级后无法启动
+	if cfg.PriEthCfg.NonceFilePath != "" {
+		logger.Warn("%s: pri_eth.nonce_file_path is deprecated and ignored, nonce is kept in leveldb", path)
+	}
+	if err = ApplyEnv(cfg); err != nil {
+		return nil, err
+	}
+	cfg.SetDefaults()
+	return cfg, nil
+}
+
+//填充默认值
+func (cfg *Config) SetDefaults() {
+	eth := &cfg.PriEthCfg
+	if eth.SignerType == "" {
+		eth.SignerType = comm.SIGNER_KEYSTORE
+	}
+	if eth.CursorFilePath == "" {
+		eth.CursorFilePath = comm.DEF_CURSOR_FILE_PATH
+	}
+	if eth.ScanInterval == 0 {
+		eth.ScanInterval = DEF_SCAN_INTERVAL
+	}
+	if eth.ReorgWindow == 0 {
+		eth.ReorgWindow = DEF_REORG_WINDOW
+	}
+	if eth.EventRetention == 0 {
+		eth.EventRetention = DEF_EVENT_RETENTION
+	}
+	if cfg.OutboxAckTimeout == 0 {
+		cfg.OutboxAckTimeout = DEF_OUTBOX_ACK_TIMEOUT
+	}
+	//小于0表示不保留
+	if cfg.OutboxRetention == 0 {
+		cfg.OutboxRetention = DEF_OUTBOX_RETENTION
+	}
+	if cfg.Health.MaxHeadAge == 0 {
+		cfg.Health.MaxHeadAge = DEF_MAX_HEAD_AGE
+	}
+	if cfg.Health.MaxBlockLag == 0 {
+		cfg.Health.MaxBlockLag = DEF_MAX_BLOCK_LAG
+	}
+	if cfg.Health.HeartTimeout == 0 {
+		cfg.Health.HeartTimeout = DEF_HEART_TIMEOUT
+	}
+	if cfg.PidFile == "" {
+		cfg.PidFile = DEF_PID_FILE
+	}
+	if cfg.AdminSocket == "" {
+		cfg.AdminSocket = DEF_ADMIN_SOCKET
+	}
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boxproject/companion/comm"
+)
+
+//旧版本的config.json
+const LEGACY_CONFIG = `{
+  "pri_eth": {
+    "creator":"0x1db6dec5731130d6b5d2e6789194e1391ca05754",
+    "creator_passphrase": "box123456",
+    "creator_keystore_path": "/opt/ether-data/keystore/UTC--2017-12-07T05-50-56.854752329Z--1db6dec5731130d6b5d2e6789194e1391ca05754",
+    "geth_api": "ws://localhost:8546",
+    "check_block_before": 3,
+    "cursor_file_path":"/opt/box/companion/cursor.txt",
+    "nonce_file_path":"/opt/box/companion/nonce.txt",
+    "scan_interval": 5,
+    "gas_limit":4700000,
+    "gas_price":2,
+    "wallet_gas": 291654,
+    "factory_gas": 513617
+  },
+  "router_info":{
+    "ser_voucher":"voucher",
+    "ser_companion":"companion",
+    "companion_name":"comp-001"
+  },
+  "level_db_path":"/opt/box/companion/leveldb",
+  "sink_address":"0x78202ee297826b2d3798db4300340d69893746f5",
+  "client_cert":"/opt/box/companion/certs/client.pem",
+  "client_key":"/opt/box/companion/certs/client.key",
+  "grpc_ser_host":"127.0.0.1:50502"
+}`
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadLegacyConfig(t *testing.T) {
+	cfg, err := Load(writeConfig(t, LEGACY_CONFIG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PriEthCfg.NonceFilePath != "/opt/box/companion/nonce.txt" {
+		t.Fatalf("nonce_file_path: %q", cfg.PriEthCfg.NonceFilePath)
+	}
+	if _, err = Load(writeConfig(t, strings.Replace(LEGACY_CONFIG, "nonce_file_path", "nonce_path", 1))); err == nil {
+		t.Fatal("unknown field accepted")
+	}
+}
+
+func TestValidateSignerUrl(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://127.0.0.1:8550", true},
+		{"ws://127.0.0.1:8550", true},
+		{"/opt/clef/clef.ipc", true},
+		{"clef.ipc", true},
+		{"ftp://127.0.0.1:8550", false},
+		{"127.0.0.1:8550", false},
+	}
+	for _, test := range tests {
+		cfg, err := Load(writeConfig(t, LEGACY_CONFIG))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.PriEthCfg.SignerType = comm.SIGNER_REMOTE
+		cfg.PriEthCfg.SignerURL = test.url
+		err = cfg.Validate()
+		if failed := err != nil && strings.Contains(err.Error(), "pri_eth.signer_url"); failed == test.ok {
+			t.Fatalf("signer_url %q: ok %v, got %v", test.url, test.ok, err)
+		}
+	}
+}
+
+func TestValidateCrossCheckLogs(t *testing.T) {
+	tests := []struct {
+		api  string
+		apis []string
+		ok   bool
+	}{
+		{"ws://localhost:8546", nil, false},
+		{"ws://localhost:8546", []string{"ws://localhost:8546"}, false},
+		{"", []string{"ws://localhost:8546"}, false},
+		{"ws://localhost:8546", []string{"ws://10.0.0.2:8546"}, true},
+		{"", []string{"ws://localhost:8546", "ws://10.0.0.2:8546"}, true},
+	}
+	for _, test := range tests {
+		cfg, err := Load(writeConfig(t, LEGACY_CONFIG))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.PriEthCfg.CrossCheckLogs = true
+		cfg.PriEthCfg.GethAPI, cfg.PriEthCfg.GethAPIs = test.api, test.apis
+		err = cfg.Validate()
+		if failed := err != nil && strings.Contains(err.Error(), "pri_eth.cross_check_logs"); failed == test.ok {
+			t.Fatalf("geth_api %q, geth_apis %v: ok %v, got %v", test.api, test.apis, test.ok, err)
+		}
+	}
+}
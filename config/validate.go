@@ -0,0 +1,208 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boxproject/companion/comm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//配置校验错误，逐项列出
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e, "; ")
+}
+
+//校验配置，应在填充默认值后调用
+func (cfg *Config) Validate() error {
+	var errs ValidationError
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, field+" "+fmt.Sprintf(format, args...))
+	}
+	required := func(field, value string) bool {
+		if strings.TrimSpace(value) == "" {
+			fail(field, "is required")
+			return false
+		}
+		return true
+	}
+	address := func(field, value string) {
+		if !common.IsHexAddress(value) {
+			fail(field, "is not a valid address: %q", value)
+		} else if common.HexToAddress(value) == (common.Address{}) {
+			fail(field, "is the zero address")
+		}
+	}
+	httpUrl := func(field, value string) {
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail(field, "is not a valid http url: %q", value)
+		}
+	}
+	hostPort := func(field, value string) {
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			fail(field, "is not a valid host:port: %q", value)
+		}
+	}
+	duration := func(field, value string) {
+		if _, err := time.ParseDuration(value); err != nil {
+			fail(field, "is not a valid duration: %q", value)
+		}
+	}
+
+	//私链
+	eth := &cfg.PriEthCfg
+	if strings.TrimSpace(eth.GethAPI) == "" && len(eth.GethAPIs) == 0 {
+		fail("pri_eth.geth_api", "is required")
+	}
+	if eth.GethAPI != "" {
+		gethUrl(fail, "pri_eth.geth_api", eth.GethAPI)
+	}
+	for _, api := range eth.GethAPIs {
+		gethUrl(fail, "pri_eth.geth_apis", api)
+	}
+	//比对log至少需要两个不同的节点
+	if eth.CrossCheckLogs {
+		endpoints := make(map[string]bool)
+		for _, api := range append([]string{eth.GethAPI}, eth.GethAPIs...) {
+			if api = strings.TrimSpace(api); api != "" {
+				endpoints[api] = true
+			}
+		}
+		if len(endpoints) < 2 {
+			fail("pri_eth.cross_check_logs", "requires at least 2 distinct endpoints in geth_api and geth_apis")
+		}
+	}
+	if required("pri_eth.creator", eth.Creator) {
+		address("pri_eth.creator", eth.Creator)
+	}
+	switch eth.SignerType {
+	case comm.SIGNER_KEYSTORE:
+		required("pri_eth.creator_keystore_path", eth.CreatorKeystorePath)
+		if strings.TrimSpace(eth.CreatorPassphrase) == "" {
+			fail("pri_eth.creator_passphrase", "is required, set it to the output of `companion encrypt`")
+		}
+	case comm.SIGNER_RAWKEY:
+		required("pri_eth.signer_key_path", eth.SignerKeyPath)
+	case comm.SIGNER_REMOTE:
+		//clef支持http、websocket及ipc
+		if required("pri_eth.signer_url", eth.SignerURL) {
+			gethUrl(fail, "pri_eth.signer_url", eth.SignerURL)
+		}
+	default:
+		fail("pri_eth.signer_type", "must be one of %s|%s|%s: %q", comm.SIGNER_KEYSTORE, comm.SIGNER_RAWKEY, comm.SIGNER_REMOTE, eth.SignerType)
+	}
+	if eth.CheckBlockBefore <= 0 {
+		fail("pri_eth.check_block_before", "must be greater than 0")
+	}
+	required("pri_eth.cursor_file_path", eth.CursorFilePath)
+	if eth.ScanInterval < 0 {
+		fail("pri_eth.scan_interval", "must not be negative")
+	}
+	if eth.ReorgWindow < 0 {
+		fail("pri_eth.reorg_window", "must not be negative")
+	}
+	if eth.EventRetention < eth.ReorgWindow {
+		fail("pri_eth.event_retention", "must not be less than reorg_window")
+	}
+	for _, a := range eth.WatchAddresses {
+		address("pri_eth.watch_addresses", a)
+	}
+	if eth.OracleAddress != "" {
+		address("pri_eth.oracle_address", eth.OracleAddress)
+	}
+	if eth.ConfirmThreshold < 0 {
+		fail("pri_eth.confirm_threshold", "must not be negative")
+	}
+	if eth.GasLimit <= 0 {
+		fail("pri_eth.gas_limit", "must be greater than 0")
+	}
+	if eth.GasPrice < 0 {
+		fail("pri_eth.gas_price", "must not be negative")
+	}
+	if eth.WalletGas < 0 {
+		fail("pri_eth.wallet_gas", "must not be negative")
+	}
+	if eth.FactoryGas < 0 {
+		fail("pri_eth.factory_gas", "must not be negative")
+	}
+
+	//存储及合约
+	required("level_db_path", cfg.LevelDbPath)
+	if required("sink_address", cfg.SinkAddress) {
+		address("sink_address", cfg.SinkAddress)
+	}
+
+	//gRPC
+	required("router_info.ser_voucher", cfg.RouterInfo.SerVoucher)
+	required("router_info.ser_companion", cfg.RouterInfo.SerCompanion)
+	required("router_info.companion_name", cfg.RouterInfo.CompanionName)
+	required("client_cert", cfg.ClientCert)
+	required("client_key", cfg.ClientKey)
+	if required("grpc_ser_host", cfg.GrpcSerHost) {
+		hostPort("grpc_ser_host", cfg.GrpcSerHost)
+	}
+	if (cfg.ServerCert == "") != (cfg.ServerKey == "") {
+		fail("server_cert/server_key", "must be set together")
+	}
+	if cfg.OutboxAckTimeout < 0 {
+		fail("outbox_ack_timeout", "must not be negative")
+	}
+
+	//上报地址
+	for _, u := range []struct{ field, value string }{
+		{"account_url", cfg.AccountUrl},
+		{"deposit_url", cfg.DepositUrl},
+		{"withdraw_url", cfg.WithDrawUrl},
+		{"withdraw_tx_url", cfg.WithDrawTxUrl},
+	} {
+		if u.value != "" {
+			httpUrl(u.field, u.value)
+		}
+	}
+
+	//http及监控
+	if srv := cfg.HttpServer; srv.HttpBind != "" {
+		hostPort("http_server.http_bind", srv.HttpBind)
+		required("http_server.http_secret", srv.HttpSecret)
+		if srv.HttpReadTimeOut != "" {
+			duration("http_server.http_read_timeout", srv.HttpReadTimeOut)
+		}
+		if srv.HttpWriteTimeOut != "" {
+			duration("http_server.http_write_timeout", srv.HttpWriteTimeOut)
+		}
+	}
+	if cfg.MetricsBind != "" {
+		hostPort("metrics_bind", cfg.MetricsBind)
+	}
+	if cfg.Health.MaxHeadAge < 0 || cfg.Health.MaxBlockLag < 0 || cfg.Health.HeartTimeout < 0 {
+		fail("health", "thresholds must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//geth及clef地址：websocket、http或ipc文件
+func gethUrl(fail func(field, format string, args ...interface{}), field, value string) {
+	if filepath.IsAbs(value) || strings.HasSuffix(value, ".ipc") {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		fail(field, "is not a valid url: %q", value)
+		return
+	}
+	switch u.Scheme {
+	case "ws", "wss", "http", "https":
+	default:
+		fail(field, "has unsupported scheme: %q", value)
+	}
+}
@@ -0,0 +1,53 @@
+package contract
+
+import (
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ParseSignflowAdded is a log parse operation binding the contract event 0x9f3f4c1672a4880364b07219cd9428dbc8a88774f53b12b98fae406c5a30ee5c.
+//
+// Solidity: event SignflowAdded(hash bytes32, lastConfirmed address)
+func (_Sink *SinkFilterer) ParseSignflowAdded(log types.Log) (*SinkSignflowAdded, error) {
+	event := new(SinkSignflowAdded)
+	if err := _Sink.contract.UnpackLog(event, "SignflowAdded", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
+// ParseSignflowEnabled is a log parse operation binding the contract event 0x50177799234754a6d6af99e5ab43b5679c202f4058d342099bfb35acdfa1a867.
+//
+// Solidity: event SignflowEnabled(hash bytes32, lastConfirmed address)
+func (_Sink *SinkFilterer) ParseSignflowEnabled(log types.Log) (*SinkSignflowEnabled, error) {
+	event := new(SinkSignflowEnabled)
+	if err := _Sink.contract.UnpackLog(event, "SignflowEnabled", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
+// ParseSignflowDisabled is a log parse operation binding the contract event 0x484f49c7a40838d935f9cd616461fad6033bb6f7fa4491fbc72941d77671f09f.
+//
+// Solidity: event SignflowDisabled(hash bytes32, lastConfirmed address)
+func (_Sink *SinkFilterer) ParseSignflowDisabled(log types.Log) (*SinkSignflowDisabled, error) {
+	event := new(SinkSignflowDisabled)
+	if err := _Sink.contract.UnpackLog(event, "SignflowDisabled", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
+// ParseWithdrawApplied is a log parse operation binding the contract event 0x7f508fd15756f38a4426383f9ef243dfccdfdff0a528e755b113ef8bef2c5c2e.
+//
+// Solidity: event WithdrawApplied(hash indexed bytes32, txHash indexed bytes32, amount uint256, fee uint256, recipient address, category uint256, lastConfirmed address)
+func (_Sink *SinkFilterer) ParseWithdrawApplied(log types.Log) (*SinkWithdrawApplied, error) {
+	event := new(SinkWithdrawApplied)
+	if err := _Sink.contract.UnpackLog(event, "WithdrawApplied", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
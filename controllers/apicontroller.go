@@ -67,8 +67,13 @@ func (h *HashController) addHash() {
 		h.retErrJSON(hash, comm.Err_HASH_EXSITS)
 		return
 	}
+	//落地成功后才应答
+	if err := comm.PushReq(&comm.RequestModel{Hash: hash, ReqType: comm.REQ_HASH_ADD, Approver: approver, Content: content}); err != nil {
+		logger.Error("push request failed: %s", err)
+		h.retErrJSON(hash, comm.Err_DB)
+		return
+	}
 	h.Data["json"] = hashModel
-	comm.ReqChan <- &comm.RequestModel{Hash: hash, ReqType: comm.REQ_HASH_ADD, Approver: approver, Content: content}
 	h.ServeJSON()
 }
 
@@ -90,7 +95,6 @@ func (h *HashController) availableHash() {
 //提现申请
 type ApplyController struct {
 	baseController
-	synHandler *handler.PriSynEthHandler
 }
 
 //提现模型
@@ -153,8 +157,13 @@ func (a *ApplyController) approve() {
 	}
 	logger.Debug("ApplyController.approve:---", "hash:", hash, " wdhash:", wdHash, " recAddress:", recAddress, " amount:", amount, " fee:", fee, " category:", category)
 
+	//落地成功后才应答
+	if err := comm.PushReq(&comm.RequestModel{Hash: hash, ReqType: comm.REQ_OUT_APPROVE, WdHash: wdHash, RecAddress: recAddress, Amount: amount, Fee: fee, Category: category}); err != nil {
+		logger.Error("push request failed: %s", err)
+		a.retErrJSON(hash, wdHash, comm.Err_DB)
+		return
+	}
 	a.Data["json"] = &ApplyModel{RspNo: comm.Err_OK, Hash: hash, WdHash: wdHash}
-	comm.ReqChan <- &comm.RequestModel{Hash: hash, ReqType: comm.REQ_OUT_APPROVE, WdHash: wdHash, RecAddress: recAddress, Amount: amount, Fee: fee, Category: category}
 	a.ServeJSON()
 }
 
@@ -164,7 +173,7 @@ func (a *ApplyController) txExists() {
 	hash := a.GetString("hash")
 	wdHash := a.GetString("wdhash")
 	applyModel := &ApplyModel{RspNo: comm.Err_OK, Hash: hash, WdHash: wdHash, Result: false}
-	if b, err := a.synHandler.TxExists(hash, wdHash); err != nil {
+	if b, err := handler.PriSynEth.TxExists(hash, wdHash); err != nil {
 		logger.Error("handler failed:%s", err)
 	} else if b {
 		applyModel.Result = b
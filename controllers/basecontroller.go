@@ -1,16 +1,116 @@
 package controllers
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
 	"github.com/astaxie/beego"
+	"github.com/boxproject/companion/comm"
+)
+
+const (
+	HEADER_TIMESTAMP = "X-Companion-Timestamp" //请求时间，unix秒
+	HEADER_SIGNATURE = "X-Companion-Signature" //请求签名，hex
+	AUTH_MAX_SKEW    = 5 * time.Minute         //允许的时间偏差
+)
+
+var (
+	ErrNoSecret  = errors.New("http secret not configured")
+	ErrNoSign    = errors.New("missing timestamp or signature")
+	ErrTimestamp = errors.New("illegal or expired timestamp")
+	ErrSignature = errors.New("signature mismatch")
+	ErrReplay    = errors.New("signature already used")
 )
 
+//通用错误模型
+type ErrModel struct {
+	RspNo   string //错误码
+	RspDesc string //说明
+}
+
 type baseController struct {
 	beego.Controller
 }
 
-func (this *baseController) Prepare() {
-	//签名验证等
-	//this.Data["json"] = map[string]interface{}{"msg": "verify not pass"}
-	//this.ServeJSON()
-	//this.StopRun()
+//签名验证，通过后交由next处理，未通过时返回401及错误json；
+//时间偏差内已使用的签名拒绝重放
+type authHandler struct {
+	secret []byte
+	next   http.Handler
+	lock   sync.Mutex
+	seen   map[string]int64 //签名 -> 过期时间，unix秒
+}
+
+func newAuthHandler(secret string, next http.Handler) *authHandler {
+	return &authHandler{secret: []byte(secret), next: next, seen: make(map[string]int64)}
+}
+
+func (this *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := this.verify(r); err != nil {
+		logger.Warn("[HTTP] %s %s from %s verify failed: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(&ErrModel{RspNo: comm.Err_AUTH, RspDesc: err.Error()})
+		return
+	}
+	this.next.ServeHTTP(w, r)
+}
+
+func (this *authHandler) verify(r *http.Request) error {
+	if len(this.secret) == 0 {
+		return ErrNoSecret
+	}
+	ts := r.Header.Get(HEADER_TIMESTAMP)
+	sign := r.Header.Get(HEADER_SIGNATURE)
+	if ts == "" || sign == "" {
+		return ErrNoSign
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrTimestamp
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > AUTH_MAX_SKEW || skew < -AUTH_MAX_SKEW {
+		return ErrTimestamp
+	}
+	if err = r.ParseForm(); err != nil {
+		return err
+	}
+	got, err := hex.DecodeString(sign)
+	if err != nil || !hmac.Equal(got, Sign(this.secret, r.Method, r.URL.Path, ts, r.Form)) {
+		return ErrSignature
+	}
+	return this.use(hex.EncodeToString(got), sec+int64(AUTH_MAX_SKEW/time.Second))
+}
+
+//记录签名至过期，已记录时拒绝；同时清理过期签名
+func (this *authHandler) use(sign string, expire int64) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	now := time.Now().Unix()
+	for s, e := range this.seen {
+		if e < now {
+			delete(this.seen, s)
+		}
+	}
+	if _, ok := this.seen[sign]; ok {
+		return ErrReplay
+	}
+	this.seen[sign] = expire
+	return nil
+}
+
+//请求签名：HMAC-SHA256(secret, METHOD\nPATH\nTIMESTAMP\n按key排序编码的参数)
+func Sign(secret []byte, method, path, timestamp string, params url.Values) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + params.Encode()))
+	return mac.Sum(nil)
 }
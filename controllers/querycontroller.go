@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"strings"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/handler"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	QUERY_DEF_LIMIT = 100  //列表默认返回条数
+	QUERY_MAX_LIMIT = 1000 //列表最多返回条数
+)
+
+//审批流、提现状态查询，只读
+type QueryController struct {
+	baseController
+}
+
+//查询模型
+type QueryModel struct {
+	RspNo   string      //0-成功 其他-失败
+	RspDesc string      //说明
+	Result  interface{} //结果
+}
+
+func (q *QueryController) retJSON(errNo string, err error, result interface{}) {
+	model := &QueryModel{RspNo: errNo, Result: result}
+	if err != nil {
+		model.RspDesc = err.Error()
+	}
+	q.Data["json"] = model
+	q.ServeJSON()
+}
+
+func (q *QueryController) query() *handler.Query {
+	return handler.NewQuery(comm.Ldb, handler.PriSynEth)
+}
+
+//审批流查询，带hash时返回单条及链上状态，否则返回列表
+func (q *QueryController) Flow() {
+	hash := q.GetString("hash")
+	if hash == "" {
+		offset, limit, errNo := q.page()
+		if errNo != comm.Err_OK {
+			q.retJSON(errNo, nil, nil)
+			return
+		}
+		flows, err := q.query().Flows(offset, limit)
+		q.ret(flows, err)
+		return
+	}
+	if errNo := checkHash(hash); errNo != comm.Err_OK {
+		q.retJSON(errNo, nil, nil)
+		return
+	}
+	flow, err := q.query().Flow(hash)
+	q.ret(flow, err)
+}
+
+//提现查询，带wdhash时返回单条及链上状态，否则返回列表
+func (q *QueryController) Withdraw() {
+	wdHash := q.GetString("wdhash")
+	if wdHash == "" {
+		offset, limit, errNo := q.page()
+		if errNo != comm.Err_OK {
+			q.retJSON(errNo, nil, nil)
+			return
+		}
+		withdraws, err := q.query().Withdraws(offset, limit)
+		q.ret(withdraws, err)
+		return
+	}
+	if errNo := checkHash(wdHash); errNo != comm.Err_OK {
+		q.retJSON(errNo, nil, nil)
+		return
+	}
+	withdraw, err := q.query().Withdraw(wdHash)
+	q.ret(withdraw, err)
+}
+
+//列表分页参数，limit默认QUERY_DEF_LIMIT，不超过QUERY_MAX_LIMIT
+func (q *QueryController) page() (int, int, string) {
+	offset, err := q.GetInt("offset", 0)
+	if err != nil || offset < 0 {
+		return 0, 0, comm.Err_PAGE
+	}
+	limit, err := q.GetInt("limit", QUERY_DEF_LIMIT)
+	if err != nil || limit <= 0 || limit > QUERY_MAX_LIMIT {
+		return 0, 0, comm.Err_PAGE
+	}
+	return offset, limit, comm.Err_OK
+}
+
+func (q *QueryController) ret(result interface{}, err error) {
+	switch err {
+	case nil:
+		q.retJSON(comm.Err_OK, nil, result)
+	case handler.ErrNotFound:
+		q.retJSON(comm.Err_NOT_FOUND, err, nil)
+	default:
+		logger.Error("query failed: %v", err)
+		q.retJSON(comm.Err_DB, err, nil)
+	}
+}
+
+//hash格式检查，返回错误码
+func checkHash(hash string) string {
+	if !strings.HasPrefix(hash, comm.HASH_PRIFIX) {
+		return comm.Err_UNENABLE_PREFIX
+	}
+	if len(common.FromHex(hash)) != comm.HASH_ENABLE_LENGTH {
+		return comm.Err_UNENABLE_LENGTH
+	}
+	return comm.Err_OK
+}
@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/astaxie/beego"
+)
+
+const (
+	ServiceName_HASH     = "/companion/hash"           //上链
+	ServiceName_APPLY    = "/companion/apply"          //提现
+	ServiceName_FLOW     = "/companion/query/flow"     //审批流查询
+	ServiceName_WITHDRAW = "/companion/query/withdraw" //提现查询
+)
+
+//http路由，secret为请求签名密钥，签名验证通过后进入各controller；返回的handler可直接用于http.Server或httptest
+func NewRouter(secret string) http.Handler {
+	router := beego.NewControllerRegister()
+	router.Add(ServiceName_HASH, &HashController{}, "get,post:Hash")
+	router.Add(ServiceName_APPLY, &ApplyController{}, "get,post:Apply")
+	router.Add(ServiceName_FLOW, &QueryController{}, "get:Flow")
+	router.Add(ServiceName_WITHDRAW, &QueryController{}, "get:Withdraw")
+	return newAuthHandler(secret, router)
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/boxproject/companion/comm"
+)
+
+const TEST_SECRET = "secret"
+
+//按签名规则构造请求，sign为空时不带签名头
+func signedReq(secret string, ts time.Time, params url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, ServiceName_HASH+"?"+params.Encode(), nil)
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	r.Header.Set(HEADER_TIMESTAMP, timestamp)
+	r.Header.Set(HEADER_SIGNATURE, hex.EncodeToString(Sign([]byte(secret), http.MethodGet, ServiceName_HASH, timestamp, params)))
+	return r
+}
+
+func serve(router http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func expectUnauthorized(t *testing.T, w *httptest.ResponseRecorder, want error) {
+	t.Helper()
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	model := &ErrModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), model); err != nil {
+		t.Fatal(err)
+	}
+	if model.RspNo != comm.Err_AUTH || model.RspDesc != want.Error() {
+		t.Fatalf("body: got %+v, want %s", model, want)
+	}
+}
+
+func TestRouterAuth(t *testing.T) {
+	params := url.Values{"hash": {"0x01"}, "reqtype": {comm.REQ_HASH_AVAILABLE}}
+	noSign := signedReq(TEST_SECRET, time.Now(), params)
+	noSign.Header.Del(HEADER_SIGNATURE)
+	noTimestamp := signedReq(TEST_SECRET, time.Now(), params)
+	noTimestamp.Header.Del(HEADER_TIMESTAMP)
+	tampered := signedReq(TEST_SECRET, time.Now(), params)
+	tampered.URL.RawQuery = url.Values{"hash": {"0x02"}, "reqtype": {comm.REQ_HASH_AVAILABLE}}.Encode()
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want error
+	}{
+		{"missing signature", noSign, ErrNoSign},
+		{"missing timestamp", noTimestamp, ErrNoSign},
+		{"bad signature", signedReq("other", time.Now(), params), ErrSignature},
+		{"tampered params", tampered, ErrSignature},
+		{"expired timestamp", signedReq(TEST_SECRET, time.Now().Add(-AUTH_MAX_SKEW-time.Minute), params), ErrTimestamp},
+		{"future timestamp", signedReq(TEST_SECRET, time.Now().Add(AUTH_MAX_SKEW+time.Minute), params), ErrTimestamp},
+	}
+	router := NewRouter(TEST_SECRET)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expectUnauthorized(t, serve(router, test.req), test.want)
+		})
+	}
+}
+
+func TestRouterAuthValid(t *testing.T) {
+	router := NewRouter(TEST_SECRET)
+	params := url.Values{"hash": {"0x01"}, "reqtype": {"unknown"}}
+	ts := time.Now()
+	if w := serve(router, signedReq(TEST_SECRET, ts, params)); w.Code == http.StatusUnauthorized {
+		t.Fatalf("valid request rejected: %s", w.Body.String())
+	}
+	//相同签名重放
+	expectUnauthorized(t, serve(router, signedReq(TEST_SECRET, ts, params)), ErrReplay)
+	//新的签名正常通过
+	if w := serve(router, signedReq(TEST_SECRET, ts.Add(time.Second), params)); w.Code == http.StatusUnauthorized {
+		t.Fatalf("valid request rejected: %s", w.Body.String())
+	}
+}
+
+func TestRouterNoSecret(t *testing.T) {
+	router := NewRouter("")
+	expectUnauthorized(t, serve(router, signedReq("", time.Now(), url.Values{})), ErrNoSecret)
+}
+
+func TestAuthReplayExpire(t *testing.T) {
+	auth := newAuthHandler(TEST_SECRET, http.NotFoundHandler())
+	if err := auth.use("a", time.Now().Unix()-1); err != nil {
+		t.Fatal(err)
+	}
+	//已过期的签名被清理
+	if err := auth.use("a", time.Now().Unix()+60); err != nil {
+		t.Fatalf("expired signature not evicted: %v", err)
+	}
+	if err := auth.use("a", time.Now().Unix()+60); err != ErrReplay {
+		t.Fatalf("got %v, want %v", err, ErrReplay)
+	}
+}
@@ -0,0 +1,443 @@
+package ethcli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/metrics"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	STATE_CONNECTED    = "connected"
+	STATE_DISCONNECTED = "disconnected"
+
+	PING_INTERVAL    = 10 * time.Second //保活检查间隔
+	PING_TIMEOUT     = 5 * time.Second  //保活检查超时
+	FAILOVER_TIMEOUT = 30 * time.Second //交易发送切换节点的最长等待时间
+	MAX_HEAD_LAG     = 3                //当前节点落后最高区块数超过该值时切换
+	REDIAL_FAILURES  = 3                //备用节点连续失败次数超过该值时重建连接
+
+	PEER_WAIT_TIMEOUT  = 10 * time.Second //比对节点落后时等待其同步的最长时间
+	PEER_WAIT_INTERVAL = time.Second      //等待比对节点同步的检查间隔
+)
+
+var (
+	ErrDisconnected = errors.New("geth disconnected")
+	ErrNoPeer       = errors.New("no second healthy endpoint for cross check")
+	ErrLogsMismatch = errors.New("logs mismatch between endpoints")
+	ErrPeerBehind   = errors.New("no endpoint for cross check has reached the block")
+)
+
+//节点返回的json-rpc错误，区别于连接异常
+type rpcError interface {
+	ErrorCode() int
+}
+
+//节点及健康状况
+type endpoint struct {
+	index    int
+	url      string
+	client   *ethclient.Client
+	redial   bool          //下次检查时重建连接
+	head     uint64        //最新区块
+	latency  time.Duration //检查耗时
+	err      error         //最近一次检查异常
+	failures int           //连续失败次数
+}
+
+func (e *endpoint) healthy() bool {
+	return e.client != nil && !e.redial && e.err == nil
+}
+
+//私链连接，watcher及各handler共用。定时检查各节点的可用性、区块高度及延迟，
+//当前节点异常或落后时切换到最优节点，切换或恢复后通知订阅方重新订阅；
+//实现bind.ContractBackend，合约绑定无需随切换重建
+type Client struct {
+	lock        sync.RWMutex
+	endpoints   []*endpoint
+	active      int
+	state       string
+	err         error         //最近一次连接异常
+	reconnected chan struct{} //切换或恢复时关闭并替换
+	kick        chan struct{} //立即检查
+}
+
+//连接各节点，至少一个可用时返回
+func Dial(urls ...string) (*Client, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no geth endpoint")
+	}
+	c := &Client{
+		state:       STATE_DISCONNECTED,
+		reconnected: make(chan struct{}),
+		kick:        make(chan struct{}, 1),
+	}
+	for i, url := range urls {
+		c.endpoints = append(c.endpoints, &endpoint{index: i, url: url})
+	}
+	c.probe(context.Background())
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.selectLocked(); !ok {
+		for _, e := range c.endpoints {
+			if e.client != nil {
+				e.client.Close()
+			}
+		}
+		return nil, c.endpoints[0].err
+	}
+	c.state = STATE_CONNECTED
+	metrics.EthConnected.Set(1)
+	logger.Info("[ETH] active endpoint[%d] %s", c.active, c.endpoints[c.active].url)
+	return c, nil
+}
+
+func (c *Client) eth() *ethclient.Client {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.endpoints[c.active].client
+}
+
+//连接状态及最近一次异常
+func (c *Client) State() (string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.state, c.err
+}
+
+//下次切换或恢复时关闭，订阅方应在订阅前获取
+func (c *Client) Reconnected() <-chan struct{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.reconnected
+}
+
+//使用方发现连接异常（如订阅中断），重建当前节点连接并立即重新选择节点
+func (c *Client) Fail(err error) {
+	c.lock.Lock()
+	e := c.endpoints[c.active]
+	e.err, e.redial = err, true
+	e.failures++
+	e.client.Close()
+	c.state, c.err = STATE_DISCONNECTED, err
+	c.lock.Unlock()
+	metrics.EthConnected.Set(0)
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+//连通检查
+func (c *Client) Ping(ctx context.Context) error {
+	if state, err := c.State(); state != STATE_CONNECTED {
+		if err == nil {
+			err = ErrDisconnected
+		}
+		return err
+	}
+	_, err := c.eth().HeaderByNumber(ctx, nil)
+	return err
+}
+
+func (c *Client) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, e := range c.endpoints {
+		if e.client != nil {
+			e.client.Close()
+		}
+	}
+}
+
+//定时检查各节点并按需切换，ctx取消后返回
+func (c *Client) Run(ctx context.Context) error {
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.kick:
+		case <-ticker.C:
+		}
+		c.probe(ctx)
+		c.update()
+	}
+}
+
+//检查结果
+type probeResult struct {
+	client  *ethclient.Client //新建的连接
+	head    uint64
+	latency time.Duration
+	err     error
+}
+
+//并发检查各节点，未连接或需重建的节点重新连接
+func (c *Client) probe(ctx context.Context) {
+	c.lock.RLock()
+	endpoints := make([]endpoint, len(c.endpoints))
+	for i, e := range c.endpoints {
+		endpoints[i] = *e
+	}
+	c.lock.RUnlock()
+
+	results := make([]*probeResult, len(endpoints))
+	var wg sync.WaitGroup
+	for i := range endpoints {
+		wg.Add(1)
+		go func(i int, e *endpoint) {
+			defer wg.Done()
+			pingCtx, cancel := context.WithTimeout(ctx, PING_TIMEOUT)
+			defer cancel()
+			r := &probeResult{}
+			results[i] = r
+			client := e.client
+			if client == nil || e.redial {
+				if client, r.err = ethclient.DialContext(pingCtx, e.url); r.err != nil {
+					return
+				}
+				r.client = client
+			}
+			start := time.Now()
+			head, err := client.HeaderByNumber(pingCtx, nil)
+			if err != nil {
+				r.err = err
+				return
+			}
+			r.head, r.latency = head.Number.Uint64(), time.Since(start)
+		}(i, &endpoints[i])
+	}
+	wg.Wait()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, r := range results {
+		e := c.endpoints[i]
+		if r.client != nil {
+			if e.client != nil {
+				e.client.Close()
+			}
+			e.client, e.redial = r.client, false
+		}
+		label := strconv.Itoa(i)
+		if r.err != nil {
+			e.err = r.err
+			e.failures++
+			logger.Warn("[ETH] endpoint[%d] %s unhealthy(%d): %v", i, e.url, e.failures, r.err)
+			if e.failures >= REDIAL_FAILURES && i != c.active && e.client != nil {
+				e.redial = true
+			}
+			metrics.EthEndpointUp.WithLabelValues(label).Set(0)
+			continue
+		}
+		e.err, e.failures = nil, 0
+		e.head, e.latency = r.head, r.latency
+		metrics.EthEndpointUp.WithLabelValues(label).Set(1)
+		metrics.EthEndpointHead.WithLabelValues(label).Set(float64(r.head))
+	}
+}
+
+//按检查结果选择节点，切换或恢复时通知订阅方
+func (c *Client) update() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switched, ok := c.selectLocked()
+	if !ok {
+		if c.state == STATE_CONNECTED {
+			logger.Error("[ETH] no healthy endpoint")
+		}
+		c.state, c.err = STATE_DISCONNECTED, c.endpoints[c.active].err
+		metrics.EthConnected.Set(0)
+		return
+	}
+	recovered := c.state != STATE_CONNECTED
+	c.state, c.err = STATE_CONNECTED, nil
+	metrics.EthConnected.Set(1)
+	if switched || recovered {
+		e := c.endpoints[c.active]
+		logger.Info("[ETH] active endpoint[%d] %s, head: %d", e.index, e.url, e.head)
+		close(c.reconnected)
+		c.reconnected = make(chan struct{})
+		metrics.EthReconnects.Inc()
+	}
+}
+
+//当前节点可用且落后不超过MAX_HEAD_LAG时保持，否则切换到区块最高、延迟最低的可用节点
+func (c *Client) selectLocked() (switched bool, ok bool) {
+	var best *endpoint
+	for _, e := range c.endpoints {
+		if !e.healthy() {
+			continue
+		}
+		if best == nil || e.head > best.head || (e.head == best.head && e.latency < best.latency) {
+			best = e
+		}
+	}
+	if best == nil {
+		return false, false
+	}
+	cur := c.endpoints[c.active]
+	if cur.healthy() && cur.head+MAX_HEAD_LAG >= best.head {
+		return false, true
+	}
+	if cur.healthy() {
+		logger.Warn("[ETH] endpoint[%d] head %d lags endpoint[%d] head %d", cur.index, cur.head, best.index, best.head)
+	}
+	c.active = best.index
+	return best != cur, true
+}
+
+//分别从当前节点及另一可用节点获取log并比对，一致时返回；
+//比对节点需已同步至查询的区块，均落后时等待其同步，不作为结果不一致处理
+func (c *Client) FilterLogsChecked(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	c.lock.RLock()
+	primary := c.endpoints[c.active].client
+	var peers []*ethclient.Client
+	for _, e := range c.endpoints {
+		if e.index != c.active && e.healthy() {
+			peers = append(peers, e.client)
+		}
+	}
+	c.lock.RUnlock()
+	if len(peers) == 0 {
+		return nil, ErrNoPeer
+	}
+	peer, err := syncedPeer(ctx, peers, q.ToBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := primary.FilterLogs(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	peerLogs, err := peer.FilterLogs(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(logs) != len(peerLogs) {
+		return nil, fmt.Errorf("%v: %d vs %d logs", ErrLogsMismatch, len(logs), len(peerLogs))
+	}
+	for i := range logs {
+		a, b := &logs[i], &peerLogs[i]
+		if a.BlockHash != b.BlockHash || a.TxHash != b.TxHash || a.Index != b.Index || a.Removed != b.Removed {
+			return nil, fmt.Errorf("%v: block %d, tx %s, index %d", ErrLogsMismatch, a.BlockNumber, a.TxHash.Hex(), a.Index)
+		}
+	}
+	return logs, nil
+}
+
+//返回最新区块不低于to的节点，to为空时不检查
+func syncedPeer(ctx context.Context, peers []*ethclient.Client, to *big.Int) (*ethclient.Client, error) {
+	if to == nil {
+		return peers[0], nil
+	}
+	deadline := time.NewTimer(PEER_WAIT_TIMEOUT)
+	defer deadline.Stop()
+	for {
+		for _, peer := range peers {
+			head, err := peer.HeaderByNumber(ctx, nil)
+			if err == nil && head.Number.Cmp(to) >= 0 {
+				return peer, nil
+			}
+		}
+		logger.Warn("[ETH] endpoints for cross check behind block %v, wait", to)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%v: %v", ErrPeerBehind, to)
+		case <-deadline.C:
+			return nil, fmt.Errorf("%v: %v", ErrPeerBehind, to)
+		case <-time.After(PEER_WAIT_INTERVAL):
+		}
+	}
+}
+
+//发送交易，连接异常时切换节点重发一次
+func (c *Client) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	reconnected := c.Reconnected()
+	err := c.eth().SendTransaction(ctx, tx)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if _, ok := err.(rpcError); ok {
+		return err
+	}
+	logger.Warn("[ETH] send tx %s failed: %v, failover", tx.Hash().Hex(), err)
+	c.Fail(err)
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		return err
+	case <-time.After(FAILOVER_TIMEOUT):
+		return err
+	}
+	return c.eth().SendTransaction(ctx, tx)
+}
+
+func (c *Client) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return c.eth().CodeAt(ctx, contract, blockNumber)
+}
+
+func (c *Client) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	return c.eth().CallContract(ctx, call, blockNumber)
+}
+
+func (c *Client) PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error) {
+	return c.eth().PendingCodeAt(ctx, account)
+}
+
+func (c *Client) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return c.eth().PendingNonceAt(ctx, account)
+}
+
+func (c *Client) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	return c.eth().NonceAt(ctx, account, blockNumber)
+}
+
+func (c *Client) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return c.eth().SuggestGasPrice(ctx)
+}
+
+func (c *Client) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return c.eth().EstimateGas(ctx, call)
+}
+
+func (c *Client) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	return c.eth().FilterLogs(ctx, q)
+}
+
+func (c *Client) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	return c.eth().SubscribeFilterLogs(ctx, q, ch)
+}
+
+func (c *Client) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	return c.eth().SubscribeNewHead(ctx, ch)
+}
+
+func (c *Client) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return c.eth().HeaderByNumber(ctx, number)
+}
+
+func (c *Client) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	return c.eth().BlockByNumber(ctx, number)
+}
+
+func (c *Client) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	return c.eth().TransactionByHash(ctx, hash)
+}
+
+func (c *Client) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	return c.eth().TransactionReceipt(ctx, txHash)
+}
@@ -0,0 +1,80 @@
+package ethcli
+
+import (
+	"context"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+//返回固定log的模拟节点，最新区块可调整
+type fakeNode struct {
+	head int64
+	logs []types.Log
+}
+
+func (f *fakeNode) GetBlockByNumber(ctx context.Context, number rpc.BlockNumber, full bool) (*types.Header, error) {
+	return &types.Header{Number: big.NewInt(atomic.LoadInt64(&f.head)), Difficulty: big.NewInt(1)}, nil
+}
+
+func (f *fakeNode) GetLogs(ctx context.Context, crit map[string]interface{}) ([]types.Log, error) {
+	return f.logs, nil
+}
+
+func startNode(t *testing.T, node *fakeNode) string {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", node); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return httpServer.URL
+}
+
+func TestFilterLogsCheckedPeerBehind(t *testing.T) {
+	logs := []types.Log{{Address: common.Address{1}, BlockNumber: 10, TxHash: common.Hash{1}, BlockHash: common.Hash{2}, Topics: []common.Hash{{3}}}}
+	primary := &fakeNode{head: 10, logs: logs}
+	peer := &fakeNode{head: 8, logs: logs}
+	client, err := Dial(startNode(t, primary), startNode(t, peer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	q := ethereum.FilterQuery{FromBlock: big.NewInt(9), ToBlock: big.NewInt(10)}
+
+	//比对节点落后时等待，不按不一致处理
+	ctx, cancel := context.WithTimeout(context.Background(), PEER_WAIT_INTERVAL/2)
+	_, err = client.FilterLogsChecked(ctx, q)
+	cancel()
+	if err == nil || !strings.Contains(err.Error(), ErrPeerBehind.Error()) {
+		t.Fatalf("got %v, want %v", err, ErrPeerBehind)
+	}
+
+	time.AfterFunc(PEER_WAIT_INTERVAL/2, func() { atomic.StoreInt64(&peer.head, 10) })
+	got, err := client.FilterLogsChecked(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].TxHash != logs[0].TxHash {
+		t.Fatalf("logs: %+v", got)
+	}
+}
+
+func TestFilterLogsCheckedNoPeer(t *testing.T) {
+	client, err := Dial(startNode(t, &fakeNode{head: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err = client.FilterLogsChecked(context.Background(), ethereum.FilterQuery{ToBlock: big.NewInt(10)}); err != ErrNoPeer {
+		t.Fatalf("got %v, want %v", err, ErrNoPeer)
+	}
+}
@@ -0,0 +1,191 @@
+package grpcserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	ErrIllegalHash   = errors.New("illegal hash")
+	ErrIllegalAmount = errors.New("illegal amount, fee or category")
+	ErrEmptyOperate  = errors.New("empty voucher operate")
+)
+
+//voucher下发消息处理
+type streamHandler func(n *replyServer, model *comm.GrpcStream) error
+
+var streamHandlers = map[string]streamHandler{
+	comm.GRPC_STREAM_ACK:       ackHandler,
+	comm.GRPC_HASH_ADD_REQ:     hashAddHandler,
+	comm.GRPC_HASH_ENABLE_REQ:  hashEnableHandler,
+	comm.GRPC_HASH_DISABLE_REQ: hashDisableHandler,
+	comm.GRPC_WITHDRAW_REQ:     withdrawHandler,
+	comm.GRPC_DEPOSIT_WEB:      webHandler(comm.REQ_DEPOSIT),
+	comm.GRPC_WITHDRAW_TX_WEB:  webHandler(comm.REQ_WITHDRAW_TX),
+	comm.GRPC_WITHDRAW_WEB:     webHandler(comm.REQ_WITHDRAW),
+	comm.GRPC_VOUCHER_OPR_REQ:  voucherOprHandler,
+	comm.GRPC_TOKEN_LIST_WEB:   tokenListHandler,
+	comm.GRPC_COIN_LIST_WEB:    coinListHandler,
+	comm.GRPC_HASH_ENABLE_WEB:  hashStatusHandler(comm.HASH_ENABLE_PREFIX),
+	comm.GRPC_HASH_DISABLE_WEB: hashStatusHandler(comm.HASH_DISABLE_PREFIX),
+}
+
+//上报确认
+func ackHandler(n *replyServer, model *comm.GrpcStream) error {
+	return comm.AckStream(model.Seq, n.retention)
+}
+
+//hash add申请，上私链
+func hashAddHandler(_ *replyServer, model *comm.GrpcStream) error {
+	//approver := streamModel.Approver //审批人
+	//content := streamModel.Content   //内容
+	return comm.PushReq(&comm.RequestModel{Hash: model.Hash.Hex(), ReqType: comm.REQ_HASH_ADD})
+}
+
+//同意，上私链
+func hashEnableHandler(_ *replyServer, model *comm.GrpcStream) error {
+	hash := model.Hash.Hex()
+	if !checkHash(hash) {
+		return ErrIllegalHash
+	}
+	return comm.PushReq(&comm.RequestModel{Hash: hash, ReqType: comm.REQ_HASH_ENABLE})
+}
+
+//禁用，上私链
+func hashDisableHandler(_ *replyServer, model *comm.GrpcStream) error {
+	hash := model.Hash.Hex()
+	if !checkHash(hash) {
+		return ErrIllegalHash
+	}
+	return comm.PushReq(&comm.RequestModel{Hash: hash, ReqType: comm.REQ_HASH_DISABLE})
+}
+
+//提现申请，上私链
+func withdrawHandler(_ *replyServer, model *comm.GrpcStream) error {
+	if model.Amount == nil || model.Fee == nil || model.Category == nil {
+		return ErrIllegalAmount
+	}
+	return comm.PushReq(&comm.RequestModel{
+		Hash:       model.Hash.Hex(),
+		ReqType:    comm.REQ_OUT_APPROVE,
+		WdHash:     model.WdHash.Hex(),
+		RecAddress: model.To,
+		Amount:     model.Amount.String(),
+		Fee:        model.Fee.String(),
+		Category:   model.Category.Int64(),
+	})
+}
+
+//充值、提现tx、提现结果，落地后经http上报web
+func webHandler(reqType string) streamHandler {
+	return func(_ *replyServer, model *comm.GrpcStream) error {
+		req := &comm.VReq{
+			ReqType: reqType,
+			Account: model.Account,
+			From:    model.From,
+			To:      model.To,
+			WdHash:  model.WdHash.Hex(),
+			TxHash:  model.TxHash,
+		}
+		if model.Amount != nil {
+			req.Amount = model.Amount.String()
+		}
+		if model.Category != nil {
+			req.Category = model.Category.Int64()
+		}
+		return comm.PushVReq(req)
+	}
+}
+
+//签名机操作，按 vo_TYPE_HASH 落地留存，重复下发时不重复处理；无hash时按内容hash
+func voucherOprHandler(_ *replyServer, model *comm.GrpcStream) error {
+	if model.VoucherOperate == nil {
+		return ErrEmptyOperate
+	}
+	data, err := json.Marshal(model.VoucherOperate)
+	if err != nil {
+		return err
+	}
+	hash := model.Hash
+	if hash == (common.Hash{}) {
+		if model.VoucherOperate.Hash != "" {
+			hash = common.HexToHash(model.VoucherOperate.Hash)
+		} else {
+			hash = crypto.Keccak256Hash(data)
+		}
+	}
+	key := []byte(comm.VOUCHER_OPR_PREFIX + model.VoucherOperate.Type + "_" + hash.Hex())
+	if has, err := comm.Ldb.Has(key, nil); err != nil {
+		return err
+	} else if has {
+		log.Info("duplicate voucher operate: %s", string(key))
+		return nil
+	}
+	return comm.Ldb.PutByte(key, data)
+}
+
+//token列表，全量替换
+func tokenListHandler(_ *replyServer, model *comm.GrpcStream) error {
+	return replaceList(comm.TOKEN_PREFIX, model.TokenList, func(token *comm.TokenInfo) string {
+		return strings.ToLower(token.ContractAddr)
+	})
+}
+
+//coin列表，全量替换
+func coinListHandler(_ *replyServer, model *comm.GrpcStream) error {
+	return replaceList(comm.COIN_PREFIX, model.TokenList, func(coin *comm.TokenInfo) string {
+		return fmt.Sprintf("%d", coin.Category)
+	})
+}
+
+func replaceList(prefix string, list []*comm.TokenInfo, keyFunc func(*comm.TokenInfo) string) error {
+	batch := new(leveldb.Batch)
+	iter := comm.Ldb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	for _, info := range list {
+		if info == nil {
+			continue
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		batch.Put([]byte(prefix+keyFunc(info)), data)
+	}
+	log.Info("replace %s list, count: %d", prefix, len(list))
+	return comm.Ldb.Write(batch, nil)
+}
+
+//公链hash启用、禁用log，按hash落地
+func hashStatusHandler(prefix string) streamHandler {
+	return func(_ *replyServer, model *comm.GrpcStream) error {
+		hash := model.Hash.Hex()
+		if !checkHash(hash) {
+			return ErrIllegalHash
+		}
+		data, err := json.Marshal(model)
+		if err != nil {
+			return err
+		}
+		return comm.Ldb.PutByte([]byte(prefix+hash), data)
+	}
+}
+
+func checkHash(hash string) bool {
+	return strings.HasPrefix(hash, comm.HASH_PRIFIX) && len(common.FromHex(hash)) == comm.HASH_ENABLE_LENGTH
+}
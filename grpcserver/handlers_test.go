@@ -0,0 +1,294 @@
+package grpcserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/config"
+	"github.com/boxproject/companion/db"
+	pb "github.com/boxproject/companion/pb"
+	"github.com/ethereum/go-ethereum/common"
+	"google.golang.org/grpc"
+)
+
+const TEST_WAIT = 5 * time.Second
+
+//模拟voucher：Listen下发消息，Router接收上报及确认
+type fakeSynchronizer struct {
+	inbound chan *comm.GrpcStream
+	acks    chan uint64
+}
+
+func (f *fakeSynchronizer) Listen(stream pb.Synchronizer_ListenServer) error {
+	//companion注册
+	if _, err := stream.Recv(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case model := <-f.inbound:
+			data, err := json.Marshal(model)
+			if err != nil {
+				return err
+			}
+			if err = stream.Send(&pb.StreamRsp{Msg: data}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (f *fakeSynchronizer) Router(_ context.Context, req *pb.RouterRequest) (*pb.RouterResponse, error) {
+	model := &comm.GrpcStream{}
+	if err := json.Unmarshal(req.Msg, model); err != nil {
+		return nil, err
+	}
+	if model.Type == comm.GRPC_STREAM_ACK {
+		f.acks <- model.Seq
+	}
+	return &pb.RouterResponse{}, nil
+}
+
+func (f *fakeSynchronizer) Heart(context.Context, *pb.HeartRequest) (*pb.HeartResponse, error) {
+	return &pb.HeartResponse{}, nil
+}
+
+//下发消息，并以一条必然确认的消息作为结束标记，返回消息是否被确认
+func (f *fakeSynchronizer) deliver(t *testing.T, model *comm.GrpcStream) bool {
+	t.Helper()
+	probe := &comm.GrpcStream{Seq: model.Seq + 100000, Type: comm.GRPC_HASH_ENABLE_WEB, Hash: common.BigToHash(big.NewInt(int64(model.Seq)))}
+	f.inbound <- model
+	f.inbound <- probe
+	acked := false
+	for {
+		select {
+		case seq := <-f.acks:
+			switch seq {
+			case model.Seq:
+				acked = true
+			case probe.Seq:
+				comm.Ldb.DelKey([]byte(comm.HASH_ENABLE_PREFIX + probe.Hash.Hex()))
+				return acked
+			}
+		case <-time.After(TEST_WAIT):
+			t.Fatalf("stream[%d] not handled", model.Seq)
+		}
+	}
+}
+
+func newFakeSynchronizer(t *testing.T) *fakeSynchronizer {
+	ldb, err := db.InitDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	comm.Ldb = ldb
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeSynchronizer{inbound: make(chan *comm.GrpcStream), acks: make(chan uint64, 16)}
+	srv := grpc.NewServer()
+	pb.RegisterSynchronizerServer(srv, fake)
+	go srv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &replyServer{conn: conn, routerInfo: config.RouterInfo{SerVoucher: "voucher", SerCompanion: "companion", CompanionName: "test"}, ackTimeout: time.Minute, retention: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		streamRecv(ctx, n)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		conn.Close()
+		srv.Stop()
+		ldb.Close()
+	})
+	return fake
+}
+
+func hashOf(n int64) common.Hash {
+	return common.BigToHash(big.NewInt(n))
+}
+
+func has(t *testing.T, key string) bool {
+	t.Helper()
+	ok, err := comm.Ldb.Has([]byte(key), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func count(t *testing.T, prefix string) int {
+	t.Helper()
+	resMap, err := comm.Ldb.GetPrifix([]byte(prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(resMap)
+}
+
+func expectReq(t *testing.T, want *comm.RequestModel) {
+	t.Helper()
+	select {
+	case req := <-comm.ReqChan:
+		if *req != *want {
+			t.Fatalf("request: got %+v, want %+v", req, want)
+		}
+		if !has(t, comm.REQ_QUEUE_PREFIX+comm.ReqKey(want)) {
+			t.Fatalf("request %s not landed", comm.ReqKey(want))
+		}
+	default:
+		t.Fatal("no request pushed")
+	}
+}
+
+func expectNoReq(t *testing.T) {
+	t.Helper()
+	select {
+	case req := <-comm.ReqChan:
+		t.Fatalf("unexpected request: %+v", req)
+	default:
+	}
+}
+
+func expectVReq(t *testing.T, want *comm.VReq) {
+	t.Helper()
+	select {
+	case req := <-comm.VReqChan:
+		if *req != *want {
+			t.Fatalf("vreq: got %+v, want %+v", req, want)
+		}
+		if !has(t, comm.VREQ_QUEUE_PREFIX+comm.VReqKey(want)) {
+			t.Fatalf("vreq %s not landed", comm.VReqKey(want))
+		}
+	default:
+		t.Fatal("no vreq pushed")
+	}
+}
+
+func TestStreamHandlers(t *testing.T) {
+	fake := newFakeSynchronizer(t)
+	//ack测试用的待确认上报
+	outSeq, err := comm.PushStream(&comm.GrpcStream{Type: comm.GRPC_HASH_ADD_LOG, Hash: hashOf(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	operate := &comm.Operate{Type: "1", AppId: "app", Hash: hashOf(9).Hex()}
+	tokens := []*comm.TokenInfo{{TokenName: "A", ContractAddr: "0xAbCd", Category: 3}, {TokenName: "B", ContractAddr: "0xEf01", Category: 4}}
+
+	tests := []struct {
+		name   string
+		stream *comm.GrpcStream
+		acked  bool
+		check  func(t *testing.T)
+	}{
+		{"hash add", &comm.GrpcStream{Type: comm.GRPC_HASH_ADD_REQ, Hash: hashOf(1)}, true, func(t *testing.T) {
+			expectReq(t, &comm.RequestModel{Hash: hashOf(1).Hex(), ReqType: comm.REQ_HASH_ADD})
+		}},
+		{"hash add redelivered", &comm.GrpcStream{Type: comm.GRPC_HASH_ADD_REQ, Hash: hashOf(1)}, true, expectNoReq},
+		{"hash enable", &comm.GrpcStream{Type: comm.GRPC_HASH_ENABLE_REQ, Hash: hashOf(1)}, true, func(t *testing.T) {
+			expectReq(t, &comm.RequestModel{Hash: hashOf(1).Hex(), ReqType: comm.REQ_HASH_ENABLE})
+		}},
+		{"hash disable", &comm.GrpcStream{Type: comm.GRPC_HASH_DISABLE_REQ, Hash: hashOf(1)}, true, func(t *testing.T) {
+			expectReq(t, &comm.RequestModel{Hash: hashOf(1).Hex(), ReqType: comm.REQ_HASH_DISABLE})
+		}},
+		{"withdraw", &comm.GrpcStream{Type: comm.GRPC_WITHDRAW_REQ, Hash: hashOf(1), WdHash: hashOf(2), To: "0x01", Amount: big.NewInt(100), Fee: big.NewInt(1), Category: big.NewInt(3)}, true, func(t *testing.T) {
+			expectReq(t, &comm.RequestModel{Hash: hashOf(1).Hex(), ReqType: comm.REQ_OUT_APPROVE, WdHash: hashOf(2).Hex(), RecAddress: "0x01", Amount: "100", Fee: "1", Category: 3})
+		}},
+		{"withdraw without amount", &comm.GrpcStream{Type: comm.GRPC_WITHDRAW_REQ, Hash: hashOf(1), WdHash: hashOf(3)}, false, expectNoReq},
+		{"deposit web", &comm.GrpcStream{Type: comm.GRPC_DEPOSIT_WEB, Account: "acc", From: "0x02", To: "0x03", TxHash: "0x04", Amount: big.NewInt(5), Category: big.NewInt(1)}, true, func(t *testing.T) {
+			expectVReq(t, &comm.VReq{ReqType: comm.REQ_DEPOSIT, Account: "acc", From: "0x02", To: "0x03", TxHash: "0x04", WdHash: common.Hash{}.Hex(), Amount: "5", Category: 1})
+		}},
+		{"withdraw tx web", &comm.GrpcStream{Type: comm.GRPC_WITHDRAW_TX_WEB, WdHash: hashOf(2), TxHash: "0x05"}, true, func(t *testing.T) {
+			expectVReq(t, &comm.VReq{ReqType: comm.REQ_WITHDRAW_TX, WdHash: hashOf(2).Hex(), TxHash: "0x05"})
+		}},
+		{"withdraw web", &comm.GrpcStream{Type: comm.GRPC_WITHDRAW_WEB, WdHash: hashOf(2), TxHash: "0x06", Amount: big.NewInt(7)}, true, func(t *testing.T) {
+			expectVReq(t, &comm.VReq{ReqType: comm.REQ_WITHDRAW, WdHash: hashOf(2).Hex(), TxHash: "0x06", Amount: "7"})
+		}},
+		{"voucher operate", &comm.GrpcStream{Type: comm.GRPC_VOUCHER_OPR_REQ, VoucherOperate: operate}, true, func(t *testing.T) {
+			if !has(t, comm.VOUCHER_OPR_PREFIX+operate.Type+"_"+operate.Hash) {
+				t.Fatal("voucher operate not landed")
+			}
+		}},
+		{"voucher operate redelivered", &comm.GrpcStream{Type: comm.GRPC_VOUCHER_OPR_REQ, VoucherOperate: operate}, true, func(t *testing.T) {
+			if n := count(t, comm.VOUCHER_OPR_PREFIX); n != 1 {
+				t.Fatalf("voucher operates: got %d, want 1", n)
+			}
+		}},
+		{"voucher operate empty", &comm.GrpcStream{Type: comm.GRPC_VOUCHER_OPR_REQ}, false, nil},
+		{"token list", &comm.GrpcStream{Type: comm.GRPC_TOKEN_LIST_WEB, TokenList: tokens}, true, func(t *testing.T) {
+			if !has(t, comm.TOKEN_PREFIX+"0xabcd") || !has(t, comm.TOKEN_PREFIX+"0xef01") {
+				t.Fatal("token list not landed")
+			}
+		}},
+		{"token list replaced", &comm.GrpcStream{Type: comm.GRPC_TOKEN_LIST_WEB, TokenList: tokens[1:]}, true, func(t *testing.T) {
+			if n := count(t, comm.TOKEN_PREFIX); n != 1 || !has(t, comm.TOKEN_PREFIX+"0xef01") {
+				t.Fatalf("token list not replaced, count: %d", n)
+			}
+		}},
+		{"coin list", &comm.GrpcStream{Type: comm.GRPC_COIN_LIST_WEB, TokenList: tokens}, true, func(t *testing.T) {
+			if !has(t, comm.COIN_PREFIX+"3") || !has(t, comm.COIN_PREFIX+"4") {
+				t.Fatal("coin list not landed")
+			}
+		}},
+		{"hash enable web", &comm.GrpcStream{Type: comm.GRPC_HASH_ENABLE_WEB, Hash: hashOf(1)}, true, func(t *testing.T) {
+			if !has(t, comm.HASH_ENABLE_PREFIX+hashOf(1).Hex()) {
+				t.Fatal("hash enable not landed")
+			}
+		}},
+		{"hash disable web", &comm.GrpcStream{Type: comm.GRPC_HASH_DISABLE_WEB, Hash: hashOf(1)}, true, func(t *testing.T) {
+			if !has(t, comm.HASH_DISABLE_PREFIX+hashOf(1).Hex()) {
+				t.Fatal("hash disable not landed")
+			}
+		}},
+		//确认消息不再回发确认
+		{"stream ack", &comm.GrpcStream{Type: comm.GRPC_STREAM_ACK, Seq: outSeq}, false, func(t *testing.T) {
+			if has(t, string(outboxKey(comm.OUTBOX_PREFIX, outSeq))) || !has(t, string(outboxKey(comm.OUTBOX_ACKED_PREFIX, outSeq))) {
+				t.Fatalf("outbox[%d] not acked", outSeq)
+			}
+		}},
+		//私链log仅由companion上报，下发时忽略
+		{"unknown type", &comm.GrpcStream{Type: comm.GRPC_HASH_ADD_LOG, Hash: hashOf(1)}, false, nil},
+	}
+
+	covered := make(map[string]bool)
+	for i, test := range tests {
+		covered[test.stream.Type] = true
+		if test.stream.Seq == 0 {
+			test.stream.Seq = uint64(1000 + i)
+		}
+		t.Run(test.name, func(t *testing.T) {
+			if acked := fake.deliver(t, test.stream); acked != test.acked {
+				t.Fatalf("acked: got %v, want %v", acked, test.acked)
+			}
+			if test.check != nil {
+				test.check(t)
+			}
+		})
+	}
+	for typ := range streamHandlers {
+		if !covered[typ] {
+			t.Errorf("stream type %s not covered", typ)
+		}
+	}
+}
+
+func outboxKey(prefix string, seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", prefix, seq))
+}
@@ -0,0 +1,42 @@
+package grpcserver
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrStreamDisconnected = errors.New("grpc stream disconnected")
+	ErrNoHeart            = errors.New("no heart response yet")
+)
+
+//stream连接状态及最近一次心跳成功时间
+var (
+	streamConnected int32
+	lastHeart       int64
+)
+
+func setConnected(connected bool) {
+	var v int32
+	if connected {
+		v = 1
+	}
+	atomic.StoreInt32(&streamConnected, v)
+}
+
+//健康检查：stream已连接，且heartTimeout内心跳成功
+func Health(heartTimeout time.Duration) error {
+	if atomic.LoadInt32(&streamConnected) == 0 {
+		return ErrStreamDisconnected
+	}
+	heart := atomic.LoadInt64(&lastHeart)
+	if heart == 0 {
+		return ErrNoHeart
+	}
+	if age := time.Since(time.Unix(0, heart)); age > heartTimeout {
+		return fmt.Errorf("no heart response for %v", age.Round(time.Second))
+	}
+	return nil
+}
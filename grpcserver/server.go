@@ -5,30 +5,46 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	//"io"
 	"io/ioutil"
+	"sync/atomic"
 	"time"
 
 	"github.com/boxproject/companion/comm"
 	"github.com/boxproject/companion/config"
+	"github.com/boxproject/companion/metrics"
 	pb "github.com/boxproject/companion/pb"
 	"github.com/boxproject/companion/util"
-	"github.com/boxproject/companion/watcher"
 
 	log "github.com/alecthomas/log4go"
-	"github.com/ethereum/go-ethereum/common"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-	"strings"
 )
 
 //
 type replyServer struct {
 	routerInfo config.RouterInfo
 	conn       *grpc.ClientConn
-	watcher    *watcher.EthEventLogWatcher
-	isRouther  bool
+	ackTimeout time.Duration //等待voucher确认时间，超时重发
+	retention  time.Duration //已确认上报保留时间
+}
+
+const (
+	GRPC_SEND_TIMEOUT     = 10 * time.Second //单次上报超时
+	OUTBOX_SCAN_INTERVAL  = time.Second      //待发送上报检查间隔
+	OUTBOX_PRUNE_INTERVAL = time.Hour        //已确认上报清理间隔
+	OUTBOX_BATCH_SIZE     = 100              //单次发送上报数
+	HEART_INTERVAL        = 10 * time.Second //心跳间隔
+)
+
+var ErrNoCert = errors.New("no certificate found in client_cert")
+
+//加载并校验客户端证书，热加载时在断开当前连接前调用
+func CheckCredential(cfg *config.Config) error {
+	_, err := loadCredential(cfg)
+	return err
 }
 
 func loadCredential(cfg *config.Config) (credentials.TransportCredentials, error) {
@@ -37,6 +53,13 @@ func loadCredential(cfg *config.Config) (credentials.TransportCredentials, error
 	if err != nil {
 		return nil, err
 	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("client_cert not valid at %v, valid from %v to %v", now.Format(time.RFC3339), leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
 
 	certBytes, err := ioutil.ReadFile(cfg.ClientCert)
 	if err != nil {
@@ -46,7 +69,7 @@ func loadCredential(cfg *config.Config) (credentials.TransportCredentials, error
 	clientCertPool := x509.NewCertPool()
 	ok := clientCertPool.AppendCertsFromPEM(certBytes)
 	if !ok {
-		return nil, err
+		return nil, ErrNoCert
 	}
 
 	config := &tls.Config{
@@ -57,11 +80,15 @@ func loadCredential(cfg *config.Config) (credentials.TransportCredentials, error
 	return credentials.NewTLS(config), nil
 }
 
-func InitConn(cfg *config.Config, watcher *watcher.EthEventLogWatcher) error {
+//连接gRPC服务并处理收发，ctx取消后将未发送的上报落地后返回
+func InitConn(ctx context.Context, cfg *config.Config) error {
 	log.Debug("init rpc client ....")
 
-	//重新发送失败GRPC
-	watcher.ReSendGrpcStream()
+	//旧版本未发送GRPC转入发件箱
+	if err := comm.MigrateGrpcStream(); err != nil {
+		log.Error("migrate grpc stream failed. cause: %v", err)
+		return err
+	}
 
 	cred, err := loadCredential(cfg)
 	if err != nil {
@@ -73,159 +100,202 @@ func InitConn(cfg *config.Config, watcher *watcher.EthEventLogWatcher) error {
 		log.Error("connect to the remote server failed. cause: %v", err)
 		return err
 	}
-	replyServer := &replyServer{conn: conn, watcher: watcher, routerInfo: cfg.RouterInfo}
-
-	go streamRecv(replyServer)
+	defer conn.Close()
+	defer setConnected(false)
+	//重连时结束本次连接的清理及心跳
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	replyServer := &replyServer{conn: conn, routerInfo: cfg.RouterInfo, ackTimeout: config.DEF_OUTBOX_ACK_TIMEOUT * time.Second, retention: config.DEF_OUTBOX_RETENTION * time.Hour}
+	if cfg.OutboxAckTimeout > 0 {
+		replyServer.ackTimeout = time.Duration(cfg.OutboxAckTimeout) * time.Second
+	}
+	if cfg.OutboxRetention != 0 {
+		replyServer.retention = time.Duration(cfg.OutboxRetention) * time.Hour
+	}
 
+	go prune(ctx, replyServer)
+	go heart(ctx, replyServer)
+	streamRecv(ctx, replyServer)
 	return nil
 }
 
 //stream recv
-func streamRecv(n *replyServer) {
+func streamRecv(ctx context.Context, n *replyServer) {
 	timeCount := 1
 	for {
 		log.Info("try reveive...%d", timeCount)
+		if timeCount > 1 {
+			metrics.GrpcReconnects.Inc()
+		}
 		client := pb.NewSynchronizerClient(n.conn)
-		stream, err := client.Listen(context.TODO())
+		stream, err := client.Listen(ctx)
 		if err != nil {
 			log.Error("[STREAM ERR] %v\n", err)
 		} else {
 			waitc := make(chan struct{})
 			//注册服务
 			stream.Send(&pb.ListenReq{ServerName: n.routerInfo.SerCompanion, Name: n.routerInfo.CompanionName, Ip: util.GetCurrentIp()})
+			setConnected(true)
 			go func() {
 				for {
 					if resp, err := stream.Recv(); err != nil { //rec error
 						log.Error("[STREAM ERR] %v\n", err)
+						setConnected(false)
 						close(waitc)
 						return
 					} else {
 						//log.Debug("stream Recv: %s\n", resp)
-						handleStream(resp)
+						handleStream(n, resp)
 					}
 				}
 			}()
-			//启动心跳检测
-			//go heart(n)
-			//路由发送
-			go router(n)
+			//路由发送，等待当前发送完成
+			routerDone := make(chan struct{})
+			go func() {
+				router(ctx, n, waitc)
+				close(routerDone)
+			}()
 			<-waitc
-			n.isRouther = false
+			<-routerDone
 			if err = stream.CloseSend(); err != nil {
 				log.Error("%v.CloseAndRecv() got error %v, want %v", stream, err, nil)
 			}
 		}
 		timeCount++
-		time.Sleep(time.Second * 5)
+		select {
+		case <-ctx.Done():
+			log.Info("end streamRecv")
+			return
+		case <-time.After(time.Second * 5):
+		}
 	}
-	log.Info("end streamRecv")
 }
 
-func heart(n *replyServer) {
-	timerHeart := time.NewTicker(time.Second * 10)
-	timeCount := 1
+//心跳检测，成功时记录时间供健康检查使用
+func heart(ctx context.Context, n *replyServer) {
+	timerHeart := time.NewTicker(HEART_INTERVAL)
+	defer timerHeart.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-timerHeart.C:
-			//log.Info("try heart...%d", timeCount)
 			client := pb.NewSynchronizerClient(n.conn)
-			if _, err := client.Heart(context.TODO(), &pb.HeartRequest{RouterType: "grpc", ServerName: n.routerInfo.SerCompanion, Name: n.routerInfo.CompanionName, Ip: util.GetCurrentIp(), Msg: []byte("heart")}); err != nil {
+			heartCtx, cancel := context.WithTimeout(ctx, GRPC_SEND_TIMEOUT)
+			if _, err := client.Heart(heartCtx, &pb.HeartRequest{RouterType: "grpc", ServerName: n.routerInfo.SerCompanion, Name: n.routerInfo.CompanionName, Ip: util.GetCurrentIp(), Msg: []byte("heart")}); err != nil {
 				log.Error("heart req failed %s\n", err)
 			} else {
-				//log.Debug("heart response", rsp)
+				atomic.StoreInt64(&lastHeart, time.Now().UnixNano())
 			}
+			cancel()
+		}
+	}
+}
 
-			timeCount++
+//按序号发送待确认上报，stream断开或ctx取消后退出
+func router(ctx context.Context, n *replyServer, done <-chan struct{}) {
+	ticker := time.NewTicker(OUTBOX_SCAN_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-comm.OutboxNotify:
 		}
+		flush(ctx, n, done)
 	}
 }
 
-func router(n *replyServer) {
-	n.isRouther = true
-	for n.isRouther {
+//发送到期上报：发送失败按退避时间重试，发送成功后等待确认，超时未确认重发
+func flush(ctx context.Context, n *replyServer, done <-chan struct{}) {
+	entries, err := comm.DueStreams(time.Now().Unix(), OUTBOX_BATCH_SIZE)
+	if err != nil {
+		log.Error("load outbox failed: %v", err)
+		return
+	}
+	for _, entry := range entries {
 		select {
-		case data, ok := <-comm.GrpcStreamChan:
-			if ok {
-				if msgJson, err := json.Marshal(data); err != nil {
-					log.Error("json marshal error:%v", err)
-				} else {
-					log.Debug("grpc send:\n", data)
-					//发送标志
-					var isSendOK bool = true
-					client := pb.NewSynchronizerClient(n.conn)
-					if _, err := client.Router(context.TODO(), &pb.RouterRequest{RouterType: "web", RouterName: n.routerInfo.SerVoucher, Msg: msgJson}); err != nil {
-						log.Error("heart req failed %s\n", err)
-						isSendOK = false
-					} else {
-						//log.Debug("heart response", rsp)
-					}
-					//update grpc db
-					switch data.Type {
-					case comm.GRPC_HASH_ADD_LOG,
-						comm.GRPC_HASH_ENABLE_LOG,
-						comm.GRPC_HASH_DISABLE_LOG:
-						//重新写入数据
-						if err := n.watcher.SetGrpcStreamDB(isSendOK, data.Type, data.Hash.Hex(), msgJson); err != nil {
-							log.Error("landtodb error", err)
-						}
-						break
-					case comm.GRPC_WITHDRAW_LOG:
-						//重新写入数据
-						if err := n.watcher.SetGrpcStreamDB(isSendOK, data.Type, data.WdHash.Hex(), msgJson); err != nil {
-							log.Error("landtodb error", err)
-						}
-					default:
-						log.Info("no grpc type :", data.Type)
-					}
-				}
-			} else {
-				log.Error("read from grpc channel failed")
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		default:
+		}
+
+		entry.Attempts++
+		err := send(n, entry.Stream)
+		wait := util.DefaultBackoff.Duration(entry.Attempts)
+		if err == nil && wait < n.ackTimeout {
+			wait = n.ackTimeout
+		}
+		entry.NextTime = time.Now().Add(wait).Unix()
+		if err := comm.SaveStream(entry); err != nil {
+			log.Error("land outbox[%d] failed: %v", entry.Seq, err)
+		}
+		if err != nil {
+			log.Error("grpc send[%d] failed, retry[%d] after %v: %v", entry.Seq, entry.Attempts, wait, err)
+			return
+		}
+	}
+}
+
+func send(n *replyServer, data *comm.GrpcStream) error {
+	msgJson, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	log.Debug("grpc send:\n", data)
+	client := pb.NewSynchronizerClient(n.conn)
+	ctx, cancel := context.WithTimeout(context.Background(), GRPC_SEND_TIMEOUT)
+	defer cancel()
+	start := time.Now()
+	_, err = client.Router(ctx, &pb.RouterRequest{RouterType: "web", RouterName: n.routerInfo.SerVoucher, Msg: msgJson})
+	metrics.RouterLatency.Observe(time.Since(start).Seconds())
+	return err
+}
+
+//定时清理已确认上报
+func prune(ctx context.Context, n *replyServer) {
+	ticker := time.NewTicker(OUTBOX_PRUNE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if count, err := comm.PruneStreams(n.retention); err != nil {
+				log.Error("prune outbox failed: %v", err)
+			} else if count > 0 {
+				log.Info("prune %d acked grpc streams", count)
 			}
 		}
 	}
 }
 
-//处理流
-func handleStream(streamRsp *pb.StreamRsp) {
+//处理流，落地成功后按Seq回发确认；处理失败时不确认，由voucher重发
+func handleStream(n *replyServer, streamRsp *pb.StreamRsp) error {
 	streamModel := &comm.GrpcStream{}
 	if err := json.Unmarshal(streamRsp.Msg, streamModel); err != nil {
 		log.Error("json marshal error:%v", err)
-		return
+		return err
 	}
-	switch streamModel.Type {
-	case comm.GRPC_HASH_ADD_REQ: //hash add申请
-		hash := streamModel.Hash.Hex()
-		//approver := streamModel.Approver //审批人
-		//content := streamModel.Content   //内容
-		comm.ReqChan <- &comm.RequestModel{Hash: hash, ReqType: comm.REQ_HASH_ADD}
-		break
-	case comm.GRPC_HASH_ENABLE_REQ: //同意
-		hash := streamModel.Hash.Hex()
-		if !strings.HasPrefix(hash, comm.HASH_PRIFIX) || len(common.FromHex(hash)) != comm.HASH_ENABLE_LENGTH {
-			log.Error("allow err")
-		} else {
-			comm.ReqChan <- &comm.RequestModel{Hash: hash, ReqType: comm.REQ_HASH_ENABLE}
-		}
-		break
-	case comm.GRPC_HASH_DISABLE_REQ: //禁用
-		hash := streamModel.Hash.Hex()
-		if !strings.HasPrefix(hash, comm.HASH_PRIFIX) || len(common.FromHex(hash)) != comm.HASH_ENABLE_LENGTH {
-			log.Error("disallow err")
-		} else {
-			comm.ReqChan <- &comm.RequestModel{Hash: hash, ReqType: comm.REQ_HASH_DISABLE}
-		}
-		break
-	case comm.GRPC_WITHDRAW_REQ:
-		hash := streamModel.Hash.Hex()
-		wdHash := streamModel.WdHash.Hex()
-		recAddress := streamModel.To
-		amount := streamModel.Amount.String()
-		fee := streamModel.Fee.String()
-		category := streamModel.Category.Int64()
-
-		comm.ReqChan <- &comm.RequestModel{Hash: hash, ReqType: comm.REQ_OUT_APPROVE, WdHash: wdHash, RecAddress: recAddress, Amount: amount, Fee: fee, Category: category}
-		break
-	default:
+	handler, ok := streamHandlers[streamModel.Type]
+	if !ok {
 		log.Info("no type,streamModel:\n", streamModel)
+		return nil
+	}
+	if err := handler(n, streamModel); err != nil {
+		log.Error("handle stream[%s] failed, not acked: %v", streamModel.Type, err)
+		return err
 	}
+	//确认消息本身不再确认
+	if streamModel.Seq > 0 && streamModel.Type != comm.GRPC_STREAM_ACK {
+		if err := send(n, &comm.GrpcStream{Type: comm.GRPC_STREAM_ACK, Seq: streamModel.Seq}); err != nil {
+			log.Error("ack stream[%d] failed: %v", streamModel.Seq, err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,73 @@
+package grpcserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boxproject/companion/config"
+)
+
+//生成自签名证书及私钥文件
+func writeCert(t *testing.T, dir, name string, notBefore, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestCheckCredential(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	validCert, validKey := writeCert(t, dir, "valid", now.Add(-time.Hour), now.Add(time.Hour))
+	expiredCert, expiredKey := writeCert(t, dir, "expired", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	otherCert, _ := writeCert(t, dir, "other", now.Add(-time.Hour), now.Add(time.Hour))
+
+	tests := []struct {
+		name      string
+		cert, key string
+		ok        bool
+	}{
+		{"valid", validCert, validKey, true},
+		{"expired", expiredCert, expiredKey, false},
+		{"key mismatch", otherCert, validKey, false},
+		{"missing file", filepath.Join(dir, "none.crt"), validKey, false},
+	}
+	for _, test := range tests {
+		err := CheckCredential(&config.Config{ClientCert: test.cert, ClientKey: test.key})
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
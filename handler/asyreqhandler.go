@@ -1,61 +1,125 @@
 package handler
 
 import (
+	"context"
 	"math/big"
-	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/boxproject/companion/comm"
 	"github.com/boxproject/companion/config"
 	"github.com/boxproject/companion/contract"
 	"github.com/boxproject/companion/db"
+	"github.com/boxproject/companion/ethcli"
+	"github.com/boxproject/companion/metrics"
 	"github.com/boxproject/companion/util"
 	logger "github.com/alecthomas/log4go"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	NONCE_MAX_RETRY   = 3                //nonce冲突最大重试次数
+	TX_MAX_RETRY      = 3                //交易发送、丢弃最大重试次数
+	TX_TRACK_INTERVAL = 10 * time.Second //交易回执检查间隔
 )
 
 //异步处理
 type PriAsyEthHandler struct {
+	paused      int32         //暂停发送，请求照常落地
+	wake        chan struct{} //恢复发送时立即处理队列
+	cfgLock     sync.RWMutex  //ethCfg可热加载
 	ethCfg      config.EthCfg
-	quitChannel chan int
-	client      *ethclient.Client
+	client      *ethcli.Client
 	sinkAddress common.Address
 	ldb         *db.Ldb
+	nonceMgr    *NonceManager
+	txQueue     *TxQueue
+	signer      Signer
+}
+
+func NewPriAsyEthHandler(cfg *config.Config, db *db.Ldb, signer Signer, client *ethcli.Client) *PriAsyEthHandler {
+	return &PriAsyEthHandler{wake: make(chan struct{}, 1), ethCfg: cfg.PriEthCfg, client: client, sinkAddress: common.HexToAddress(cfg.SinkAddress), ldb: db, txQueue: NewTxQueue(db), signer: signer, nonceMgr: NewNonceManager(signer.Address(), client, db)}
+}
+
+//热加载gas及确认区块数
+func (this *PriAsyEthHandler) Reload(cfg config.EthCfg) {
+	this.cfgLock.Lock()
+	defer this.cfgLock.Unlock()
+	this.ethCfg.GasLimit = cfg.GasLimit
+	this.ethCfg.GasPrice = cfg.GasPrice
+	this.ethCfg.CheckBlockBefore = cfg.CheckBlockBefore
 }
 
-func NewPriAsyEthHandler(cfg *config.Config, db *db.Ldb) *PriAsyEthHandler {
-	return &PriAsyEthHandler{ethCfg: cfg.PriEthCfg, sinkAddress: common.HexToAddress(cfg.SinkAddress), ldb: db,quitChannel:make(chan int,1)}
+func (this *PriAsyEthHandler) config() config.EthCfg {
+	this.cfgLock.RLock()
+	defer this.cfgLock.RUnlock()
+	return this.ethCfg
 }
 
-//上私链操作
-func (this *PriAsyEthHandler) Start() {
+//暂停发送交易，已发送交易继续跟踪回执
+func (this *PriAsyEthHandler) Pause() {
+	if atomic.CompareAndSwapInt32(&this.paused, 0, 1) {
+		logger.Warn("PriAsyEthHandler paused")
+	}
+}
+
+func (this *PriAsyEthHandler) Resume() {
+	if atomic.CompareAndSwapInt32(&this.paused, 1, 0) {
+		logger.Info("PriAsyEthHandler resumed")
+		select {
+		case this.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (this *PriAsyEthHandler) Paused() bool {
+	return atomic.LoadInt32(&this.paused) == 1
+}
+
+//上私链操作，ctx取消后将ReqChan中剩余请求落地后返回
+func (this *PriAsyEthHandler) Run(ctx context.Context) error {
 	logger.Info("PriAsyEthHandler start...")
-	priClient, err := ethclient.Dial(this.ethCfg.GethAPI) //断线重连待处理
-	if err != nil {
-		logger.Error("Dial to the geth node failed. cause: %s", err)
-		return
+	if err := this.txQueue.InitMetrics(); err != nil {
+		logger.Error("init tx metrics failed. cause: %s", err)
+		return err
 	}
-	this.client = priClient
-	loop := true
-	for loop {
+	reconnected := this.client.Reconnected()
+	if err := this.nonceMgr.Sync(ctx); err != nil {
+		logger.Error("nonce sync failed. cause: %s", err)
+		return err
+	}
+	//启动时处理未完成交易
+	this.track()
+
+	trackTicker := time.NewTicker(TX_TRACK_INTERVAL)
+	defer trackTicker.Stop()
+	for {
 		select {
-		case <-this.quitChannel:
-			logger.Info("PriEthHandler::SendMessage thread exitCh!")
-			loop = false
+		case <-ctx.Done():
+			this.drain()
+			logger.Info("PriAsyEthHandler closed")
+			return nil
+		case <-reconnected:
+			//重连后与链上nonce重新同步
+			reconnected = this.client.Reconnected()
+			if err := this.nonceMgr.Sync(ctx); err != nil {
+				logger.Error("nonce sync failed. cause: %s", err)
+				return err
+			}
+			this.track()
+		case <-trackTicker.C:
+			this.track()
+		case <-this.wake:
+			this.track()
 		case data, ok := <-comm.ReqChan:
 			if ok {
-				switch data.ReqType {
-				case comm.REQ_HASH_ADD:
-					this.addHash(data)
-				case comm.REQ_HASH_ENABLE:
-					this.enableHash(data)
-				case comm.REQ_HASH_DISABLE:
-					this.disableHash(data)
-				case comm.REQ_OUT_APPROVE:
-					this.approve(data)
-				default:
-					logger.Info("unknow asy req: %s", data.ReqType)
+				if rec, isNew := this.enqueue(data); isNew {
+					this.send(rec)
 				}
 			} else {
 				logger.Error("PriAsyEthHandler read from channel failed")
@@ -64,14 +128,37 @@ func (this *PriAsyEthHandler) Start() {
 	}
 }
 
-//关闭私链操作处理
-func (this *PriAsyEthHandler) Close() {
-	close(this.quitChannel)
-	logger.Info("PriAsyEthHandler closed")
+//请求转入发送队列
+func (this *PriAsyEthHandler) enqueue(req *comm.RequestModel) (*TxRecord, bool) {
+	//发送前落地
+	rec, isNew, err := this.txQueue.Enqueue(req)
+	if err != nil {
+		logger.Error("land request to db failed: %s", err)
+		return nil, false
+	}
+	if err = comm.AckReq(req); err != nil {
+		logger.Error("ack request failed: %s", err)
+	}
+	return rec, isNew
+}
+
+//退出前将未处理请求转入发送队列，下次启动时发送
+func (this *PriAsyEthHandler) drain() {
+	for {
+		select {
+		case data, ok := <-comm.ReqChan:
+			if !ok {
+				return
+			}
+			this.enqueue(data)
+		default:
+			return
+		}
+	}
 }
 
 //hash上链
-func (this *PriAsyEthHandler) addHash(req *comm.RequestModel) error {
+func (this *PriAsyEthHandler) addHash(req *comm.RequestModel) (*types.Transaction, error) {
 	logger.Info("PriAsyEthHandler addHash....")
 
 	//if err := this.ldb.PutStrWithPrifix(comm.HASH_ADD_CONTENT_PREFIX, req.Hash, req.Content); err != nil { //content 内容存入db，供私链申请同意后查询使用
@@ -79,135 +166,77 @@ func (this *PriAsyEthHandler) addHash(req *comm.RequestModel) error {
 	//	return err
 	//}
 
-	opts, err := this.createTransactor(this.ethCfg.CreatorKeystorePath, this.ethCfg.CreatorPassphrase)
-	if err != nil {
-		logger.Error("Create options failed: %s", err)
-		return err
-	}
-
-	nonce, err := util.ReadNumberFromFile(this.ethCfg.NonceFilePath) //nonce file
-	if err != nil {
-		logger.Error("read block info err :%s", err)
-		return err
-	}
-
-	opts.Nonce = nonce
-	logger.Debug("current nonce :%d", nonce.Int64())
-
 	sink, err := contract.NewSink(this.sinkAddress, this.client)
 	if err != nil {
 		logger.Error("NewSink error: %s", err)
-		return err
+		return nil, err
 	}
 	hash32 := util.Byte2Byte32(common.FromHex(req.Hash))
-	if tx, err := sink.AddHash(opts, hash32); err != nil {
+	tx, err := this.transact(func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return sink.AddHash(opts, hash32)
+	})
+	if err != nil {
 		logger.Error("add hash err: %s", err)
-		return err
-	} else {
-		logger.Info("PriAsyEthHandler addHash tx: %s", tx.Hash().Hex())
-		nonce = nonce.Add(nonce, big.NewInt(comm.NONCE_PLUS))
-		util.WriteNumberToFile(this.ethCfg.NonceFilePath, nonce)
+		return nil, err
 	}
-	return nil
+	logger.Info("PriAsyEthHandler addHash tx: %s", tx.Hash().Hex())
+	return tx, nil
 }
 
 //hash 确认
-func (this *PriAsyEthHandler) enableHash(req *comm.RequestModel) error {
+func (this *PriAsyEthHandler) enableHash(req *comm.RequestModel) (*types.Transaction, error) {
 	logger.Debug("PriAsyEthHandler enableHash....")
-	opts, err := this.createTransactor(this.ethCfg.CreatorKeystorePath, this.ethCfg.CreatorPassphrase)
-	if err != nil {
-		logger.Info("Create options failed: %s", err)
-		return err
-	}
-
-	nonce, err := util.ReadNumberFromFile(this.ethCfg.NonceFilePath) //nonce file
-	if err != nil {
-		logger.Error("read block info err :%s", err)
-		return err
-	}
-
-	opts.Nonce = nonce
-	logger.Debug("current nonce :%d", nonce.Int64())
-
 	sink, err := contract.NewSink(this.sinkAddress, this.client)
 	if err != nil {
 		logger.Info("NewSink error: %s", err)
+		return nil, err
 	}
 	hash32 := util.Byte2Byte32(common.FromHex(req.Hash))
-	if tx, err := sink.Enable(opts, hash32); err != nil {
-		logger.Info("enable hash err: %s",err)
-		return err
-	} else {
-		logger.Info("PriAsyEthHandler enableHash: %s", tx.Hash().Hex())
-		nonce = nonce.Add(nonce, big.NewInt(comm.NONCE_PLUS))
-		util.WriteNumberToFile(this.ethCfg.NonceFilePath, nonce)
+	tx, err := this.transact(func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return sink.Enable(opts, hash32)
+	})
+	if err != nil {
+		logger.Info("enable hash err: %s", err)
+		return nil, err
 	}
-
-	return nil
+	logger.Info("PriAsyEthHandler enableHash: %s", tx.Hash().Hex())
+	return tx, nil
 }
 
 //hash 禁用
-func (this *PriAsyEthHandler) disableHash(req *comm.RequestModel) error {
+func (this *PriAsyEthHandler) disableHash(req *comm.RequestModel) (*types.Transaction, error) {
 	logger.Info("PriAsyEthHandler disableHash....")
-	opts, err := this.createTransactor(this.ethCfg.CreatorKeystorePath, this.ethCfg.CreatorPassphrase)
-	if err != nil {
-		logger.Info("Create options failed: %s", err)
-		return err
-	}
-
-	nonce, err := util.ReadNumberFromFile(this.ethCfg.NonceFilePath) //nonce file
-	if err != nil {
-		logger.Error("read block info err :%s", err)
-		return err
-	}
-
-	opts.Nonce = nonce
-	logger.Debug("current nonce :%d", nonce.Int64())
-
 	sink, err := contract.NewSink(this.sinkAddress, this.client)
 	if err != nil {
 		logger.Info("NewSink error: %s", err)
+		return nil, err
 	}
 
 	hash32 := util.Byte2Byte32(common.FromHex(req.Hash))
-	if tx, err := sink.Disable(opts, hash32); err != nil {
-		logger.Info("disable hash err: %s",err)
-		return err
-	} else {
-		logger.Info("Transaction disableHash: %s\n", tx.Hash().Hex())
-		nonce = nonce.Add(nonce, big.NewInt(comm.NONCE_PLUS))
-		util.WriteNumberToFile(this.ethCfg.NonceFilePath, nonce)
+	tx, err := this.transact(func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return sink.Disable(opts, hash32)
+	})
+	if err != nil {
+		logger.Info("disable hash err: %s", err)
+		return nil, err
 	}
-	return nil
+	logger.Info("Transaction disableHash: %s\n", tx.Hash().Hex())
+	return tx, nil
 }
 
 //out apply
-func (this *PriAsyEthHandler) approve(req *comm.RequestModel) error {
+func (this *PriAsyEthHandler) approve(req *comm.RequestModel) (*types.Transaction, error) {
 	logger.Debug("PriAsyEthHandler approve....")
 
 	if err := this.ldb.PutStrWithPrifix(comm.APPROVE_RECADDR_PREFIX, req.WdHash, req.RecAddress); err != nil { //recaddress 内容存入db，供私链申请同意后查询使用
 		logger.Error("land to db failed: %s", err)
-		return err
-	}
-
-	opts, err := this.createTransactor(this.ethCfg.CreatorKeystorePath, this.ethCfg.CreatorPassphrase)
-	if err != nil {
-		logger.Info("Create options failed: %s", err)
-		return err
-	}
-
-	nonce, err := util.ReadNumberFromFile(this.ethCfg.NonceFilePath) //nonce file
-	if err != nil {
-		logger.Error("read block info err :%s", err)
-		return err
+		return nil, err
 	}
 
-	opts.Nonce = nonce
-	logger.Debug("current nonce :%d", nonce.Int64())
-
 	sink, err := contract.NewSink(this.sinkAddress, this.client)
 	if err != nil {
 		logger.Info("NewSink error: %s", err)
+		return nil, err
 	}
 
 	hash32 := util.Byte2Byte32(common.FromHex(req.Hash))
@@ -222,37 +251,210 @@ func (this *PriAsyEthHandler) approve(req *comm.RequestModel) error {
 	recAddress, err := util.GetRecAddress(*req)
 	if err != nil {
 		logger.Error("getRecAddress err:", err)
-		return err
+		return nil, err
 	}
 
 	logger.Debug("recAddress...", recAddress.Hex())
-	if tx, err := sink.Approve(opts, wdHash32, amount, fee, recAddress, hash32, category); err != nil {
+	tx, err := this.transact(func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return sink.Approve(opts, wdHash32, amount, fee, recAddress, hash32, category)
+	})
+	if err != nil {
 		logger.Error("approve tx err: %s", err)
-		return err
+		return nil, err
+	}
+	logger.Info("Transaction hash: %s\n", tx.Hash().Hex())
+	return tx, nil
+}
+
+//发送队列中的请求，暂停时保留在队列中
+func (this *PriAsyEthHandler) send(rec *TxRecord) {
+	if this.Paused() {
+		if rec.Status != comm.TX_STATUS_QUEUED {
+			rec.Status = comm.TX_STATUS_QUEUED
+			this.saveRecord(rec)
+		}
+		return
+	}
+	var tx *types.Transaction
+	var err error
+	switch rec.Req.ReqType {
+	case comm.REQ_HASH_ADD:
+		tx, err = this.addHash(rec.Req)
+	case comm.REQ_HASH_ENABLE:
+		tx, err = this.enableHash(rec.Req)
+	case comm.REQ_HASH_DISABLE:
+		tx, err = this.disableHash(rec.Req)
+	case comm.REQ_OUT_APPROVE:
+		tx, err = this.approve(rec.Req)
+	default:
+		logger.Info("unknow asy req: %s", rec.Req.ReqType)
+		rec.Status = comm.TX_STATUS_FAILED
+		rec.Err = "unknow req type"
+		this.saveRecord(rec)
+		return
+	}
+
+	if err != nil {
+		metrics.TxFailed.Inc()
+		rec.Retries++
+		rec.Err = err.Error()
+		if rec.Retries >= TX_MAX_RETRY {
+			logger.Error("tx[%s] send failed %d times, mark failed", rec.Id, rec.Retries)
+			rec.Status = comm.TX_STATUS_FAILED
+		} else {
+			rec.Status = comm.TX_STATUS_QUEUED
+		}
 	} else {
-		logger.Info("Transaction hash: %s\n", tx.Hash().Hex())
-		nonce = nonce.Add(nonce, big.NewInt(comm.NONCE_PLUS))
-		util.WriteNumberToFile(this.ethCfg.NonceFilePath, nonce)
+		metrics.TxSent.Inc()
+		rec.Status = comm.TX_STATUS_SENT
+		rec.TxHash = tx.Hash().Hex()
+		rec.Nonce = tx.Nonce()
+		rec.SeenBlock = 0
+		rec.Err = ""
 	}
+	this.saveRecord(rec)
+}
 
-	return nil
+//跟踪已发送交易回执
+func (this *PriAsyEthHandler) track() {
+	records, err := this.txQueue.List(comm.TX_STATUS_QUEUED, comm.TX_STATUS_SENT)
+	if err != nil {
+		logger.Error("load tx queue failed: %s", err)
+		return
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	head, err := this.client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		logger.Error("get head failed: %s", err)
+		return
+	}
+
+	for _, rec := range records {
+		if rec.Status == comm.TX_STATUS_QUEUED {
+			//未发送成功或发送前中断
+			this.send(rec)
+			continue
+		}
+
+		txHash := common.HexToHash(rec.TxHash)
+		receipt, err := this.client.TransactionReceipt(context.Background(), txHash)
+		if err == ethereum.NotFound {
+			if _, _, err = this.client.TransactionByHash(context.Background(), txHash); err == ethereum.NotFound {
+				//交易已丢弃，归还nonce重发
+				logger.Warn("tx[%s] %s dropped, resend", rec.Id, rec.TxHash)
+				if err = this.nonceMgr.Release(new(big.Int).SetUint64(rec.Nonce)); err != nil {
+					logger.Error("release nonce[%d] failed: %s", rec.Nonce, err)
+				}
+				this.retry(rec, "dropped")
+			} else if err != nil {
+				logger.Error("get tx[%s] failed: %s", rec.TxHash, err)
+			}
+			continue
+		} else if err != nil {
+			logger.Error("get receipt[%s] failed: %s", rec.TxHash, err)
+			continue
+		}
+
+		if receipt.Status == types.ReceiptStatusFailed {
+			//交易回滚，重发结果相同，标记失败
+			logger.Error("tx[%s] %s reverted, mark failed", rec.Id, rec.TxHash)
+			this.nonceMgr.Confirm(new(big.Int).SetUint64(rec.Nonce))
+			metrics.TxFailed.Inc()
+			rec.Status = comm.TX_STATUS_FAILED
+			rec.Err = "reverted"
+			this.saveRecord(rec)
+			continue
+		}
+
+		//确认数从交易所在区块起算，分叉后回执区块可能变化
+		if block := receipt.BlockNumber.Uint64(); rec.SeenBlock != block {
+			rec.SeenBlock = block
+			this.saveRecord(rec)
+		}
+		if head.Number.Uint64() >= rec.SeenBlock+uint64(this.config().CheckBlockBefore) {
+			logger.Info("tx[%s] %s confirmed", rec.Id, rec.TxHash)
+			this.nonceMgr.Confirm(new(big.Int).SetUint64(rec.Nonce))
+			rec.Status = comm.TX_STATUS_CONFIRMED
+			this.saveRecord(rec)
+		}
+	}
+}
+
+//发送队列中的交易，statuses为空时返回全部
+func (this *PriAsyEthHandler) Txs(statuses ...string) ([]*TxRecord, error) {
+	return this.txQueue.List(statuses...)
 }
 
-func (this *PriAsyEthHandler) createTransactor(filePath, passphrase string) (*bind.TransactOpts, error) {
-	keyFile, err := openKey(filePath)
+//失败记录重新发送
+func (this *PriAsyEthHandler) Retry(id string) (*TxRecord, error) {
+	rec, err := this.txQueue.Retry(id)
 	if err != nil {
 		return nil, err
 	}
-	defer keyFile.Close()
-	if transactor, err := bind.NewTransactor(keyFile, passphrase); err != nil {
-		return nil, err
-	} else {
-		transactor.GasLimit = uint64(this.ethCfg.GasLimit)
-		//transactor.GasPrice = big.NewInt(this.ethCfg.GasPrice)
-		return transactor, nil
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+	return rec, nil
+}
+
+//重发，超过次数标记失败
+func (this *PriAsyEthHandler) retry(rec *TxRecord, reason string) {
+	rec.Retries++
+	rec.Err = reason
+	if rec.Retries >= TX_MAX_RETRY {
+		logger.Error("tx[%s] %s, mark failed", rec.Id, reason)
+		rec.Status = comm.TX_STATUS_FAILED
+		this.saveRecord(rec)
+		return
+	}
+	this.send(rec)
+}
+
+func (this *PriAsyEthHandler) saveRecord(rec *TxRecord) {
+	if err := this.txQueue.Save(rec); err != nil {
+		logger.Error("land tx record[%s] to db failed: %s", rec.Id, err)
 	}
 }
 
-func openKey(filePath string) (*os.File, error) {
-	return os.OpenFile(filePath, os.O_RDONLY, 0600)
+//分配nonce并发送交易，nonce冲突时换新nonce重试
+func (this *PriAsyEthHandler) transact(send func(opts *bind.TransactOpts) (*types.Transaction, error)) (*types.Transaction, error) {
+	var sendErr error
+	for i := 0; i < NONCE_MAX_RETRY; i++ {
+		opts := this.createTransactor()
+		nonce, err := this.nonceMgr.Next()
+		if err != nil {
+			logger.Error("get nonce err :%s", err)
+			return nil, err
+		}
+		opts.Nonce = nonce
+		logger.Debug("current nonce :%d", nonce.Int64())
+
+		tx, err := send(opts)
+		if err == nil {
+			if err = this.nonceMgr.Commit(nonce, tx.Hash()); err != nil {
+				logger.Error("commit nonce[%d] failed: %s", nonce.Int64(), err)
+			}
+			return tx, nil
+		}
+		sendErr = err
+		if !this.nonceMgr.HandleError(nonce, err) {
+			break
+		}
+	}
+	return nil, sendErr
+}
+
+func (this *PriAsyEthHandler) createTransactor() *bind.TransactOpts {
+	transactor := NewTransactOpts(this.signer)
+	ethCfg := this.config()
+	transactor.GasLimit = uint64(ethCfg.GasLimit)
+	//未配置时由节点建议
+	if ethCfg.GasPrice > 0 {
+		transactor.GasPrice = big.NewInt(ethCfg.GasPrice)
+	}
+	return transactor
 }
@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/db"
+	"github.com/boxproject/companion/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//nonce 链上查询接口，ethclient.Client 及 backends.SimulatedBackend 均已实现
+type NonceBackend interface {
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+}
+
+//nonce管理，数据存于leveldb
+//nn_ACCOUNT 记录下一个待分配的nonce
+//ng_ACCOUNT_NONCE 记录发送失败而空出的nonce，分配时优先复用
+//np_ACCOUNT_NONCE 记录已发送、尚未上链的交易hash
+type NonceManager struct {
+	lock    sync.Mutex
+	account common.Address
+	backend NonceBackend
+	ldb     *db.Ldb
+}
+
+func NewNonceManager(account common.Address, backend NonceBackend, ldb *db.Ldb) *NonceManager {
+	return &NonceManager{account: account, backend: backend, ldb: ldb}
+}
+
+//与链上nonce同步：清理已上链记录，对齐next，补齐空洞
+func (this *NonceManager) Sync(ctx context.Context) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	confirmed, err := this.backend.NonceAt(ctx, this.account, nil)
+	if err != nil {
+		logger.Error("get nonce err: %v", err)
+		return err
+	}
+	pending, err := this.backend.PendingNonceAt(ctx, this.account)
+	if err != nil {
+		logger.Error("get pending nonce err: %v", err)
+		return err
+	}
+
+	next, err := this.loadNext()
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	//已上链的pending记录
+	pendings, err := this.loadNonces(comm.NONCE_PENDING_PREFIX)
+	if err != nil {
+		return err
+	}
+	for nonce := range pendings {
+		if nonce < confirmed {
+			batch.Delete(this.key(comm.NONCE_PENDING_PREFIX, nonce))
+			delete(pendings, nonce)
+		}
+	}
+	//交易池中已有交易占用的空洞
+	gaps, err := this.loadNonces(comm.NONCE_GAP_PREFIX)
+	if err != nil {
+		return err
+	}
+	for nonce := range gaps {
+		if nonce < pending {
+			batch.Delete(this.key(comm.NONCE_GAP_PREFIX, nonce))
+		}
+	}
+
+	if next < pending {
+		//其他途径发送过交易或首次启动
+		next = pending
+	} else {
+		//[pending, next) 区间内不在交易池中的nonce视为空洞，等待补齐
+		for nonce := pending; nonce < next; nonce++ {
+			if _, ok := pendings[nonce]; ok && nonce != pending {
+				continue
+			}
+			batch.Delete(this.key(comm.NONCE_PENDING_PREFIX, nonce))
+			batch.Put(this.key(comm.NONCE_GAP_PREFIX, nonce), []byte{})
+		}
+	}
+	batch.Put(this.nextKey(), []byte(strconv.FormatUint(next, 10)))
+
+	if err = this.ldb.Write(batch, nil); err != nil {
+		logger.Error("nonce sync land to db failed: %v", err)
+		return err
+	}
+	this.setNextGauge(next)
+	logger.Info("nonce synced, account: %s, confirmed: %d, pending: %d, next: %d", this.account.Hex(), confirmed, pending, next)
+	return nil
+}
+
+//分配nonce，优先复用空洞
+func (this *NonceManager) Next() (*big.Int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	batch := new(leveldb.Batch)
+	if gap, ok, err := this.lowestGap(); err != nil {
+		return nil, err
+	} else if ok {
+		batch.Delete(this.key(comm.NONCE_GAP_PREFIX, gap))
+		if err = this.ldb.Write(batch, nil); err != nil {
+			return nil, err
+		}
+		logger.Debug("reuse gap nonce: %d", gap)
+		return new(big.Int).SetUint64(gap), nil
+	}
+
+	next, err := this.loadNext()
+	if err != nil {
+		return nil, err
+	}
+	batch.Put(this.nextKey(), []byte(strconv.FormatUint(next+comm.NONCE_PLUS, 10)))
+	if err = this.ldb.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	this.setNextGauge(next + comm.NONCE_PLUS)
+	return new(big.Int).SetUint64(next), nil
+}
+
+//当前待分配nonce
+func (this *NonceManager) Current() (uint64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.loadNext()
+}
+
+//交易发送成功，记录pending
+func (this *NonceManager) Commit(nonce *big.Int, txHash common.Hash) error {
+	return this.ldb.PutByte(this.key(comm.NONCE_PENDING_PREFIX, nonce.Uint64()), []byte(txHash.Hex()))
+}
+
+//交易已确认，删除pending
+func (this *NonceManager) Confirm(nonce *big.Int) error {
+	return this.ldb.DelKey(this.key(comm.NONCE_PENDING_PREFIX, nonce.Uint64()))
+}
+
+//交易发送失败，归还nonce
+func (this *NonceManager) Release(nonce *big.Int) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	n := nonce.Uint64()
+	next, err := this.loadNext()
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(this.key(comm.NONCE_PENDING_PREFIX, n))
+	if n+comm.NONCE_PLUS == next {
+		batch.Put(this.nextKey(), []byte(strconv.FormatUint(n, 10)))
+	} else if n < next {
+		batch.Put(this.key(comm.NONCE_GAP_PREFIX, n), []byte{})
+	}
+	if err = this.ldb.Write(batch, nil); err != nil {
+		return err
+	}
+	if n+comm.NONCE_PLUS == next {
+		this.setNextGauge(n)
+	}
+	return nil
+}
+
+//发送错误处理，返回true表示可换新nonce重试
+func (this *NonceManager) HandleError(nonce *big.Int, sendErr error) bool {
+	msg := strings.ToLower(sendErr.Error())
+	switch {
+	case strings.Contains(msg, "nonce too low"):
+		//nonce已被占用，重新同步
+		logger.Warn("nonce[%d] too low, resync", nonce.Uint64())
+		if err := this.Sync(context.Background()); err != nil {
+			logger.Error("nonce resync failed: %v", err)
+			return false
+		}
+		return true
+	case strings.Contains(msg, "replacement transaction underpriced"),
+		strings.Contains(msg, "known transaction"),
+		strings.Contains(msg, "already known"):
+		//交易池中已有同nonce交易，跳过该nonce
+		logger.Warn("nonce[%d] occupied in txpool: %v", nonce.Uint64(), sendErr)
+		return true
+	default:
+		if err := this.Release(nonce); err != nil {
+			logger.Error("release nonce[%d] failed: %v", nonce.Uint64(), err)
+		}
+		return false
+	}
+}
+
+func (this *NonceManager) setNextGauge(next uint64) {
+	metrics.NonceNext.WithLabelValues(this.account.Hex()).Set(float64(next))
+}
+
+func (this *NonceManager) nextKey() []byte {
+	return []byte(comm.NONCE_NEXT_PREFIX + this.account.Hex())
+}
+
+func (this *NonceManager) key(prefix string, nonce uint64) []byte {
+	return []byte(fmt.Sprintf("%s%s_%020d", prefix, this.account.Hex(), nonce))
+}
+
+func (this *NonceManager) loadNext() (uint64, error) {
+	data, err := this.ldb.GetByte(this.nextKey())
+	if err == leveldb.ErrNotFound {
+		return comm.DEF_NONCE, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(data), 10, 64)
+}
+
+func (this *NonceManager) loadNonces(prefix string) (map[uint64]string, error) {
+	keyPrefix := prefix + this.account.Hex() + "_"
+	resMap, err := this.ldb.GetPrifix([]byte(keyPrefix))
+	if err != nil {
+		return nil, err
+	}
+	nonces := make(map[uint64]string, len(resMap))
+	for k, v := range resMap {
+		nonce, err := strconv.ParseUint(strings.TrimPrefix(k, keyPrefix), 10, 64)
+		if err != nil {
+			logger.Error("illegal nonce key: %s", k)
+			continue
+		}
+		nonces[nonce] = v
+	}
+	return nonces, nil
+}
+
+func (this *NonceManager) lowestGap() (uint64, bool, error) {
+	keyPrefix := comm.NONCE_GAP_PREFIX + this.account.Hex() + "_"
+	iter := this.ldb.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	defer iter.Release()
+	if !iter.Next() {
+		return 0, false, iter.Error()
+	}
+	nonce, err := strconv.ParseUint(strings.TrimPrefix(string(iter.Key()), keyPrefix), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return nonce, true, nil
+}
@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/db"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type nonceEnv struct {
+	key     *ecdsa.PrivateKey
+	account common.Address
+	sim     *backends.SimulatedBackend
+	ldb     *db.Ldb
+}
+
+func newNonceEnv(t *testing.T) *nonceEnv {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := crypto.PubkeyToAddress(key.PublicKey)
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{account: {Balance: big.NewInt(1e18)}}, 8000000)
+	ldb, err := db.InitDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ldb.Close()
+		sim.Close()
+	})
+	return &nonceEnv{key: key, account: account, sim: sim, ldb: ldb}
+}
+
+func (env *nonceEnv) manager() *NonceManager {
+	return NewNonceManager(env.account, env.sim, env.ldb)
+}
+
+//发送一笔指定nonce的转账
+func (env *nonceEnv) send(t *testing.T, nonce uint64) common.Hash {
+	tx := types.NewTransaction(nonce, common.Address{1}, big.NewInt(1), 21000, big.NewInt(1), nil)
+	signed, err := types.SignTx(tx, types.HomesteadSigner{}, env.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = env.sim.SendTransaction(context.Background(), signed); err != nil {
+		t.Fatal(err)
+	}
+	return signed.Hash()
+}
+
+func mustNext(t *testing.T, mgr *NonceManager, want uint64) *big.Int {
+	t.Helper()
+	nonce, err := mgr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce.Uint64() != want {
+		t.Fatalf("next nonce: got %d, want %d", nonce.Uint64(), want)
+	}
+	return nonce
+}
+
+func TestNonceNextRelease(t *testing.T) {
+	env := newNonceEnv(t)
+	mgr := env.manager()
+	if err := mgr.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mustNext(t, mgr, 0)
+	n1 := mustNext(t, mgr, 1)
+	n2 := mustNext(t, mgr, 2)
+
+	//中间的nonce归还后成为空洞，优先复用
+	if err := mgr.Release(n1); err != nil {
+		t.Fatal(err)
+	}
+	mustNext(t, mgr, 1)
+	mustNext(t, mgr, 3)
+
+	//空洞之后已分配的nonce归还后同样复用
+	if err := mgr.Release(n2); err != nil {
+		t.Fatal(err)
+	}
+	mustNext(t, mgr, 2)
+	mustNext(t, mgr, 4)
+
+	//最后分配的nonce归还时直接回退next
+	n5 := mustNext(t, mgr, 5)
+	if err := mgr.Release(n5); err != nil {
+		t.Fatal(err)
+	}
+	if cur, err := mgr.Current(); err != nil || cur != 5 {
+		t.Fatalf("current nonce: got %d, %v, want 5", cur, err)
+	}
+}
+
+func TestNonceResyncAfterRestart(t *testing.T) {
+	env := newNonceEnv(t)
+	mgr := env.manager()
+	if err := mgr.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	//0、1已发送并上链，2已分配但发送前进程退出
+	for i := uint64(0); i < 2; i++ {
+		nonce := mustNext(t, mgr, i)
+		if err := mgr.Commit(nonce, env.send(t, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustNext(t, mgr, 2)
+	env.sim.Commit()
+
+	restarted := env.manager()
+	if err := restarted.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pendings, err := restarted.loadNonces(comm.NONCE_PENDING_PREFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pendings) != 0 {
+		t.Fatalf("confirmed pending records not cleaned: %v", pendings)
+	}
+	mustNext(t, restarted, 2)
+	mustNext(t, restarted, 3)
+}
+
+func TestNonceResyncChainAhead(t *testing.T) {
+	env := newNonceEnv(t)
+	mgr := env.manager()
+	if err := mgr.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mustNext(t, mgr, 0)
+
+	//其他途径用该账户发送过交易
+	for i := uint64(0); i < 3; i++ {
+		env.send(t, i)
+	}
+	env.sim.Commit()
+
+	if err := mgr.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mustNext(t, mgr, 3)
+}
+
+func TestNonceHandleError(t *testing.T) {
+	env := newNonceEnv(t)
+	mgr := env.manager()
+	if err := mgr.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	//nonce too low：重新同步后可重试，新nonce从链上pending开始
+	n0 := mustNext(t, mgr, 0)
+	env.send(t, 0)
+	env.send(t, 1)
+	env.sim.Commit()
+	if !mgr.HandleError(n0, core.ErrNonceTooLow) {
+		t.Fatal("nonce too low should be retried")
+	}
+	mustNext(t, mgr, 2)
+
+	//replacement underpriced：交易池已占用，跳过该nonce，不归还
+	n3 := mustNext(t, mgr, 3)
+	if !mgr.HandleError(n3, core.ErrReplaceUnderpriced) {
+		t.Fatal("replacement underpriced should be retried")
+	}
+	mustNext(t, mgr, 4)
+
+	//其他错误：归还nonce，不重试
+	n5 := mustNext(t, mgr, 5)
+	if mgr.HandleError(n5, errors.New("insufficient funds for gas * price + value")) {
+		t.Fatal("unexpected retry")
+	}
+	mustNext(t, mgr, 5)
+}
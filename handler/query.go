@@ -0,0 +1,313 @@
+package handler
+
+import (
+	"errors"
+	"sort"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/db"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var ErrNotFound = errors.New("record not found")
+
+//私链log类型对应的审批流状态
+var flowLogStatus = map[string]string{
+	comm.GRPC_HASH_ADD_LOG:     comm.HASH_STATUS_APPLY,
+	comm.GRPC_HASH_ENABLE_LOG:  comm.HASH_STATUS_ENABLE,
+	comm.GRPC_HASH_DISABLE_LOG: comm.HASH_STATUS_DISABLE,
+}
+
+//上报及送达状态
+type StreamInfo struct {
+	Seq         uint64
+	Type        string
+	Status      string
+	BlockNumber uint64
+	Acked       bool //voucher是否已确认
+	Attempts    int  //已发送次数
+	CreateTime  int64
+	AckTime     int64
+}
+
+//审批流状态
+type FlowInfo struct {
+	Hash        string
+	Status      string        //最近一次私链log对应状态 HASH_STATUS_*
+	BlockNumber uint64        //最近一次私链log区块号
+	PubStatus   string        //公链状态，he_/hd_记录
+	Available   *bool         `json:",omitempty"` //链上是否生效，仅单条查询时返回
+	Txs         []*TxRecord   //本节点发出的私链交易
+	Streams     []*StreamInfo //上报记录
+}
+
+//提现状态
+type WithdrawInfo struct {
+	Hash        string
+	WdHash      string
+	Amount      string
+	Fee         string
+	Category    int64
+	RecAddress  string
+	Status      string        //私链log状态 HASH_STATUS_APPLY|HASH_STATUS_REVERTED
+	BlockNumber uint64        //私链log区块号
+	Exists      *bool         `json:",omitempty"` //链上是否生效，仅单条查询时返回
+	Txs         []*TxRecord   //本节点发出的私链交易
+	Streams     []*StreamInfo //上报记录
+}
+
+//只读查询，汇总 txq_、ob_/oba_、he_/hd_ 记录；单条查询经 txi_/obi_ 索引读取，并通过sink合约确认链上状态
+type Query struct {
+	ldb *db.Ldb
+	txq *TxQueue
+	syn *PriSynEthHandler
+}
+
+func NewQuery(ldb *db.Ldb, syn *PriSynEthHandler) *Query {
+	return &Query{ldb: ldb, txq: NewTxQueue(ldb), syn: syn}
+}
+
+//为旧版本的交易及上报记录建立查询索引，已建立时跳过
+func BuildQueryIndex(ldb *db.Ldb) error {
+	if has, err := ldb.Has([]byte(comm.QUERY_INDEX_KEY), nil); err != nil || has {
+		return err
+	}
+	if err := NewTxQueue(ldb).Reindex(); err != nil {
+		return err
+	}
+	if err := comm.IndexStreams(); err != nil {
+		return err
+	}
+	logger.Info("query index built")
+	return ldb.PutByte([]byte(comm.QUERY_INDEX_KEY), nil)
+}
+
+//审批流列表，按区块号排序，offset起最多返回limit条
+func (q *Query) Flows(offset, limit int) ([]*FlowInfo, error) {
+	records, err := q.txq.List()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := comm.ListStreams()
+	if err != nil {
+		return nil, err
+	}
+	flows, _ := collect(records, entries)
+	list := make([]*FlowInfo, 0, len(flows))
+	for _, f := range flows {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].BlockNumber != list[j].BlockNumber {
+			return list[i].BlockNumber < list[j].BlockNumber
+		}
+		return list[i].Hash < list[j].Hash
+	})
+	from, to := pageRange(len(list), offset, limit)
+	list = list[from:to]
+	for _, f := range list {
+		if err = q.pubStatus(f); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (q *Query) Flow(hash string) (*FlowInfo, error) {
+	hash = normHash(hash)
+	records, err := q.txq.ListOf(hash)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := comm.StreamsOf(common.HexToHash(hash))
+	if err != nil {
+		return nil, err
+	}
+	flows, _ := collect(records, entries)
+	f, ok := flows[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if err = q.pubStatus(f); err != nil {
+		return nil, err
+	}
+	if q.syn != nil {
+		if b, err := q.syn.HashAvailable(f.Hash); err != nil {
+			logger.Error("query hash[%s] available failed: %v", f.Hash, err)
+		} else {
+			f.Available = &b
+		}
+	}
+	return f, nil
+}
+
+//提现列表，按区块号排序，offset起最多返回limit条
+func (q *Query) Withdraws(offset, limit int) ([]*WithdrawInfo, error) {
+	records, err := q.txq.List()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := comm.ListStreams()
+	if err != nil {
+		return nil, err
+	}
+	_, withdraws := collect(records, entries)
+	list := make([]*WithdrawInfo, 0, len(withdraws))
+	for _, w := range withdraws {
+		list = append(list, w)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].BlockNumber != list[j].BlockNumber {
+			return list[i].BlockNumber < list[j].BlockNumber
+		}
+		return list[i].WdHash < list[j].WdHash
+	})
+	from, to := pageRange(len(list), offset, limit)
+	return list[from:to], nil
+}
+
+func (q *Query) Withdraw(wdHash string) (*WithdrawInfo, error) {
+	wdHash = normHash(wdHash)
+	records, err := q.txq.ListOf(wdHash)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := comm.StreamsOf(common.HexToHash(wdHash))
+	if err != nil {
+		return nil, err
+	}
+	_, withdraws := collect(records, entries)
+	w, ok := withdraws[wdHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if q.syn != nil && w.Hash != "" {
+		if b, err := q.syn.TxExists(w.Hash, w.WdHash); err != nil {
+			logger.Error("query withdraw[%s] exists failed: %v", w.WdHash, err)
+		} else {
+			w.Exists = &b
+		}
+	}
+	return w, nil
+}
+
+//offset、limit对应的下标区间，offset超出时为空
+func pageRange(total, offset, limit int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	if limit > total-offset {
+		limit = total - offset
+	}
+	return offset, offset + limit
+}
+
+//汇总交易记录(按创建时间排序)及上报记录(按序号排序)
+func collect(records []*TxRecord, entries []*comm.OutboxEntry) (map[string]*FlowInfo, map[string]*WithdrawInfo) {
+	flows := make(map[string]*FlowInfo)
+	withdraws := make(map[string]*WithdrawInfo)
+	flowOf := func(hash string) *FlowInfo {
+		f, ok := flows[hash]
+		if !ok {
+			f = &FlowInfo{Hash: hash, Txs: []*TxRecord{}, Streams: []*StreamInfo{}}
+			flows[hash] = f
+		}
+		return f
+	}
+	withdrawOf := func(wdHash string) *WithdrawInfo {
+		w, ok := withdraws[wdHash]
+		if !ok {
+			w = &WithdrawInfo{WdHash: wdHash, Txs: []*TxRecord{}, Streams: []*StreamInfo{}}
+			withdraws[wdHash] = w
+		}
+		return w
+	}
+
+	//本节点私链交易
+	for _, rec := range records {
+		req := rec.Req
+		if req == nil {
+			continue
+		}
+		switch req.ReqType {
+		case comm.REQ_HASH_ADD, comm.REQ_HASH_ENABLE, comm.REQ_HASH_DISABLE:
+			f := flowOf(normHash(req.Hash))
+			f.Txs = append(f.Txs, rec)
+		case comm.REQ_OUT_APPROVE:
+			w := withdrawOf(normHash(req.WdHash))
+			w.Hash = normHash(req.Hash)
+			w.Amount, w.Fee, w.Category, w.RecAddress = req.Amount, req.Fee, req.Category, req.RecAddress
+			w.Txs = append(w.Txs, rec)
+		}
+	}
+
+	//上报记录，后上报的状态覆盖之前的
+	for _, entry := range entries {
+		stream := entry.Stream
+		if stream == nil {
+			continue
+		}
+		info := &StreamInfo{
+			Seq:         entry.Seq,
+			Type:        stream.Type,
+			Status:      stream.Status,
+			BlockNumber: stream.BlockNumber,
+			Acked:       entry.AckTime > 0,
+			Attempts:    entry.Attempts,
+			CreateTime:  entry.CreateTime,
+			AckTime:     entry.AckTime,
+		}
+		if status, ok := flowLogStatus[stream.Type]; ok {
+			f := flowOf(stream.Hash.Hex())
+			if stream.Status == comm.HASH_STATUS_REVERTED {
+				status = comm.HASH_STATUS_REVERTED
+			}
+			f.Status, f.BlockNumber = status, stream.BlockNumber
+			f.Streams = append(f.Streams, info)
+		} else if stream.Type == comm.GRPC_WITHDRAW_LOG {
+			w := withdrawOf(stream.WdHash.Hex())
+			w.Hash = stream.Hash.Hex()
+			if stream.Amount != nil {
+				w.Amount = stream.Amount.String()
+			}
+			if stream.Fee != nil {
+				w.Fee = stream.Fee.String()
+			}
+			if stream.Category != nil {
+				w.Category = stream.Category.Int64()
+			}
+			if stream.To != "" {
+				w.RecAddress = stream.To
+			}
+			w.Status = comm.HASH_STATUS_APPLY
+			if stream.Status == comm.HASH_STATUS_REVERTED {
+				w.Status = comm.HASH_STATUS_REVERTED
+			}
+			w.BlockNumber = stream.BlockNumber
+			w.Streams = append(w.Streams, info)
+		}
+	}
+	return flows, withdraws
+}
+
+//公链启用、禁用记录
+func (q *Query) pubStatus(f *FlowInfo) error {
+	for _, s := range []struct {
+		prefix string
+		status string
+	}{{comm.HASH_ENABLE_PREFIX, comm.HASH_STATUS_ENABLE}, {comm.HASH_DISABLE_PREFIX, comm.HASH_STATUS_DISABLE}} {
+		if has, err := q.ldb.Has([]byte(s.prefix+f.Hash), nil); err != nil && err != leveldb.ErrNotFound {
+			return err
+		} else if has {
+			f.PubStatus = s.status
+		}
+	}
+	return nil
+}
+
+//统一hash格式，与上报记录中common.Hash.Hex()一致
+func normHash(hash string) string {
+	return common.HexToHash(hash).Hex()
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/db"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func newQueryDb(t *testing.T) *db.Ldb {
+	ldb, err := db.InitDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	comm.Ldb = ldb
+	t.Cleanup(func() { ldb.Close() })
+	return ldb
+}
+
+func mustEnqueue(t *testing.T, q *TxQueue, req *comm.RequestModel) {
+	t.Helper()
+	if _, _, err := q.Enqueue(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustPush(t *testing.T, stream *comm.GrpcStream) uint64 {
+	t.Helper()
+	seq, err := comm.PushStream(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seq
+}
+
+func TestQueryLookup(t *testing.T) {
+	ldb := newQueryDb(t)
+	query := NewQuery(ldb, nil)
+	hash, wdHash, other := common.Hash{0xab}, common.Hash{2}, common.Hash{3}
+
+	//请求中的hash大小写与上报记录不一致
+	mustEnqueue(t, query.txq, &comm.RequestModel{Hash: "0x" + strings.ToUpper(hash.Hex()[2:]), ReqType: comm.REQ_HASH_ADD})
+	mustEnqueue(t, query.txq, &comm.RequestModel{Hash: other.Hex(), ReqType: comm.REQ_HASH_ADD})
+	mustEnqueue(t, query.txq, &comm.RequestModel{Hash: hash.Hex(), WdHash: wdHash.Hex(), ReqType: comm.REQ_OUT_APPROVE, Amount: "5"})
+	addSeq := mustPush(t, &comm.GrpcStream{Type: comm.GRPC_HASH_ADD_LOG, Hash: hash, BlockNumber: 10})
+	mustPush(t, &comm.GrpcStream{Type: comm.GRPC_HASH_ENABLE_LOG, Hash: hash, BlockNumber: 12})
+	mustPush(t, &comm.GrpcStream{Type: comm.GRPC_HASH_ADD_LOG, Hash: other, BlockNumber: 11})
+	mustPush(t, &comm.GrpcStream{Type: comm.GRPC_WITHDRAW_LOG, Hash: hash, WdHash: wdHash, Amount: big.NewInt(5), BlockNumber: 13})
+	if err := comm.AckStream(addSeq, 1<<40); err != nil {
+		t.Fatal(err)
+	}
+	if err := ldb.PutByte([]byte(comm.HASH_ENABLE_PREFIX+hash.Hex()), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	flow, err := query.Flow(hash.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flow.Txs) != 1 || len(flow.Streams) != 2 || !flow.Streams[0].Acked || flow.Streams[1].Acked {
+		t.Fatalf("flow: txs %d, streams %+v", len(flow.Txs), flow.Streams)
+	}
+	if flow.Status != comm.HASH_STATUS_ENABLE || flow.BlockNumber != 12 || flow.PubStatus != comm.HASH_STATUS_ENABLE {
+		t.Fatalf("flow status: %+v", flow)
+	}
+
+	withdraw, err := query.Withdraw(wdHash.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withdraw.Txs) != 1 || len(withdraw.Streams) != 1 || withdraw.Hash != hash.Hex() || withdraw.Amount != "5" {
+		t.Fatalf("withdraw: %+v", withdraw)
+	}
+
+	if _, err = query.Flow(common.Hash{9}.Hex()); err != ErrNotFound {
+		t.Fatalf("got %v, want %v", err, ErrNotFound)
+	}
+	if _, err = query.Withdraw(hash.Hex()); err != ErrNotFound {
+		t.Fatalf("got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestQueryPage(t *testing.T) {
+	ldb := newQueryDb(t)
+	query := NewQuery(ldb, nil)
+	for i := 1; i <= 5; i++ {
+		mustPush(t, &comm.GrpcStream{Type: comm.GRPC_HASH_ADD_LOG, Hash: common.Hash{byte(i)}, BlockNumber: uint64(10 - i)})
+	}
+	tests := []struct {
+		offset, limit int
+		want          []uint64
+	}{
+		{0, 2, []uint64{5, 6}},
+		{3, 10, []uint64{8, 9}},
+		{5, 1, []uint64{}},
+		{9, 1, []uint64{}},
+	}
+	for _, test := range tests {
+		flows, err := query.Flows(test.offset, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]uint64, 0, len(flows))
+		for _, f := range flows {
+			got = append(got, f.BlockNumber)
+		}
+		if len(got) != len(test.want) {
+			t.Fatalf("offset %d, limit %d: got %v, want %v", test.offset, test.limit, got, test.want)
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Fatalf("offset %d, limit %d: got %v, want %v", test.offset, test.limit, got, test.want)
+			}
+		}
+	}
+}
+
+func TestBuildQueryIndex(t *testing.T) {
+	ldb := newQueryDb(t)
+	query := NewQuery(ldb, nil)
+	hash := common.Hash{1}
+	mustEnqueue(t, query.txq, &comm.RequestModel{Hash: hash.Hex(), ReqType: comm.REQ_HASH_ADD})
+	mustPush(t, &comm.GrpcStream{Type: comm.GRPC_HASH_ADD_LOG, Hash: hash})
+	//模拟旧版本无索引的记录
+	for _, prefix := range []string{comm.TX_INDEX_PREFIX, comm.OUTBOX_INDEX_PREFIX} {
+		resMap, err := ldb.GetPrifix([]byte(prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := range resMap {
+			ldb.DelKey([]byte(k))
+		}
+	}
+	if _, err := query.Flow(hash.Hex()); err != ErrNotFound {
+		t.Fatalf("got %v, want %v", err, ErrNotFound)
+	}
+
+	if err := BuildQueryIndex(ldb); err != nil {
+		t.Fatal(err)
+	}
+	flow, err := query.Flow(hash.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flow.Txs) != 1 || len(flow.Streams) != 1 {
+		t.Fatalf("flow: txs %d, streams %d", len(flow.Txs), len(flow.Streams))
+	}
+}
@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/config"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+//远程签名超时
+const REMOTE_SIGN_TIMEOUT = 30 * time.Second
+
+//检查签名可用时使用的固定hash
+var probeHash = crypto.Keccak256([]byte("companion signer probe"))
+
+var (
+	ErrSignerAddress  = errors.New("not authorized to sign this account")
+	ErrRemoteSignedTx = errors.New("remote signer returned a different transaction")
+	ErrSignerLocked   = errors.New("signer key not unlocked")
+	ErrRemoteAccount  = errors.New("account not listed by remote signer")
+)
+
+//交易签名
+type Signer interface {
+	Address() common.Address
+	SignTx(signer types.Signer, tx *types.Transaction) (*types.Transaction, error)
+	Ping(ctx context.Context) error //检查签名是否可用，供健康检查使用
+}
+
+//按配置创建签名者
+func NewSigner(cfg config.EthCfg) (Signer, error) {
+	switch cfg.SignerType {
+	case "", comm.SIGNER_KEYSTORE:
+		return NewKeystoreSigner(cfg.CreatorKeystorePath, cfg.CreatorPassphrase)
+	case comm.SIGNER_RAWKEY:
+		return NewRawKeySigner(cfg.SignerKeyPath)
+	case comm.SIGNER_REMOTE:
+		return NewRemoteSigner(cfg.SignerURL, common.HexToAddress(cfg.Creator))
+	default:
+		return nil, fmt.Errorf("unknow signer type: %s", cfg.SignerType)
+	}
+}
+
+//生成交易参数
+func NewTransactOpts(s Signer) *bind.TransactOpts {
+	return &bind.TransactOpts{
+		From: s.Address(),
+		Signer: func(signer types.Signer, address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if !bytes.Equal(address.Bytes(), s.Address().Bytes()) {
+				return nil, ErrSignerAddress
+			}
+			return s.SignTx(signer, tx)
+		},
+	}
+}
+
+//私钥签名
+type keySigner struct {
+	key     *ecdsa.PrivateKey
+	address common.Address
+}
+
+func (k *keySigner) Address() common.Address {
+	return k.address
+}
+
+func (k *keySigner) SignTx(signer types.Signer, tx *types.Transaction) (*types.Transaction, error) {
+	return types.SignTx(tx, signer, k.key)
+}
+
+//私钥仍在内存中且签名可还原出账户地址
+func (k *keySigner) Ping(context.Context) error {
+	if k.key == nil {
+		return ErrSignerLocked
+	}
+	sig, err := crypto.Sign(probeHash, k.key)
+	if err != nil {
+		return err
+	}
+	pub, err := crypto.SigToPub(probeHash, sig)
+	if err != nil {
+		return err
+	}
+	if crypto.PubkeyToAddress(*pub) != k.address {
+		return ErrSignerLocked
+	}
+	return nil
+}
+
+//keystore签名，启动时解锁一次，私钥常驻内存
+type KeystoreSigner struct {
+	keySigner
+}
+
+func NewKeystoreSigner(keystorePath, passphrase string) (*KeystoreSigner, error) {
+	keyJson, err := ioutil.ReadFile(keystorePath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keystore.DecryptKey(keyJson, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeystoreSignerFromKey(key), nil
+}
+
+//已解密的keystore私钥
+func NewKeystoreSignerFromKey(key *keystore.Key) *KeystoreSigner {
+	logger.Info("keystore signer unlocked: %s", key.Address.Hex())
+	return &KeystoreSigner{keySigner{key: key.PrivateKey, address: key.Address}}
+}
+
+//私钥文件签名（hex明文私钥），仅供测试使用
+type RawKeySigner struct {
+	keySigner
+}
+
+func NewRawKeySigner(keyPath string) (*RawKeySigner, error) {
+	key, err := crypto.LoadECDSA(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	logger.Warn("raw key signer loaded: %s, do not use in production", address.Hex())
+	return &RawKeySigner{keySigner{key: key, address: address}}, nil
+}
+
+//远程签名，兼容clef account_signTransaction 接口，私钥不进入companion
+type RemoteSigner struct {
+	client  *rpc.Client
+	address common.Address
+}
+
+//签名请求参数
+type remoteSignArgs struct {
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      hexutil.Uint64  `json:"gas"`
+	GasPrice hexutil.Big     `json:"gasPrice"`
+	Value    hexutil.Big     `json:"value"`
+	Nonce    hexutil.Uint64  `json:"nonce"`
+	Data     hexutil.Bytes   `json:"data"`
+}
+
+//签名结果
+type remoteSignResult struct {
+	Raw hexutil.Bytes `json:"raw"`
+}
+
+func NewRemoteSigner(url string, address common.Address) (*RemoteSigner, error) {
+	client, err := rpc.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewRemoteSignerWithClient(client, address), nil
+}
+
+func NewRemoteSignerWithClient(client *rpc.Client, address common.Address) *RemoteSigner {
+	return &RemoteSigner{client: client, address: address}
+}
+
+func (r *RemoteSigner) Address() common.Address {
+	return r.address
+}
+
+func (r *RemoteSigner) SignTx(_ types.Signer, tx *types.Transaction) (*types.Transaction, error) {
+	args := &remoteSignArgs{
+		From:     r.address,
+		Gas:      hexutil.Uint64(tx.Gas()),
+		GasPrice: hexutil.Big(*tx.GasPrice()),
+		Value:    hexutil.Big(*tx.Value()),
+		Nonce:    hexutil.Uint64(tx.Nonce()),
+		Data:     tx.Data(),
+		To:       tx.To(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), REMOTE_SIGN_TIMEOUT)
+	defer cancel()
+	var result remoteSignResult
+	if err := r.client.CallContext(ctx, &result, "account_signTransaction", args); err != nil {
+		return nil, err
+	}
+
+	signed := new(types.Transaction)
+	if err := rlp.DecodeBytes(result.Raw, signed); err != nil {
+		return nil, err
+	}
+	if err := r.verify(tx, signed); err != nil {
+		return nil, err
+	}
+	return signed, nil
+}
+
+//通过 account_list 检查clef可访问且管理该账户
+func (r *RemoteSigner) Ping(ctx context.Context) error {
+	var accounts []common.Address
+	if err := r.client.CallContext(ctx, &accounts, "account_list"); err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		if account == r.address {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v: %s", ErrRemoteAccount, r.address.Hex())
+}
+
+//校验远程签名交易内容及签名人
+func (r *RemoteSigner) verify(tx, signed *types.Transaction) error {
+	if tx.Nonce() != signed.Nonce() || tx.Gas() != signed.Gas() ||
+		tx.GasPrice().Cmp(signed.GasPrice()) != 0 || tx.Value().Cmp(signed.Value()) != 0 ||
+		!bytes.Equal(tx.Data(), signed.Data()) {
+		return ErrRemoteSignedTx
+	}
+	if (tx.To() == nil) != (signed.To() == nil) || (tx.To() != nil && *tx.To() != *signed.To()) {
+		return ErrRemoteSignedTx
+	}
+
+	var txSigner types.Signer = types.HomesteadSigner{}
+	if signed.Protected() {
+		txSigner = types.NewEIP155Signer(signed.ChainId())
+	}
+	from, err := types.Sender(txSigner, signed)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(from.Bytes(), r.address.Bytes()) {
+		return ErrSignerAddress
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/google/uuid"
+)
+
+var testChainSigner = types.NewEIP155Signer(big.NewInt(1))
+
+func testTx() *types.Transaction {
+	return types.NewTransaction(7, common.Address{0xaa}, big.NewInt(1), 100000, big.NewInt(2), []byte{1, 2, 3})
+}
+
+func mustKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+//签名后检查签名人
+func checkSigned(t *testing.T, s Signer) {
+	t.Helper()
+	signed, err := s.SignTx(testChainSigner, testTx())
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := types.Sender(testChainSigner, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != s.Address() {
+		t.Fatalf("sender: got %s, want %s", from.Hex(), s.Address().Hex())
+	}
+}
+
+func TestKeystoreSigner(t *testing.T) {
+	key := mustKey(t)
+	id, err := uuid.NewRandom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	keyJson, err := keystore.EncryptKey(&keystore.Key{Id: id[:], Address: address, PrivateKey: key}, "pass", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	if err = ioutil.WriteFile(path, keyJson, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewKeystoreSigner(path, "wrong"); err != keystore.ErrDecrypt {
+		t.Fatalf("wrong passphrase: got %v, want %v", err, keystore.ErrDecrypt)
+	}
+	s, err := NewKeystoreSigner(path, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Address() != address {
+		t.Fatalf("address: got %s, want %s", s.Address().Hex(), address.Hex())
+	}
+	checkSigned(t, s)
+}
+
+func TestRawKeySigner(t *testing.T) {
+	key := mustKey(t)
+	path := filepath.Join(t.TempDir(), "key.hex")
+	if err := crypto.SaveECDSA(path, key); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewRawKeySigner(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Address() != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Fatalf("address mismatch: %s", s.Address().Hex())
+	}
+	checkSigned(t, s)
+}
+
+func TestTransactOptsAddress(t *testing.T) {
+	s := &keySigner{key: mustKey(t)}
+	s.address = crypto.PubkeyToAddress(s.key.PublicKey)
+	opts := NewTransactOpts(s)
+	if _, err := opts.Signer(testChainSigner, common.Address{1}, testTx()); err != ErrSignerAddress {
+		t.Fatalf("got %v, want %v", err, ErrSignerAddress)
+	}
+	if _, err := opts.Signer(testChainSigner, s.address, testTx()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//模拟clef，按请求参数构造交易后签名，tamper用于篡改交易内容
+type mockClef struct {
+	key    *ecdsa.PrivateKey
+	tamper func(args *remoteSignArgs)
+}
+
+func (m *mockClef) SignTransaction(_ context.Context, args remoteSignArgs) (*remoteSignResult, error) {
+	if m.tamper != nil {
+		m.tamper(&args)
+	}
+	tx := types.NewTransaction(uint64(args.Nonce), *args.To, args.Value.ToInt(), uint64(args.Gas), args.GasPrice.ToInt(), args.Data)
+	signed, err := types.SignTx(tx, testChainSigner, m.key)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := rlp.EncodeToBytes(signed)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteSignResult{Raw: raw}, nil
+}
+
+func (m *mockClef) List() []common.Address {
+	return []common.Address{crypto.PubkeyToAddress(m.key.PublicKey)}
+}
+
+func newMockRemoteSigner(t *testing.T, clef *mockClef, address common.Address) *RemoteSigner {
+	server := rpc.NewServer()
+	if err := server.RegisterName("account", clef); err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.DialInProc(server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Stop()
+	})
+	return NewRemoteSignerWithClient(client, address)
+}
+
+func TestRemoteSigner(t *testing.T) {
+	key := mustKey(t)
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	s := newMockRemoteSigner(t, &mockClef{key: key}, address)
+	checkSigned(t, s)
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	//clef未管理该账户
+	if err := newMockRemoteSigner(t, &mockClef{key: mustKey(t)}, address).Ping(context.Background()); err == nil || !strings.Contains(err.Error(), ErrRemoteAccount.Error()) {
+		t.Fatalf("got %v, want %v", err, ErrRemoteAccount)
+	}
+}
+
+func TestKeySignerPing(t *testing.T) {
+	s := &keySigner{key: mustKey(t)}
+	s.address = crypto.PubkeyToAddress(s.key.PublicKey)
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&keySigner{key: s.key, address: common.Address{1}}).Ping(context.Background()); err != ErrSignerLocked {
+		t.Fatalf("got %v, want %v", err, ErrSignerLocked)
+	}
+	if err := (&keySigner{address: s.address}).Ping(context.Background()); err != ErrSignerLocked {
+		t.Fatalf("got %v, want %v", err, ErrSignerLocked)
+	}
+}
+
+func TestRemoteSignerVerify(t *testing.T) {
+	key := mustKey(t)
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	tests := []struct {
+		name string
+		clef *mockClef
+		want error
+	}{
+		{"other key", &mockClef{key: mustKey(t)}, ErrSignerAddress},
+		{"nonce", &mockClef{key: key, tamper: func(args *remoteSignArgs) { args.Nonce++ }}, ErrRemoteSignedTx},
+		{"gas", &mockClef{key: key, tamper: func(args *remoteSignArgs) { args.Gas++ }}, ErrRemoteSignedTx},
+		{"gas price", &mockClef{key: key, tamper: func(args *remoteSignArgs) { args.GasPrice.ToInt().SetInt64(100) }}, ErrRemoteSignedTx},
+		{"value", &mockClef{key: key, tamper: func(args *remoteSignArgs) { args.Value.ToInt().SetInt64(100) }}, ErrRemoteSignedTx},
+		{"data", &mockClef{key: key, tamper: func(args *remoteSignArgs) { args.Data = []byte{9} }}, ErrRemoteSignedTx},
+		{"to", &mockClef{key: key, tamper: func(args *remoteSignArgs) { args.To = &common.Address{0xbb} }}, ErrRemoteSignedTx},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newMockRemoteSigner(t, test.clef, address)
+			if _, err := s.SignTx(testChainSigner, testTx()); err != test.want {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,14 @@
 package handler
 
 import (
-
-
 	"github.com/boxproject/companion/comm"
 	"github.com/boxproject/companion/config"
 	"github.com/boxproject/companion/contract"
+	"github.com/boxproject/companion/ethcli"
 	"github.com/boxproject/companion/util"
 	logger "github.com/alecthomas/log4go"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 )
 
 var PriSynEth *PriSynEthHandler
@@ -18,18 +16,13 @@ var PriSynEth *PriSynEthHandler
 //同步处理
 type PriSynEthHandler struct {
 	ethCfg   config.EthCfg
-	client   *ethclient.Client
+	client   *ethcli.Client
 	sinkAddr common.Address
 }
 
-func InitPriSynEthHandler(sinkAddrStr string, cfg config.EthCfg) (*PriSynEthHandler, error) {
-	priClient, err := ethclient.Dial(cfg.GethAPI) //断线重连待处理
-	if err != nil {
-		logger.Error("Dial to the geth node failed. cause: %v", err)
-		return nil, err
-	}
+func InitPriSynEthHandler(sinkAddrStr string, cfg config.EthCfg, client *ethcli.Client) *PriSynEthHandler {
 	sinkAddr := common.HexToAddress(sinkAddrStr)
-	return &PriSynEthHandler{ethCfg: cfg, client: priClient, sinkAddr: sinkAddr}, nil
+	return &PriSynEthHandler{ethCfg: cfg, client: client, sinkAddr: sinkAddr}
 }
 
 //hash是否有效
@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/db"
+	"github.com/boxproject/companion/metrics"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var ErrNotFailed = errors.New("tx record is not failed")
+
+//交易记录
+type TxRecord struct {
+	Id         string
+	Req        *comm.RequestModel
+	Status     string
+	Nonce      uint64
+	TxHash     string
+	SeenBlock  uint64 //回执中交易所在区块高度，确认数由此计算
+	Retries    int
+	Err        string
+	CreateTime time.Time
+	UpdateTime time.Time
+}
+
+//是否处理中
+func (r *TxRecord) InFlight() bool {
+	return r.Status == comm.TX_STATUS_QUEUED || r.Status == comm.TX_STATUS_SENT
+}
+
+//发送队列，记录存于leveldb txq_ID
+type TxQueue struct {
+	ldb *db.Ldb
+}
+
+func NewTxQueue(ldb *db.Ldb) *TxQueue {
+	return &TxQueue{ldb: ldb}
+}
+
+//请求入队，发送前落地；同一请求已有记录时不重复入队，失败的记录只能通过Retry重新入队
+func (q *TxQueue) Enqueue(req *comm.RequestModel) (*TxRecord, bool, error) {
+	id := comm.ReqKey(req)
+	if rec, err := q.Get(id); err == nil {
+		logger.Info("tx queue duplicate request: %s, status: %s", id, rec.Status)
+		return rec, false, nil
+	} else if err != leveldb.ErrNotFound {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	rec := &TxRecord{Id: id, Req: req, Status: comm.TX_STATUS_QUEUED, CreateTime: now, UpdateTime: now}
+	//先写索引，记录落地失败时索引指向的记录不存在，查询时跳过
+	if key := txIndexKey(rec); key != nil {
+		if err := q.ldb.PutByte(key, nil); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := q.Save(rec); err != nil {
+		return nil, false, err
+	}
+	return rec, true, nil
+}
+
+//失败记录重新入队
+func (q *TxQueue) Retry(id string) (*TxRecord, error) {
+	rec, err := q.Get(id)
+	if err == leveldb.ErrNotFound {
+		return nil, fmt.Errorf("tx record not found: %s", id)
+	} else if err != nil {
+		return nil, err
+	}
+	if rec.Status != comm.TX_STATUS_FAILED {
+		return nil, fmt.Errorf("%v: %s", ErrNotFailed, id)
+	}
+	logger.Warn("tx[%s] retry, last err: %s", id, rec.Err)
+	rec.Status = comm.TX_STATUS_QUEUED
+	rec.Retries = 0
+	rec.Err = ""
+	if err = q.Save(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (q *TxQueue) Save(rec *TxRecord) error {
+	rec.UpdateTime = time.Now()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	last := ""
+	if old, err := q.Get(rec.Id); err == nil {
+		last = old.Status
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	if err = q.ldb.PutByte([]byte(comm.TX_QUEUE_PREFIX+rec.Id), data); err != nil {
+		return err
+	}
+	trackPending(last, rec.Status)
+	return nil
+}
+
+//统计处理中的交易数，启动时设置，之后由Save随状态变化更新
+func (q *TxQueue) InitMetrics() error {
+	records, err := q.List(comm.TX_STATUS_QUEUED, comm.TX_STATUS_SENT)
+	if err != nil {
+		return err
+	}
+	counts := map[string]float64{comm.TX_STATUS_QUEUED: 0, comm.TX_STATUS_SENT: 0}
+	for _, rec := range records {
+		counts[rec.Status]++
+	}
+	for status, count := range counts {
+		metrics.TxPending.WithLabelValues(status).Set(count)
+	}
+	return nil
+}
+
+//处理中交易数随状态变化更新
+func trackPending(from, to string) {
+	if from == to {
+		return
+	}
+	if from == comm.TX_STATUS_QUEUED || from == comm.TX_STATUS_SENT {
+		metrics.TxPending.WithLabelValues(from).Dec()
+	}
+	if to == comm.TX_STATUS_QUEUED || to == comm.TX_STATUS_SENT {
+		metrics.TxPending.WithLabelValues(to).Inc()
+	}
+}
+
+func (q *TxQueue) Get(id string) (*TxRecord, error) {
+	data, err := q.ldb.GetByte([]byte(comm.TX_QUEUE_PREFIX + id))
+	if err != nil {
+		return nil, err
+	}
+	rec := &TxRecord{}
+	if err = json.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+//按状态查询，statuses为空时返回全部，按创建时间排序
+func (q *TxQueue) List(statuses ...string) ([]*TxRecord, error) {
+	resMap, err := q.ldb.GetPrifix([]byte(comm.TX_QUEUE_PREFIX))
+	if err != nil {
+		return nil, err
+	}
+	var records []*TxRecord
+	for k, v := range resMap {
+		rec := &TxRecord{}
+		if err := json.Unmarshal([]byte(v), rec); err != nil {
+			logger.Error("tx record[%s] unmarshal err: %v", k, err)
+			continue
+		}
+		if len(statuses) == 0 || containsStr(statuses, rec.Status) {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreateTime.Before(records[j].CreateTime)
+	})
+	return records, nil
+}
+
+//按hash（提现为wdHash）经索引查询交易记录，按创建时间排序
+func (q *TxQueue) ListOf(hash string) ([]*TxRecord, error) {
+	prefix := comm.TX_INDEX_PREFIX + normHash(hash) + "_"
+	resMap, err := q.ldb.GetPrifix([]byte(prefix))
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*TxRecord, 0, len(resMap))
+	for k := range resMap {
+		rec, err := q.Get(strings.TrimPrefix(k, prefix))
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreateTime.Before(records[j].CreateTime)
+	})
+	return records, nil
+}
+
+//为已有交易记录建立索引，旧版本升级时使用
+func (q *TxQueue) Reindex() error {
+	records, err := q.List()
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for _, rec := range records {
+		if key := txIndexKey(rec); key != nil {
+			batch.Put(key, nil)
+		}
+	}
+	return q.ldb.Write(batch, nil)
+}
+
+//交易记录索引：审批流请求按hash，提现申请按wdHash
+func txIndexKey(rec *TxRecord) []byte {
+	if rec.Req == nil {
+		return nil
+	}
+	switch rec.Req.ReqType {
+	case comm.REQ_HASH_ADD, comm.REQ_HASH_ENABLE, comm.REQ_HASH_DISABLE:
+		return []byte(comm.TX_INDEX_PREFIX + normHash(rec.Req.Hash) + "_" + rec.Id)
+	case comm.REQ_OUT_APPROVE:
+		return []byte(comm.TX_INDEX_PREFIX + normHash(rec.Req.WdHash) + "_" + rec.Id)
+	}
+	return nil
+}
+
+func containsStr(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
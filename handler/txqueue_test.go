@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func expectPending(t *testing.T, queued, sent float64) {
+	t.Helper()
+	q := testutil.ToFloat64(metrics.TxPending.WithLabelValues(comm.TX_STATUS_QUEUED))
+	s := testutil.ToFloat64(metrics.TxPending.WithLabelValues(comm.TX_STATUS_SENT))
+	if q != queued || s != sent {
+		t.Fatalf("tx pending: got %v/%v, want %v/%v", q, s, queued, sent)
+	}
+}
+
+func TestTxPendingMetrics(t *testing.T) {
+	q := NewTxQueue(newQueryDb(t))
+	rec, _, err := q.Enqueue(&comm.RequestModel{Hash: "0x01", ReqType: comm.REQ_HASH_ADD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustEnqueue(t, q, &comm.RequestModel{Hash: "0x02", ReqType: comm.REQ_HASH_ADD})
+	//重启时按db重新统计
+	if err = q.InitMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	expectPending(t, 2, 0)
+
+	//重复入队不计数
+	mustEnqueue(t, q, &comm.RequestModel{Hash: "0x01", ReqType: comm.REQ_HASH_ADD})
+	expectPending(t, 2, 0)
+
+	for _, step := range []struct {
+		status       string
+		queued, sent float64
+	}{
+		{comm.TX_STATUS_SENT, 1, 1},
+		{comm.TX_STATUS_SENT, 1, 1},
+		{comm.TX_STATUS_FAILED, 1, 0},
+	} {
+		rec.Status = step.status
+		if err = q.Save(rec); err != nil {
+			t.Fatal(err)
+		}
+		expectPending(t, step.queued, step.sent)
+	}
+	if _, err = q.Retry(rec.Id); err != nil {
+		t.Fatal(err)
+	}
+	expectPending(t, 2, 0)
+}
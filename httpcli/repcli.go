@@ -0,0 +1,115 @@
+package httpcli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/config"
+	"github.com/boxproject/companion/util"
+)
+
+//单次上报超时
+const REP_TIMEOUT = 10 * time.Second
+
+//上报程序，将VReqChan中的请求以json post到web对应地址，失败按退避时间重试
+type RepCli struct {
+	urls   map[string]string
+	client *http.Client
+}
+
+func NewRepCli(cfg *config.Config) *RepCli {
+	return &RepCli{
+		urls: map[string]string{
+			comm.REQ_ACCOUNT_ADD: cfg.AccountUrl,
+			comm.REQ_DEPOSIT:     cfg.DepositUrl,
+			comm.REQ_WITHDRAW:    cfg.WithDrawUrl,
+			comm.REQ_WITHDRAW_TX: cfg.WithDrawTxUrl,
+		},
+		client: &http.Client{Timeout: REP_TIMEOUT},
+	}
+}
+
+func (r *RepCli) Run(ctx context.Context) error {
+	logger.Info("RepCli start...")
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("RepCli closed")
+			return nil
+		case req, ok := <-comm.VReqChan:
+			if !ok {
+				logger.Info("RepCli channel closed")
+				return nil
+			}
+			if !r.report(ctx, req) {
+				//退出前未完成，记录保留，下次启动重新上报
+				return nil
+			}
+			if err := comm.AckVReq(req); err != nil {
+				logger.Error("ack vreq failed: %v", err)
+			}
+		}
+	}
+}
+
+//上报直至成功，ctx取消时返回false
+func (r *RepCli) report(ctx context.Context, req *comm.VReq) bool {
+	url := r.urls[req.ReqType]
+	if url == "" {
+		logger.Warn("no url for vreq type: %s, drop %s", req.ReqType, comm.VReqKey(req))
+		return true
+	}
+	for retries := 0; ; retries++ {
+		err := r.post(ctx, url, req)
+		if err == nil {
+			logger.Info("report %s to %s ok", comm.VReqKey(req), url)
+			return true
+		}
+		d := util.DefaultBackoff.Duration(retries)
+		logger.Error("report %s failed: %v, retry[%d] after %v", comm.VReqKey(req), err, retries+1, d)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(d):
+		}
+	}
+}
+
+func (r *RepCli) post(ctx context.Context, url string, req *comm.VReq) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status %d: %s", resp.StatusCode, string(body))
+	}
+	rsp := &comm.VRsp{}
+	if err = json.Unmarshal(body, rsp); err != nil {
+		return err
+	}
+	if rsp.Code != 0 {
+		return fmt.Errorf("code %d: %s", rsp.Code, rsp.Message)
+	}
+	return nil
+}
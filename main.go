@@ -11,7 +11,10 @@ import (
 func main() {
 	commands.InitLogger()
 	app := newApp()
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
 func newApp() *cli.App {
@@ -36,9 +39,52 @@ func newApp() *cli.App {
 					Usage: "Path of the config.json file",
 					Value: "",
 				},
+				blockFileFlag,
 				cli.StringFlag{
-					Name:  "block-file,b",
-					Usage: "Check point block number",
+					Name:  "password-file",
+					Usage: "Read the password decrypting creator_passphrase from file",
+					Value: "",
+				},
+				cli.IntFlag{
+					Name:  "password-fd",
+					Usage: "Read the password decrypting creator_passphrase from file descriptor",
+				},
+			},
+		},
+		// 运行状态
+		{
+			Name:   "status",
+			Usage:  "show status and readiness of the running companion",
+			Action: commands.StatusCmd,
+			Flags:  []cli.Flag{configFlag},
+		},
+		// 配置检查
+		{
+			Name:  "config",
+			Usage: "manage config.json",
+			Subcommands: []cli.Command{
+				{
+					Name:   "check",
+					Usage:  "validate config.json and check keystore, certs, geth and sink",
+					Action: commands.ConfigCheckCmd,
+					Flags:  []cli.Flag{configFlag},
+				},
+			},
+		},
+		// 加密keystore密码
+		{
+			Name:   "encrypt",
+			Usage:  "encrypt the keystore passphrase for config.json",
+			Action: commands.EncryptCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config,c",
+					Usage: "Path of the config.json file, verify the passphrase against its keystore",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "output,o",
+					Usage: "Write the ciphertext to file instead of stdout",
 					Value: "",
 				},
 			},
@@ -46,15 +92,202 @@ func newApp() *cli.App {
 		// 停止
 		{
 			Name:   "stop",
-			Usage:  "stop the monitor",
+			Usage:  "stop the running monitor",
 			Action: commands.StopCmd,
-			Flags:  []cli.Flag{},
+			Flags:  []cli.Flag{configFlag},
+		},
+		// 暂停、恢复发送私链交易
+		{
+			Name:   "pause",
+			Usage:  "pause sending private chain transactions",
+			Action: commands.PauseCmd,
+			Flags:  []cli.Flag{configFlag},
+		},
+		{
+			Name:   "resume",
+			Usage:  "resume sending private chain transactions",
+			Action: commands.ResumeCmd,
+			Flags:  []cli.Flag{configFlag},
+		},
+		// 游标
+		{
+			Name:  "cursor",
+			Usage: "show or move the block cursor",
+			Subcommands: []cli.Command{
+				{
+					Name:   "show",
+					Usage:  "show the cursor",
+					Action: commands.CursorShowCmd,
+					Flags:  []cli.Flag{configFlag, blockFileFlag},
+				},
+				{
+					Name:      "set",
+					Usage:     "set the cursor to BLOCK",
+					ArgsUsage: "BLOCK",
+					Action:    commands.CursorSetCmd,
+					Flags:     []cli.Flag{configFlag, blockFileFlag},
+				},
+				{
+					Name:      "rewind",
+					Usage:     "move the cursor back N blocks",
+					ArgsUsage: "N",
+					Action:    commands.CursorRewindCmd,
+					Flags:     []cli.Flag{configFlag, blockFileFlag},
+				},
+			},
+		},
+		// 重新扫描
+		{
+			Name:   "rescan",
+			Usage:  "rescan private chain blocks, skipping events already forwarded",
+			Action: commands.RescanCmd,
+			Flags: []cli.Flag{
+				configFlag,
+				blockFileFlag,
+				cli.Uint64Flag{
+					Name:  "from",
+					Usage: "First block to rescan; alone it rewinds the cursor to from-1",
+				},
+				cli.Uint64Flag{
+					Name:  "to",
+					Usage: "Last block to rescan, not beyond cursor; the cursor is not moved",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Print decoded events without forwarding them",
+				},
+			},
+		},
+		// oracle合约管理
+		{
+			Name:  "oracle",
+			Usage: "manage the oracle contract with the creator account",
+			Subcommands: []cli.Command{
+				{
+					Name:   "deploy",
+					Usage:  "deploy a new oracle contract, the creator becomes its boss",
+					Action: commands.OracleDeployCmd,
+					Flags:  signerFlags,
+				},
+				{
+					Name:   "add-signer",
+					Usage:  "authorize a node signer",
+					Action: commands.OracleAddSignerCmd,
+					Flags:  append([]cli.Flag{oracleFlag, nodeSignerFlag}, signerFlags...),
+				},
+				{
+					Name:   "disable-signer",
+					Usage:  "disable a node signer",
+					Action: commands.OracleDisableSignerCmd,
+					Flags:  append([]cli.Flag{oracleFlag, nodeSignerFlag}, signerFlags...),
+				},
+				{
+					Name:   "list",
+					Usage:  "list node signers",
+					Action: commands.OracleListCmd,
+					Flags:  []cli.Flag{configFlag, oracleFlag},
+				},
+				{
+					Name:   "status",
+					Usage:  "show oracle boss, node counts and whether the creator is authorized",
+					Action: commands.OracleStatusCmd,
+					Flags:  []cli.Flag{configFlag, oracleFlag},
+				},
+			},
+		},
+		// sink合约管理
+		{
+			Name:  "sink",
+			Usage: "manage the sink contract with the creator account",
+			Subcommands: []cli.Command{
+				{
+					Name:   "deploy",
+					Usage:  "deploy a new sink contract bound to the oracle",
+					Action: commands.SinkDeployCmd,
+					Flags:  append([]cli.Flag{oracleFlag}, signerFlags...),
+				},
+				{
+					Name:   "change-oracle",
+					Usage:  "bind the sink contract to a new oracle",
+					Action: commands.SinkChangeOracleCmd,
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "sink",
+							Usage: "Sink contract address, default sink_address in config",
+						},
+						cli.StringFlag{
+							Name:  "oracle",
+							Usage: "New oracle contract address",
+						},
+					}, signerFlags...),
+				},
+			},
+		},
+		// 私链交易
+		{
+			Name:   "txs",
+			Usage:  "list pending and failed private chain transactions",
+			Action: commands.TxsCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config,c",
+					Usage: "Path of the config.json file",
+					Value: "",
+				},
+				cli.BoolFlag{
+					Name:  "all,a",
+					Usage: "Include confirmed transactions",
+				},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:      "retry",
+					Usage:     "queue a failed transaction for sending again",
+					ArgsUsage: "REQUEST",
+					Action:    commands.TxsRetryCmd,
+					Flags:     []cli.Flag{configFlag},
+				},
+			},
 		},
 	}
 
 	return app
 }
 
+var (
+	configFlag = cli.StringFlag{
+		Name:  "config,c",
+		Usage: "Path of the config.json file",
+		Value: "",
+	}
+	blockFileFlag = cli.StringFlag{
+		Name:  "block-file,b",
+		Usage: "Cursor file, default cursor_file_path in config",
+		Value: "",
+	}
+	oracleFlag = cli.StringFlag{
+		Name:  "oracle",
+		Usage: "Oracle contract address, default oracle_address in config",
+	}
+	nodeSignerFlag = cli.StringFlag{
+		Name:  "signer",
+		Usage: "Node signer address",
+	}
+	// creator签名
+	signerFlags = []cli.Flag{
+		configFlag,
+		cli.StringFlag{
+			Name:  "password-file",
+			Usage: "Read the password decrypting creator_passphrase from file",
+			Value: "",
+		},
+		cli.IntFlag{
+			Name:  "password-fd",
+			Usage: "Read the password decrypting creator_passphrase from file descriptor",
+		},
+	}
+)
+
 func PrintVersion(gitCommit, stage, version string) string {
 	if gitCommit != "" {
 		return fmt.Sprintf("%s-%s-%s", stage, version, gitCommit)
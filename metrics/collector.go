@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//采集时读取的队列长度及发件箱计数，均为内存数据，不扫描leveldb
+type dbCollector struct {
+	chanDepth *prometheus.Desc
+	outbox    *prometheus.Desc
+}
+
+func newDbCollector() *dbCollector {
+	return &dbCollector{
+		chanDepth: prometheus.NewDesc(prometheus.BuildFQName(NAMESPACE, "", "chan_depth"),
+			"Requests waiting in a queue; grpc_stream counts unacked outbox streams.", []string{"chan"}, nil),
+		outbox: prometheus.NewDesc(prometheus.BuildFQName(NAMESPACE, "", "outbox_backlog"),
+			"gRPC streams in the outbox, by state.", []string{"state"}, nil),
+	}
+}
+
+func (c *dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.chanDepth
+	ch <- c.outbox
+}
+
+func (c *dbCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.chanDepth, prometheus.GaugeValue, float64(len(comm.ReqChan)), "req")
+	ch <- prometheus.MustNewConstMetric(c.chanDepth, prometheus.GaugeValue, float64(len(comm.VReqChan)), "vreq")
+	if comm.Ldb == nil {
+		return
+	}
+
+	//首次采集时统计一次，之后随上报落地、确认及清理更新
+	pending, acked, err := comm.OutboxCounts()
+	if err != nil {
+		logger.Error("[METRICS] count outbox failed: %v", err)
+		return
+	}
+	//上报经发件箱发送，待发送数即未确认的上报数
+	ch <- prometheus.MustNewConstMetric(c.chanDepth, prometheus.GaugeValue, float64(pending), "grpc_stream")
+	ch <- prometheus.MustNewConstMetric(c.outbox, prometheus.GaugeValue, float64(pending), "pending")
+	ch <- prometheus.MustNewConstMetric(c.outbox, prometheus.GaugeValue, float64(acked), "acked")
+}
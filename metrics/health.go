@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+//健康检查，返回nil表示正常
+type HealthCheck func() error
+
+type checkEntry struct {
+	name  string
+	live  bool
+	check HealthCheck
+}
+
+var (
+	checksLock sync.RWMutex
+	checks     []*checkEntry
+)
+
+//检查结果
+type CheckResult struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	Err  string `json:"err,omitempty"`
+}
+
+//健康报告
+type HealthReport struct {
+	OK     bool           `json:"ok"`
+	Checks []*CheckResult `json:"checks"`
+}
+
+//注册检查项，live为true时同时用于存活检查(/healthz)，否则仅用于就绪检查(/readyz)
+func RegisterCheck(name string, live bool, check HealthCheck) {
+	checksLock.Lock()
+	defer checksLock.Unlock()
+	checks = append(checks, &checkEntry{name: name, live: live, check: check})
+}
+
+//执行检查，liveOnly为true时仅执行存活检查项
+func RunChecks(liveOnly bool) *HealthReport {
+	checksLock.RLock()
+	entries := append([]*checkEntry{}, checks...)
+	checksLock.RUnlock()
+
+	report := &HealthReport{OK: true, Checks: make([]*CheckResult, 0, len(entries))}
+	for _, e := range entries {
+		if liveOnly && !e.live {
+			continue
+		}
+		result := &CheckResult{Name: e.name, OK: true}
+		if err := e.check(); err != nil {
+			result.OK, result.Err = false, err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+func healthHandler(liveOnly bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		report := RunChecks(liveOnly)
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
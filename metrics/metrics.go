@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const NAMESPACE = "companion"
+
+var (
+	headBlock   int64
+	cursorBlock int64
+
+	//私链最新区块
+	HeadBlock = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "head_block",
+		Help:      "Latest private chain block seen by the watcher.",
+	})
+	//已处理区块游标
+	CursorBlock = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "cursor_block",
+		Help:      "Last private chain block scanned by the watcher.",
+	})
+	//游标落后区块数
+	BlockLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "block_lag",
+		Help:      "Blocks between head and cursor.",
+	})
+	//按上报类型统计的私链事件
+	Events = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "events_total",
+		Help:      "Private chain events forwarded, by grpc stream type.",
+	}, []string{"type"})
+	//死信log
+	DeadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "dead_letters_total",
+		Help:      "Logs that failed to decode and were moved to the dead-letter store.",
+	})
+	//私链交易发送
+	TxSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "tx_sent_total",
+		Help:      "Private chain transactions sent.",
+	})
+	//私链交易发送失败
+	TxFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "tx_failed_total",
+		Help:      "Private chain transaction send failures.",
+	})
+	//处理中的私链交易，随交易状态变化更新
+	TxPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "tx_pending",
+		Help:      "Private chain transactions queued or sent but not yet confirmed.",
+	}, []string{"status"})
+	//下一个待分配nonce，随分配及同步更新
+	NonceNext = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "nonce_next",
+		Help:      "Next nonce to be assigned, by account.",
+	}, []string{"account"})
+	//私链连接状态
+	EthConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "eth_connected",
+		Help:      "Whether the private chain connection is up.",
+	})
+	//私链重连
+	EthReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "eth_reconnects_total",
+		Help:      "Private chain reconnects.",
+	})
+	//私链各节点可用状态
+	EthEndpointUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "eth_endpoint_up",
+		Help:      "Whether each private chain endpoint passed the last probe.",
+	}, []string{"endpoint"})
+	//私链各节点最新区块
+	EthEndpointHead = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "eth_endpoint_head_block",
+		Help:      "Latest block reported by each private chain endpoint.",
+	}, []string{"endpoint"})
+	//gRPC stream重连
+	GrpcReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "grpc_reconnects_total",
+		Help:      "gRPC listen stream reconnects.",
+	})
+	//gRPC上报耗时
+	RouterLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "grpc_router_seconds",
+		Help:      "Latency of gRPC router sends.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(HeadBlock, CursorBlock, BlockLag, Events, DeadLetters, TxSent, TxFailed, TxPending, NonceNext, EthConnected, EthReconnects, EthEndpointUp, EthEndpointHead, GrpcReconnects, RouterLatency)
+	prometheus.MustRegister(newDbCollector())
+}
+
+func SetHead(number uint64) {
+	atomic.StoreInt64(&headBlock, int64(number))
+	HeadBlock.Set(float64(number))
+	updateLag()
+}
+
+func SetCursor(number uint64) {
+	atomic.StoreInt64(&cursorBlock, int64(number))
+	CursorBlock.Set(float64(number))
+	updateLag()
+}
+
+func updateLag() {
+	BlockLag.Set(float64(atomic.LoadInt64(&headBlock) - atomic.LoadInt64(&cursorBlock)))
+}
+
+//最新区块及游标，供健康检查使用
+func Blocks() (head, cursor uint64) {
+	return uint64(atomic.LoadInt64(&headBlock)), uint64(atomic.LoadInt64(&cursorBlock))
+}
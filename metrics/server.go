@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//退出时等待请求结束的最长时间
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
+//监控服务，无需签名，建议仅绑定内网地址
+type Server struct {
+	mux *http.ServeMux
+	srv *http.Server
+}
+
+func NewServer(bind string) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthHandler(true))
+	mux.Handle("/readyz", healthHandler(false))
+	return &Server{mux: mux, srv: &http.Server{Addr: bind, Handler: mux}}
+}
+
+//注册其他监控接口
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		logger.Info("metrics server listen on %s", s.srv.Addr)
+		errCh <- s.srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		return s.srv.Shutdown(shutdownCtx)
+	}
+}
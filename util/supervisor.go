@@ -0,0 +1,87 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/alecthomas/log4go"
+)
+
+//服务，ctx取消后应尽快返回；返回error或panic时由supervisor重启
+type Service func(ctx context.Context) error
+
+//管理常驻goroutine的启动、重启及退出
+type Supervisor struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	backoff Backoff
+}
+
+func NewSupervisor() *Supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Supervisor{ctx: ctx, cancel: cancel, backoff: DefaultBackoff}
+}
+
+func (s *Supervisor) Context() context.Context {
+	return s.ctx
+}
+
+//启动服务，异常退出时按退避时间重启，正常返回或ctx取消后不再重启；
+//运行时间超过最大退避时间后视为已恢复，重启次数重新计算
+func (s *Supervisor) Go(name string, svc Service) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for restarts := 0; ; restarts++ {
+			start := time.Now()
+			err := s.run(svc)
+			if s.ctx.Err() != nil {
+				log.Info("[SUPERVISOR] %s stopped", name)
+				return
+			}
+			if err == nil {
+				log.Info("[SUPERVISOR] %s exited", name)
+				return
+			}
+			if time.Since(start) > s.backoff.MaxDelay {
+				restarts = 0
+			}
+			d := s.backoff.Duration(restarts)
+			log.Error("[SUPERVISOR] %s crashed: %v, restart[%d] after %v", name, err, restarts+1, d)
+			select {
+			case <-s.ctx.Done():
+				log.Info("[SUPERVISOR] %s stopped", name)
+				return
+			case <-time.After(d):
+			}
+		}
+	}()
+}
+
+func (s *Supervisor) run(svc Service) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return svc(s.ctx)
+}
+
+//通知所有服务退出，等待其返回，超时返回false
+func (s *Supervisor) Stop(timeout time.Duration) bool {
+	s.cancel()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSupervisorBackoffReset(t *testing.T) {
+	s := NewSupervisor()
+	s.backoff = Backoff{MaxDelay: 200 * time.Millisecond, baseDelay: 10 * time.Millisecond, factor: 4}
+	//前4次立即失败，第5次运行超过最大退避时间后失败，第6次正常返回
+	var calls []time.Time
+	done := make(chan struct{})
+	s.Go("test", func(ctx context.Context) error {
+		calls = append(calls, time.Now())
+		switch len(calls) {
+		case 5:
+			time.Sleep(250 * time.Millisecond)
+		case 6:
+			close(done)
+			return nil
+		}
+		return errors.New("failed")
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("service not restarted")
+	}
+	s.Stop(time.Second)
+
+	//第4次失败后已退避至最大值
+	if d := calls[4].Sub(calls[3]); d < 150*time.Millisecond {
+		t.Fatalf("restart delay before reset: %v", d)
+	}
+	if d := calls[5].Sub(calls[4]) - 250*time.Millisecond; d > 100*time.Millisecond {
+		t.Fatalf("restart delay after long run not reset: %v", d)
+	}
+}
@@ -0,0 +1,44 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+//解析或校验失败的log
+type DeadLetter struct {
+	Log        types.Log `json:"log"`
+	Err        string    `json:"err"`
+	CreateTime int64     `json:"createTime"`
+}
+
+//log写入死信记录，不再处理
+func (logW *EthEventLogWatcher) deadLetter(log *types.Log, cause error) {
+	if logW.manual != nil {
+		logW.manual.record(log, RESCAN_DEAD_LETTER, nil, cause)
+		if logW.manual.dryRun {
+			return
+		}
+	}
+	logger.Error("[DLQ] block: %d, tx: %s, index: %d, cause: %v", log.BlockNumber, log.TxHash.Hex(), log.Index, cause)
+	metrics.DeadLetters.Inc()
+	data, err := json.Marshal(&DeadLetter{Log: *log, Err: cause.Error(), CreateTime: time.Now().Unix()})
+	if err != nil {
+		logger.Error("dead letter marshal failed. cause:%v", err)
+		return
+	}
+	if err = logW.PutByte(deadLetterKey(log.BlockNumber, log.TxHash, log.Index), data); err != nil {
+		logger.Error("land dead letter to db error: %v", err)
+	}
+}
+
+func deadLetterKey(number uint64, txHash common.Hash, index uint) []byte {
+	return []byte(fmt.Sprintf("%s%020d_%s_%d", comm.DEAD_LETTER_PREFIX, number, txHash.Hex(), index))
+}
@@ -2,14 +2,12 @@ package watcher
 
 import (
 	"bytes"
+	"errors"
 	"math"
 	"math/big"
 
-	"encoding/json"
-
 	logger "github.com/alecthomas/log4go"
 	"github.com/boxproject/companion/comm"
-	"github.com/boxproject/companion/util"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -41,127 +39,114 @@ var (
 	}
 )
 
+var (
+	ErrEmptyHash     = errors.New("empty hash in event")
+	ErrIllegalAmount = errors.New("illegal amount in event")
+)
+
 type EventHandler func(logW *EthEventLogWatcher, log *types.Log) error
 
 func addHashHandler(logW *EthEventLogWatcher, log *types.Log) error {
 	logger.Debug("addHashHandler......")
-
-	if dataBytes := log.Data; len(dataBytes) > 0 {
-		hash := common.BytesToHash(dataBytes[:32])
-		lastConfirmed := common.BytesToAddress(dataBytes[32:64])
-		if util.AddressEquals(lastConfirmed, common.HexToAddress(logW.appCfg.Creator)) { //最终确认人
-			logger.Info("[address equal]")
-			grpcStream := &comm.GrpcStream{BlockNumber: log.BlockNumber, Type: comm.GRPC_HASH_ADD_LOG, Hash: hash, Status: comm.HASH_STATUS_APPLY}
-			if grpcStreamJson, err := json.Marshal(grpcStream); err != nil {
-				logger.Error("EventStream marshal failed. cause:%v", err)
-			} else {
-				//write to db
-				if err := logW.SetGrpcStreamDB(false, grpcStream.Type, hash.Hex(), grpcStreamJson); err != nil {
-					logger.Error("landtodb error", err)
-				}
-			}
-			comm.GrpcStreamChan <- grpcStream
-		}else {
-			logger.Info("[address not equal]CreatorAddr:%v,LastConfirmAddr:%v",common.HexToAddress(logW.appCfg.Creator),lastConfirmed,)
-		}
-
+	event, err := logW.sink.ParseSignflowAdded(*log)
+	if err != nil {
+		logW.deadLetter(log, err)
+		return nil
+	}
+	hash := common.Hash(event.Hash)
+	if hash == (common.Hash{}) {
+		logW.deadLetter(log, ErrEmptyHash)
+		return nil
 	}
-	return nil
+	signInfos, ok, err := logW.accept(log, comm.REQ_HASH_ADD, hash, common.Hash{}, event.LastConfirmed)
+	if ok {
+		grpcStream := &comm.GrpcStream{BlockNumber: log.BlockNumber, Type: comm.GRPC_HASH_ADD_LOG, Hash: hash, Status: comm.HASH_STATUS_APPLY, SignInfos: signInfos}
+		err = logW.forward(log, grpcStream)
+	}
+	return err
 }
 
 //确认hash
 func enableHashHandler(logW *EthEventLogWatcher, log *types.Log) error {
 	logger.Debug("enableHashHandler......")
-	if dataBytes := log.Data; len(dataBytes) > 0 {
-		hash := common.BytesToHash(dataBytes[:32])
-		lastConfirmed := common.BytesToAddress(dataBytes[32:64])
-		logger.Debug("enableHashHandler......db....", hash)
-		if util.AddressEquals(lastConfirmed, common.HexToAddress(logW.appCfg.Creator)) { //最终确认人
-			//if contentByte, err := logW.ldb.GetByte([]byte(comm.HASH_ADD_CONTENT_PREFIX + hash.Hex())); err != nil {
-			//	logger.Error("load content err:%v", err)
-			//} else {
-				grpcStream := &comm.GrpcStream{BlockNumber: log.BlockNumber, Type: comm.GRPC_HASH_ENABLE_LOG, Hash: hash}
-				if grpcStreamJson, err := json.Marshal(grpcStream); err != nil {
-					logger.Error("EventStream marshal failed. cause:%v", err)
-				} else {
-					//write to db
-					if err := logW.SetGrpcStreamDB(false, grpcStream.Type, hash.Hex(), grpcStreamJson); err != nil {
-						logger.Error("landtodb error", err)
-					}
-				}
-				comm.GrpcStreamChan <- grpcStream
-			//}
-		}
+	event, err := logW.sink.ParseSignflowEnabled(*log)
+	if err != nil {
+		logW.deadLetter(log, err)
+		return nil
 	}
-	return nil
+	hash := common.Hash(event.Hash)
+	if hash == (common.Hash{}) {
+		logW.deadLetter(log, ErrEmptyHash)
+		return nil
+	}
+	logger.Debug("enableHashHandler......db....", hash)
+	signInfos, ok, err := logW.accept(log, comm.REQ_HASH_ENABLE, hash, common.Hash{}, event.LastConfirmed)
+	if ok {
+		grpcStream := &comm.GrpcStream{BlockNumber: log.BlockNumber, Type: comm.GRPC_HASH_ENABLE_LOG, Hash: hash, SignInfos: signInfos}
+		err = logW.forward(log, grpcStream)
+	}
+	return err
 }
 
 //禁用hash
 func disableHashHandler(logW *EthEventLogWatcher, log *types.Log) error {
 	logger.Debug("disableHashHandler......")
-	if dataBytes := log.Data; len(dataBytes) > 0 {
-		hash := common.BytesToHash(dataBytes[:32])
-		lastConfirmed := common.BytesToAddress(dataBytes[32:64])
-		logger.Debug("disableHashHandler......db....", hash)
-
-		if util.AddressEquals(lastConfirmed, common.HexToAddress(logW.appCfg.Creator)) { //最终确认人
-			//if contentByte, err := logW.ldb.GetByte([]byte(comm.HASH_ADD_CONTENT_PREFIX + hash.Hex())); err != nil {
-			//	logger.Error("load content err:%v", err)
-			//} else {
-				grpcStream := &comm.GrpcStream{BlockNumber: log.BlockNumber, Type: comm.GRPC_HASH_DISABLE_LOG, Hash: hash}
-				if grpcStreamJson, err := json.Marshal(grpcStream); err != nil {
-					logger.Error("EventStream marshal failed. cause:%v", err)
-				} else {
-					//write to db
-					if err := logW.SetGrpcStreamDB(false, grpcStream.Type, hash.Hex(), grpcStreamJson); err != nil {
-						logger.Error("landtodb error", err)
-					}
-				}
-				comm.GrpcStreamChan <- grpcStream
-			//}
-		}
+	event, err := logW.sink.ParseSignflowDisabled(*log)
+	if err != nil {
+		logW.deadLetter(log, err)
+		return nil
+	}
+	hash := common.Hash(event.Hash)
+	if hash == (common.Hash{}) {
+		logW.deadLetter(log, ErrEmptyHash)
+		return nil
+	}
+	logger.Debug("disableHashHandler......db....", hash)
+	signInfos, ok, err := logW.accept(log, comm.REQ_HASH_DISABLE, hash, common.Hash{}, event.LastConfirmed)
+	if ok {
+		grpcStream := &comm.GrpcStream{BlockNumber: log.BlockNumber, Type: comm.GRPC_HASH_DISABLE_LOG, Hash: hash, SignInfos: signInfos}
+		err = logW.forward(log, grpcStream)
 	}
-	return nil
+	return err
 }
 
 //提现申请
 func withdrawApplyHandler(logW *EthEventLogWatcher, log *types.Log) error {
 	logger.Debug("withdrawAplyHandler......")
+	event, err := logW.sink.ParseWithdrawApplied(*log)
+	if err != nil {
+		logW.deadLetter(log, err)
+		return nil
+	}
+	hash := common.Hash(event.Hash)
+	wdHash := common.Hash(event.TxHash)
+	if hash == (common.Hash{}) || wdHash == (common.Hash{}) {
+		logW.deadLetter(log, ErrEmptyHash)
+		return nil
+	}
+	if event.Amount.Sign() <= 0 || event.Fee.Sign() < 0 {
+		logW.deadLetter(log, ErrIllegalAmount)
+		return nil
+	}
 
-	if dataBytes := log.Data; len(dataBytes) > 0 {
-		hash := log.Topics[1]
-		wdHash := log.Topics[2]
-		amount := common.BytesToHash(dataBytes[:32]).Big()
-		fee := common.BytesToHash(dataBytes[32:64]).Big()
-		category := common.BytesToHash(dataBytes[96:128]).Big()
-		var to string = ""
-		if category.Int64() == comm.CATEGORY_BTC {
-			//获取db中的地址数据
-			if recAddrByte, err := logW.ldb.GetByte([]byte(comm.APPROVE_RECADDR_PREFIX + wdHash.Hex())); err != nil {
-				logger.Error("load recAddress err:%v", err)
-			} else {
-				to = string(recAddrByte)
-			}
+	var to string = ""
+	if event.Category.Int64() == comm.CATEGORY_BTC {
+		//获取db中的地址数据
+		if recAddrByte, err := logW.ldb.GetByte([]byte(comm.APPROVE_RECADDR_PREFIX + wdHash.Hex())); err != nil {
+			logger.Error("load recAddress err:%v", err)
 		} else {
-			to = common.BytesToAddress(dataBytes[64:96]).Hex()
-		}
-		logger.Debug("withdrawAplyHandler......db....")
-		lastConfirmed := common.BytesToAddress(dataBytes[128:160])
-		logger.Debug("lastConfirmed:%v,Creator:%v,txHash:%v",lastConfirmed.Hex(),common.HexToAddress(logW.appCfg.Creator).Hex(),log.TxHash.Hex())
-		if util.AddressEquals(lastConfirmed, common.HexToAddress(logW.appCfg.Creator)) { //最终确认人
-			grpcStream := &comm.GrpcStream{BlockNumber: log.BlockNumber, Type: comm.GRPC_WITHDRAW_LOG, Hash: hash, WdHash: wdHash, Amount: amount, Fee: fee, To: to, Category: category}
-			if grpcStreamJson, err := json.Marshal(grpcStream); err != nil {
-				logger.Error("EventStream marshal failed. cause:%v", err)
-			} else {
-				//write to db
-				if err := logW.SetGrpcStreamDB(false, grpcStream.Type, wdHash.Hex(), grpcStreamJson); err != nil {
-					logger.Error("landtodb error", err)
-				}
-			}
-			comm.GrpcStreamChan <- grpcStream
+			to = string(recAddrByte)
 		}
+	} else {
+		to = event.Recipient.Hex()
+	}
+	logger.Debug("lastConfirmed:%v,Creator:%v,txHash:%v", event.LastConfirmed.Hex(), common.HexToAddress(logW.appCfg.Creator).Hex(), log.TxHash.Hex())
+	signInfos, ok, err := logW.accept(log, comm.REQ_OUT_APPROVE, hash, wdHash, event.LastConfirmed)
+	if ok {
+		grpcStream := &comm.GrpcStream{BlockNumber: log.BlockNumber, Type: comm.GRPC_WITHDRAW_LOG, Hash: hash, WdHash: wdHash, Amount: event.Amount, Fee: event.Fee, To: to, Category: event.Category, SignInfos: signInfos}
+		err = logW.forward(log, grpcStream)
 	}
-	return nil
+	return err
 }
 
 //解析地址
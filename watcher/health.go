@@ -0,0 +1,30 @@
+package watcher
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/boxproject/companion/metrics"
+)
+
+//记录收到新区块的时间
+func (logW *EthEventLogWatcher) touchHead() {
+	atomic.StoreInt64(&logW.headTime, time.Now().UnixNano())
+}
+
+//健康检查：maxHeadAge内收到过新区块，且游标落后(除check_block_before外)不超过maxLag
+func (logW *EthEventLogWatcher) Health(maxHeadAge time.Duration, maxLag int64) error {
+	headTime := atomic.LoadInt64(&logW.headTime)
+	if headTime == 0 {
+		return fmt.Errorf("no head received yet")
+	}
+	if age := time.Since(time.Unix(0, headTime)); age > maxHeadAge {
+		return fmt.Errorf("no new head for %v", age.Round(time.Second))
+	}
+	head, cursor := metrics.Blocks()
+	if lag := int64(head) - int64(cursor) - atomic.LoadInt64(&logW.checkBefore); lag > maxLag {
+		return fmt.Errorf("cursor %d lags head %d by %d blocks", cursor, head, lag)
+	}
+	return nil
+}
@@ -2,49 +2,122 @@ package watcher
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"math/big"
+	"time"
 
 	logger "github.com/alecthomas/log4go"
-	"github.com/boxproject/companion/comm"
 	"github.com/boxproject/companion/config"
+	"github.com/boxproject/companion/contract"
 	"github.com/boxproject/companion/db"
-	"github.com/boxproject/companion/util"
+	"github.com/boxproject/companion/ethcli"
+	"github.com/boxproject/companion/metrics"
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/rpc"
-	"strings"
-	//"time"
-	"time"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	HEAD_TIMEOUT         = 10 * time.Second //获取最新区块超时
+	RESUBSCRIBE_INTERVAL = time.Minute      //订阅失败改为轮询后，尝试恢复订阅的间隔
 )
 
+//轮询期间定时尝试恢复订阅
+var errResubscribe = errors.New("resubscribe new head")
+
+//订阅中断，需重连后重新订阅
+type subscribeError struct {
+	error
+}
+
 type EthEventLogWatcher struct {
-	client          *ethclient.Client
+	headTime        int64 //最近收到新区块时间，unix纳秒
+	checkBefore     int64 //确认区块数，可热加载
+	pendingCursor   int64 //下一个新区块时设置的游标+1，0表示无
+	client          *ethcli.Client
 	appCfg          *config.EthCfg
 	blkFile         string
 	quitSignal      chan struct{}
+	stopOnce        sync.Once
+	handleLock      sync.Mutex   //log处理与手动重新扫描互斥
+	manual          *rescanState //手动重新扫描时记录处理结果
 	eventHandlerMap map[common.Hash]EventHandler
-	checkBefore     *big.Int
+	reorgWindow     int64
+	eventRetention  uint64 //已上报log记录保留区块数
+	scanInterval    time.Duration
+	addresses       []common.Address
+	addressSet      map[common.Address]bool
+	sink            *contract.SinkFilterer
+	quorum          *quorum
 	ldb             *db.Ldb
 }
 
-func NewEthEventLogWatcher(c *rpc.Client, ethCfg *config.EthCfg, blkFile string, ldb *db.Ldb) (*EthEventLogWatcher, error) {
-	client := ethclient.NewClient(c)
+//addresses 首个地址为sink合约
+func NewEthEventLogWatcher(client *ethcli.Client, ethCfg *config.EthCfg, blkFile string, ldb *db.Ldb, addresses []common.Address) (*EthEventLogWatcher, error) {
 	logWatcher := &EthEventLogWatcher{
 		client:     client,
 		appCfg:     ethCfg,
 		blkFile:    blkFile,
 		quitSignal: make(chan struct{}),
 		ldb:        ldb,
+		addresses:  addresses,
+		addressSet: make(map[common.Address]bool),
+	}
+	for _, addr := range addresses {
+		logWatcher.addressSet[addr] = true
+	}
+	//sink合约事件解析
+	sink, err := contract.NewSinkFilterer(addresses[0], client)
+	if err != nil {
+		return nil, err
+	}
+	logWatcher.sink = sink
+	//多节点确认统计
+	if ethCfg.OracleAddress != "" {
+		oracle, err := contract.NewOracleCaller(common.HexToAddress(ethCfg.OracleAddress), client)
+		if err != nil {
+			return nil, err
+		}
+		if logWatcher.quorum, err = newQuorum(addresses[0], ethCfg.ConfirmThreshold, oracle); err != nil {
+			return nil, err
+		}
+	} else {
+		logger.Warn("oracle_address not set, forward events confirmed by creator only")
+	}
+	logWatcher.scanInterval = config.DEF_SCAN_INTERVAL * time.Second
+	if ethCfg.ScanInterval > 0 {
+		logWatcher.scanInterval = time.Duration(ethCfg.ScanInterval) * time.Second
+	}
+	logWatcher.reorgWindow = ethCfg.ReorgWindow
+	if logWatcher.reorgWindow <= 0 {
+		logWatcher.reorgWindow = config.DEF_REORG_WINDOW
+	}
+	logWatcher.eventRetention = config.DEF_EVENT_RETENTION
+	if ethCfg.EventRetention > 0 {
+		logWatcher.eventRetention = uint64(ethCfg.EventRetention)
 	}
 
 	return logWatcher, nil
 }
 
+//按watch_topics设置关注的事件
+func (logW *EthEventLogWatcher) SetEvents(events map[common.Hash]EventHandler) error {
+	eventHandlerMap, err := filterEvents(events, logW.appCfg.WatchTopics)
+	if err != nil {
+		logger.Error("Illegal watch topics, cause: %v", err)
+		return err
+	}
+	logW.eventHandlerMap = eventHandlerMap
+	return nil
+}
+
 func (logW *EthEventLogWatcher) Initial(events map[common.Hash]EventHandler) error {
-	logW.eventHandlerMap = events
+	if err := logW.SetEvents(events); err != nil {
+		return err
+	}
 	// 读取当前日志记录下的区块号
 	logger.Debug("Block file:[%v]", logW.blkFile)
 
@@ -61,92 +134,160 @@ func (logW *EthEventLogWatcher) Initial(events map[common.Hash]EventHandler) err
 		return err
 	}
 	maxBlkNumber := blk.Number()
+	logW.saveBlockHash(maxBlkNumber.Uint64(), blk.Hash())
+	metrics.SetHead(maxBlkNumber.Uint64())
+	logW.touchHead()
+	metrics.SetCursor(lastCursorBlkNumber.Uint64())
 
-	//nonce值初始化
-	nonce, err := logW.client.NonceAt(context.Background(), common.HexToAddress(logW.appCfg.Creator), maxBlkNumber)
-	if err != nil { //设置初始值nonce值
-		logger.Error("get nonce err: %v", err)
-	}
-	util.WriteNumberToFile(logW.appCfg.NonceFilePath, big.NewInt(int64(nonce)))
-	logger.Info("Nonce file:[%v], current nonce value:%v", logW.appCfg.NonceFilePath, nonce)
-
-	// 获取向前推N个区块的big.Int值
-	logW.checkBefore = big.NewInt(logW.appCfg.CheckBlockBefore)
+	// 向前推N个区块
+	logW.SetCheckBefore(logW.appCfg.CheckBlockBefore)
 	logger.Info("[BEGIN] rescan block ...")
 	logger.Info("Last scan block height: %v", lastCursorBlkNumber.String())
 	logger.Info("Current max block height: %v", maxBlkNumber.String())
 	// -------|-------------------|
 	//    current                max
 	//  max - current >= checkBefore(30) 检查向前推的区块
-	cursorBlkNumber := new(big.Int).Add(lastCursorBlkNumber, logW.checkBefore)
-	for maxBlkNumber.Cmp(new(big.Int).Add(cursorBlkNumber, big.NewInt(1))) >= 0 {
-		if err := logW.checkLogs(new(big.Int).Add(cursorBlkNumber, big.NewInt(1))); err != nil {
-			continue
-		}
-		//add 1 to next
-		cursorBlkNumber.Add(cursorBlkNumber, big.NewInt(1))
+	checkPoint := new(big.Int).Sub(maxBlkNumber, logW.checkBeforeBig())
+	if err = logW.scanRange(new(big.Int).Add(lastCursorBlkNumber, big.NewInt(1)), checkPoint); err != nil {
+		logger.Error("rescan block failed. cause: %v", err)
+		return err
 	}
-	logger.Info("current scan block height: %v", new(big.Int).Sub(cursorBlkNumber, logW.checkBefore))
+	logger.Info("current scan block height: %v", checkPoint)
 	logger.Info("[END] rescan block ...")
 
 	return nil
 }
 
-func (logW *EthEventLogWatcher) Listen() {
+//订阅新区块，无法订阅时轮询。订阅中断时通知重连，重连成功后重新订阅并从游标补扫；扫描异常时返回error由supervisor重启
+func (logW *EthEventLogWatcher) Listen(ctx context.Context) error {
+	for {
+		reconnected := logW.client.Reconnected()
+		err := logW.subscribe(ctx)
+		if err == nil {
+			logger.Debug("watcher listener stopped.")
+			return nil
+		}
+		if err == errResubscribe {
+			continue
+		}
+		subErr, ok := err.(subscribeError)
+		if !ok {
+			return err
+		}
+		logger.Error("[ETH CONNECT ERROR]: %v", err)
+		select {
+		case <-reconnected:
+			//订阅期间连接已重建
+		default:
+			logW.client.Fail(subErr.error)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-logW.quitSignal:
+			return nil
+		case <-reconnected:
+			logger.Info("[ETH] resubscribe new head")
+		}
+	}
+}
 
+func (logW *EthEventLogWatcher) subscribe(ctx context.Context) error {
 	ch := make(chan *types.Header)
-	sid, err := logW.client.SubscribeNewHead(context.Background(), ch)
-	if err == nil {
-		err = logW.recv(sid, ch)
-		defer sid.Unsubscribe()
+	sid, err := logW.client.SubscribeNewHead(ctx, ch)
+	if err != nil {
+		//不支持订阅(http/ipc代理)或订阅失败时改为轮询
+		logger.Warn("[ETH] subscribe new head failed: %v, poll every %v", err, logW.scanInterval)
+		return logW.poll(ctx, err != rpc.ErrNotificationsUnsupported)
+	}
+	defer sid.Unsubscribe()
+	//补扫未订阅期间的区块
+	if err = logW.rescan(ctx); err != nil {
+		return err
 	}
+	return logW.recv(ctx, sid, ch)
+}
 
-	//retry connect
+//从游标扫描至当前区块
+func (logW *EthEventLogWatcher) rescan(ctx context.Context) error {
+	headCtx, cancel := context.WithTimeout(ctx, HEAD_TIMEOUT)
+	defer cancel()
+	head, err := logW.client.HeaderByNumber(headCtx, nil)
 	if err != nil {
-		logger.Error("[ETH CONNECT ERROR]: %v", err)
-		d := util.DefaultBackoff.Duration(util.RetryCount)
-		if d > 0 {
-			time.Sleep(d)
-			logger.Info("[RETRY ETH CONNECT][%v] sleep:%v", util.RetryCount, d)
-			util.RetryCount++
-			go logW.Listen()
-			return
+		return subscribeError{err}
+	}
+	return logW.handleHead(head)
+}
+
+//按scan_interval轮询最新区块，与订阅共用handleHead；resubscribe为true时定时返回以尝试恢复订阅
+func (logW *EthEventLogWatcher) poll(ctx context.Context, resubscribe bool) error {
+	ticker := time.NewTicker(logW.scanInterval)
+	defer ticker.Stop()
+	var retry <-chan time.Time
+	if resubscribe {
+		retryTicker := time.NewTicker(RESUBSCRIBE_INTERVAL)
+		defer retryTicker.Stop()
+		retry = retryTicker.C
+	}
+
+	var lastScanHeight = big.NewInt(-1)
+	for {
+		headCtx, cancel := context.WithTimeout(ctx, HEAD_TIMEOUT)
+		head, err := logW.client.HeaderByNumber(headCtx, nil)
+		cancel()
+		if err != nil {
+			return subscribeError{err}
+		}
+		if lastScanHeight.Cmp(head.Number) != 0 {
+			if err = logW.handleHead(head); err != nil {
+				return err
+			}
+			lastScanHeight = head.Number
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("Monitor stopped!")
+			return nil
+		case <-logW.quitSignal:
+			logger.Info("Monitor stopped!")
+			return nil
+		case <-retry:
+			return errResubscribe
+		case <-ticker.C:
 		}
 	}
-	logger.Debug("watcher listener stopped.")
 }
 
 func (logW *EthEventLogWatcher) Stop() {
-	close(logW.quitSignal)
+	logW.stopOnce.Do(func() { close(logW.quitSignal) })
 	logger.Info("ETH Event log Watcher stopped!")
 }
 
-func (logW *EthEventLogWatcher) recv(sid ethereum.Subscription, ch <-chan *types.Header) error {
+func (logW *EthEventLogWatcher) recv(ctx context.Context, sid ethereum.Subscription, ch <-chan *types.Header) error {
 	logger.Debug("EthHandler recv...")
 	var err error
 	var lastScanHeight = big.NewInt(-1)
 	for {
 		select {
+		case <-ctx.Done():
+			logger.Info("Monitor stopped!")
+			return nil
 		case <-logW.quitSignal:
 			logger.Info("Monitor stopped!")
 			return nil
 		case err = <-sid.Err():
-			if err != nil {
-				logger.Error("When subscribe the header, error found. cause: %v", err)
-				return err
+			if err == nil {
+				err = ethcli.ErrDisconnected
 			}
+			logger.Error("When subscribe the header, error found. cause: %v", err)
+			return subscribeError{err}
 		case head := <-ch:
-			if util.RetryCount != 0 {
-				//发现掉线,重新扫描
-				logW.Initial(PriEventMap)
-				util.RetryCount = 0
-				continue
-			}
 			if head.Number == nil {
 				continue
 			}
 			if lastScanHeight.Cmp(head.Number) != 0 {
-				if err = logW.checkLogs(head.Number); err != nil {
+				if err = logW.handleHead(head); err != nil {
 					return err
 				}
 				lastScanHeight = head.Number
@@ -157,145 +298,34 @@ func (logW *EthEventLogWatcher) recv(sid ethereum.Subscription, ch <-chan *types
 	}
 }
 
-func (logW *EthEventLogWatcher) checkLogs(blkNumber *big.Int) error {
-	checkPoint := new(big.Int).Sub(blkNumber, logW.checkBefore)
-
-	logger.Debug("[BLOCK] GetBlock: %v, CheckBlock: %v", blkNumber, checkPoint)
-
-	//logger.Debug("[HEADER] blkNumber: %s， blkNumber checkpoint: %s", blkNumber.String(), checkPoint.String())
-	if logs, err := logW.client.FilterLogs(
-		context.Background(),
-		ethereum.FilterQuery{
-			FromBlock: checkPoint,
-			ToBlock:   checkPoint,
-		}); err != nil {
-		logger.Error("FilterLogs :%s", err)
-		return err
-	} else {
-		if len(logs) != 0 {
-			for _, log := range logs {
-				if log.Topics == nil || len(log.Topics) == 0 {
-					logger.Info("enventLog topics nil")
-					continue
-				}
-
-				handler, ok := logW.eventHandlerMap[log.Topics[0]]
-				if !ok {
-					logger.Info("false No ==> %s", log.Topics[0].Hex())
-					continue
-				}
-				logger.Info("true No ==> %s", log.Topics[0].Hex())
-				if err = handler(logW, &log); err != nil {
-					logger.Error("log handler err: %s", err)
-					return err
-				}
-			}
-		}
-		WriteCheckpointBlockNumberToFile(logW.blkFile, checkPoint)
-	}
-
-	return nil
+//更新确认区块数，下一个新区块起生效
+func (logW *EthEventLogWatcher) SetCheckBefore(n int64) {
+	atomic.StoreInt64(&logW.checkBefore, n)
 }
 
-//待修改
-func (logW *EthEventLogWatcher) CheckLogs(blkNumber *big.Int) error {
-	checkPoint := new(big.Int).Sub(blkNumber, logW.checkBefore)
-	logger.Debug("[HEADER] blkNumber: %s， blkNumber checkpoint: %s", blkNumber.String(), checkPoint.String())
-
-	logs, err := logW.client.FilterLogs(
-		context.Background(),
-		ethereum.FilterQuery{
-			FromBlock: checkPoint,
-			ToBlock:   checkPoint,
-		})
-
-	if err != nil {
-		return err
-	}
-
-	if len(logs) == 0 {
-		return nil
-	}
-
-	for _, log := range logs {
-		handler, ok := logW.eventHandlerMap[log.Topics[0]]
-		if !ok {
-			logger.Info("false No ==> %s", log.Topics[0].Hex())
-			continue
-		}
-		logger.Info("true No ==> %s", log.Topics[0].Hex())
-		if err = handler(logW, &log); err != nil {
-			return err
-		}
-	}
-	return nil
+func (logW *EthEventLogWatcher) checkBeforeBig() *big.Int {
+	return big.NewInt(atomic.LoadInt64(&logW.checkBefore))
 }
 
-func (logW *EthEventLogWatcher) SetGrpcStreamDB(isSendOK bool, infoType string, keyIndex string, value []byte) error {
-	//删除原有数据
-	var keysDelFlag string
-	var keysSetFlag string
-	if isSendOK {
-		keysDelFlag = "0_"
-		keysSetFlag = "1_"
-	} else {
-		keysDelFlag = "1_"
-		keysSetFlag = "0_"
+//新区块：分叉检查，扫描游标至 head-checkBefore 之间的区块
+func (logW *EthEventLogWatcher) handleHead(head *types.Header) error {
+	if err := logW.checkReorg(head); err != nil {
+		return err
 	}
+	logW.saveBlockHash(head.Number.Uint64(), head.Hash())
+	metrics.SetHead(head.Number.Uint64())
+	logW.touchHead()
 
-	//logW.ldb.DelKey()
-	switch infoType {
-	case comm.GRPC_HASH_ADD_LOG,
-		comm.GRPC_HASH_ENABLE_LOG,
-		comm.GRPC_HASH_DISABLE_LOG,
-		comm.GRPC_WITHDRAW_LOG:
-		//logger.Debug("isSendOK:",isSendOK," infoType:",infoType, " keyIndex:",keyIndex," value:",string(value))
-		//先删除数据
-		logW.DelKey([]byte(comm.GRPC_DB_PREFIX + keysDelFlag + infoType + "_" + keyIndex))
-		logW.DelKey([]byte(comm.GRPC_DB_PREFIX + keysSetFlag + infoType + "_" + keyIndex))
-		//重新写入数据
-		if err := logW.PutByte([]byte(comm.GRPC_DB_PREFIX+keysSetFlag+infoType+"_"+keyIndex), value); err != nil {
-			logger.Error("landtodb error", err)
-		}
-	default:
-		logger.Info("no grpc type :", infoType)
+	if err := logW.applyCursor(); err != nil {
+		return err
 	}
-
-	return nil
-}
-
-//GRPC重发检测
-func (logW *EthEventLogWatcher) ReSendGrpcStream() error {
-	//logger.Debug("ReSendGrpcStream....")
-	if mapHashAdd, err := logW.ldb.GetPrifix([]byte(comm.GRPC_DB_PREFIX + "0_")); err != nil {
-		logger.Error("get db error:", err)
-	} else {
-		for i, value := range mapHashAdd {
-			//logger.Debug("key:",i,"value:",value)
-			index := strings.Split(i, "_")[:]
-			switch index[2] {
-			case comm.GRPC_HASH_ADD_LOG,
-				comm.GRPC_HASH_ENABLE_LOG,
-				comm.GRPC_HASH_DISABLE_LOG,
-				comm.GRPC_WITHDRAW_LOG:
-				grpcStream := &comm.GrpcStream{}
-				if err := json.Unmarshal([]byte(value), grpcStream); err != nil {
-					logger.Error("db unmarshal err: %v", err)
-				} else {
-					//update time
-					//grpcStream.CreateTime = time.Now()
-					comm.GrpcStreamChan <- grpcStream
-					//logger.Debug("resend....",grpcStream)
-					logger.Debug("grpc resend, type value:", grpcStream.Type)
-				}
-				break
-			default:
-				logger.Info("no grpc type..", index[2])
-			}
-		}
+	cursor, err := ReadBlockNumberFromFile(logW.blkFile)
+	if err != nil {
+		return err
 	}
-
-	return nil
+	checkPoint := new(big.Int).Sub(head.Number, logW.checkBeforeBig())
+	logger.Debug("[BLOCK] GetBlock: %v, CheckBlock: %v", head.Number, checkPoint)
+	return logW.scanRange(new(big.Int).Add(cursor, big.NewInt(1)), checkPoint)
 }
 
 func (logW *EthEventLogWatcher) PutByte(key, value []byte) error {
@@ -0,0 +1,584 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/contract"
+	"github.com/boxproject/companion/util"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var ErrQuorum = errors.New("confirmations below threshold")
+
+//sink方法对应的请求类型
+var sinkMethodStage = map[string]string{
+	"addHash": comm.REQ_HASH_ADD,
+	"enable":  comm.REQ_HASH_ENABLE,
+	"disable": comm.REQ_HASH_DISABLE,
+	"approve": comm.REQ_OUT_APPROVE,
+}
+
+//节点确认记录
+type Confirm struct {
+	Signer      common.Address
+	TxHash      common.Hash
+	BlockNumber uint64
+}
+
+//approve参数
+type approveArgs struct {
+	TxHash    [32]byte
+	Amount    *big.Int
+	Fee       *big.Int
+	Recipient common.Address
+	Hash      [32]byte
+	Category  *big.Int
+}
+
+//多节点确认统计
+type quorum struct {
+	sink      common.Address
+	sinkAbi   abi.ABI
+	oracle    *contract.OracleCaller
+	threshold int64
+}
+
+func newQuorum(sink common.Address, threshold int64, oracle *contract.OracleCaller) (*quorum, error) {
+	parsed, err := abi.JSON(strings.NewReader(contract.SinkABI))
+	if err != nil {
+		return nil, err
+	}
+	return &quorum{sink: sink, sinkAbi: parsed, oracle: oracle, threshold: threshold}, nil
+}
+
+//是否上报：配置了oracle时检查多节点确认数，否则仅由最终确认人为本节点时上报
+func (logW *EthEventLogWatcher) accept(log *types.Log, stage string, hash, wdHash common.Hash, lastConfirmed common.Address) ([]*comm.SignInfo, bool, error) {
+	if logW.quorum == nil {
+		if !util.AddressEquals(lastConfirmed, common.HexToAddress(logW.appCfg.Creator)) {
+			logger.Info("[address not equal]CreatorAddr:%v,LastConfirmAddr:%v", common.HexToAddress(logW.appCfg.Creator), lastConfirmed)
+			return nil, false, nil
+		}
+		return nil, true, nil
+	}
+	signInfos, err := logW.checkQuorum(stage, hash, wdHash, log.BlockNumber)
+	if err == ErrQuorum {
+		logW.hold(log, confirmKey(stage, hash, wdHash))
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return signInfos, true, nil
+}
+
+//确认数未达门限的log
+type pendingLog struct {
+	Log        types.Log `json:"log"`
+	ConfirmKey string    `json:"confirmKey"`
+}
+
+//确认数未达门限时暂存log，后续区块中其他节点确认后重新检查
+func (logW *EthEventLogWatcher) hold(log *types.Log, confirmKey []byte) {
+	if logW.manual != nil {
+		logW.manual.record(log, RESCAN_PENDING, nil, ErrQuorum)
+		if logW.manual.dryRun {
+			return
+		}
+	}
+	data, err := json.Marshal(&pendingLog{Log: *log, ConfirmKey: string(confirmKey)})
+	if err != nil {
+		logger.Error("pending log marshal failed. cause:%v", err)
+		return
+	}
+	if err = logW.PutByte(pendingKey(log.BlockNumber, log.TxHash, log.Index), data); err != nil {
+		logger.Error("land pending log to db error: %v", err)
+	}
+}
+
+//重新检查暂存的log：已上报的清除，超出event_retention仍未达门限的写入死信记录并清除确认记录
+func (logW *EthEventLogWatcher) recheckPending(cursor uint64) error {
+	logW.handleLock.Lock()
+	defer logW.handleLock.Unlock()
+	resMap, err := logW.ldb.GetPrifix([]byte(comm.QUORUM_PENDING_PREFIX))
+	if err != nil {
+		return err
+	}
+	if len(resMap) == 0 {
+		return nil
+	}
+	pendings := make([]*pendingLog, 0, len(resMap))
+	logs := make([]types.Log, 0, len(resMap))
+	for key, value := range resMap {
+		pending := &pendingLog{}
+		if err = json.Unmarshal([]byte(value), pending); err != nil {
+			logger.Error("pending log[%s] unmarshal err: %v", key, err)
+			logW.DelKey([]byte(key))
+			continue
+		}
+		if cursor > logW.eventRetention && pending.Log.BlockNumber < cursor-logW.eventRetention {
+			logW.deadLetter(&pending.Log, ErrQuorum)
+			logW.DelKey([]byte(pending.ConfirmKey))
+			logW.DelKey([]byte(key))
+			continue
+		}
+		pendings = append(pendings, pending)
+		logs = append(logs, pending.Log)
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		if logs[i].BlockNumber != logs[j].BlockNumber {
+			return logs[i].BlockNumber < logs[j].BlockNumber
+		}
+		return logs[i].Index < logs[j].Index
+	})
+	if err = logW.handleLogsLocked(logs); err != nil {
+		return err
+	}
+	for _, pending := range pendings {
+		log := &pending.Log
+		if _, done, err := logW.forwarded(log); err != nil {
+			return err
+		} else if done {
+			logger.Info("[QUORUM] pending log forwarded, block: %d, tx: %s, index: %d", log.BlockNumber, log.TxHash.Hex(), log.Index)
+			logW.DelKey(pendingKey(log.BlockNumber, log.TxHash, log.Index))
+		}
+	}
+	return nil
+}
+
+func pendingKey(number uint64, txHash common.Hash, index uint) []byte {
+	return []byte(fmt.Sprintf("%s%020d_%s_%d", comm.QUORUM_PENDING_PREFIX, number, txHash.Hex(), index))
+}
+
+//确认门限：配置优先，未配置时与sink合约一致，按启用节点数过半
+func (q *quorum) margin() (int64, error) {
+	if q.threshold > 0 {
+		return q.threshold, nil
+	}
+	total, err := q.oracle.TotalEnabledNodes(nil)
+	if err != nil {
+		return 0, err
+	}
+	n := total.Int64()
+	if n <= 2 {
+		return n, nil
+	}
+	return n/2 + 1, nil
+}
+
+//已启用的授权节点
+func (q *quorum) signers() (map[common.Address]bool, error) {
+	count, err := q.oracle.Count(nil)
+	if err != nil {
+		return nil, err
+	}
+	signers := make(map[common.Address]bool)
+	//nodes[0]为占位节点
+	for i := int64(1); i < count.Int64(); i++ {
+		signer, enabled, err := q.oracle.IndexOf(nil, big.NewInt(i))
+		if err != nil {
+			return nil, err
+		}
+		if enabled {
+			signers[signer] = true
+		}
+	}
+	return signers, nil
+}
+
+//解析授权节点发往sink合约的交易，记录各节点的确认；仅获取授权节点发送过交易的区块
+//manual为dryRun的重新扫描状态时确认记录只写入内存
+func (logW *EthEventLogWatcher) trackConfirms(from, to *big.Int, manual *rescanState) error {
+	if logW.quorum == nil {
+		return nil
+	}
+	signers, err := logW.quorum.signers()
+	if err != nil {
+		return err
+	}
+	numbers, err := logW.signerBlocks(signers, from.Uint64(), to.Uint64())
+	if err != nil {
+		//节点未保留历史状态时无法按nonce定位，逐块获取
+		logger.Warn("[QUORUM] locate signer txs in block %v - %v failed: %v, fetch every block", from, to, err)
+		numbers = nil
+		for n := from.Uint64(); n <= to.Uint64(); n++ {
+			numbers = append(numbers, n)
+		}
+	}
+	for _, n := range numbers {
+		block, err := logW.client.BlockByNumber(context.Background(), new(big.Int).SetUint64(n))
+		if err != nil {
+			return err
+		}
+		for _, tx := range block.Transactions() {
+			if tx.To() == nil || *tx.To() != logW.quorum.sink || len(tx.Data()) < 4 {
+				continue
+			}
+			if err = logW.trackConfirm(block.NumberU64(), tx, signers, manual); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//[from, to]内授权节点发送过交易的区块，按各节点nonce的变化二分查找
+func (logW *EthEventLogWatcher) signerBlocks(signers map[common.Address]bool, from, to uint64) ([]uint64, error) {
+	blocks := make(map[uint64]bool)
+	for signer := range signers {
+		before := uint64(0)
+		if from > 0 {
+			nonce, err := logW.client.NonceAt(context.Background(), signer, new(big.Int).SetUint64(from-1))
+			if err != nil {
+				return nil, err
+			}
+			before = nonce
+		}
+		after, err := logW.client.NonceAt(context.Background(), signer, new(big.Int).SetUint64(to))
+		if err != nil {
+			return nil, err
+		}
+		if err = logW.bisectNonce(signer, from, to, before, after, blocks); err != nil {
+			return nil, err
+		}
+	}
+	numbers := make([]uint64, 0, len(blocks))
+	for n := range blocks {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+//before为from-1区块的nonce，after为to区块的nonce，nonce变化的区块记入blocks
+func (logW *EthEventLogWatcher) bisectNonce(signer common.Address, from, to, before, after uint64, blocks map[uint64]bool) error {
+	if before == after {
+		return nil
+	}
+	if from == to {
+		blocks[from] = true
+		return nil
+	}
+	mid := from + (to-from)/2
+	nonce, err := logW.client.NonceAt(context.Background(), signer, new(big.Int).SetUint64(mid))
+	if err != nil {
+		return err
+	}
+	if err = logW.bisectNonce(signer, from, mid, before, nonce, blocks); err != nil {
+		return err
+	}
+	return logW.bisectNonce(signer, mid+1, to, nonce, after, blocks)
+}
+
+func (logW *EthEventLogWatcher) trackConfirm(number uint64, tx *types.Transaction, signers map[common.Address]bool, manual *rescanState) error {
+	var signer types.Signer = types.HomesteadSigner{}
+	if tx.Protected() {
+		signer = types.NewEIP155Signer(tx.ChainId())
+	}
+	from, err := types.Sender(signer, tx)
+	if err != nil {
+		return nil
+	}
+	if !signers[from] {
+		logger.Warn("[QUORUM] tx %s from unauthorized node %s", tx.Hash().Hex(), from.Hex())
+		return nil
+	}
+	method, err := logW.quorum.sinkAbi.MethodById(tx.Data()[:4])
+	if err != nil {
+		return nil
+	}
+	stage, ok := sinkMethodStage[method.Name]
+	if !ok {
+		return nil
+	}
+	var hash, wdHash common.Hash
+	if stage == comm.REQ_OUT_APPROVE {
+		args := &approveArgs{}
+		if err = method.Inputs.Unpack(args, tx.Data()[4:]); err != nil {
+			logger.Warn("[QUORUM] tx %s unpack failed: %v", tx.Hash().Hex(), err)
+			return nil
+		}
+		hash, wdHash = common.Hash(args.Hash), common.Hash(args.TxHash)
+	} else {
+		var arg [32]byte
+		if err = method.Inputs.Unpack(&arg, tx.Data()[4:]); err != nil {
+			logger.Warn("[QUORUM] tx %s unpack failed: %v", tx.Hash().Hex(), err)
+			return nil
+		}
+		hash = common.Hash(arg)
+	}
+	receipt, err := logW.client.TransactionReceipt(context.Background(), tx.Hash())
+	if err != nil {
+		return err
+	}
+	if receipt.Status == types.ReceiptStatusFailed {
+		return nil
+	}
+
+	//与log处理互斥，实时扫描与手动重新扫描不同时修改确认记录
+	logW.handleLock.Lock()
+	defer logW.handleLock.Unlock()
+	return logW.addConfirm(stage, hash, wdHash, &Confirm{Signer: from, TxHash: tx.Hash(), BlockNumber: number}, manual)
+}
+
+//记录节点确认
+func (logW *EthEventLogWatcher) addConfirm(stage string, hash, wdHash common.Hash, confirm *Confirm, manual *rescanState) error {
+	start, closed, err := logW.roundStart(stage, hash, wdHash, manual)
+	if err != nil {
+		return err
+	}
+	key := confirmKey(stage, hash, wdHash)
+	//已上报阶段之后的重复确认（合约中不生效）及重新扫描到的旧确认不再记录
+	if closed || confirm.BlockNumber <= start {
+		logger.Info("[QUORUM] %s forwarded at block %d, ignore tx %s from %s", string(key), start, confirm.TxHash.Hex(), confirm.Signer.Hex())
+		return nil
+	}
+	confirms, err := logW.confirms(key, manual)
+	if err != nil {
+		return err
+	}
+	//同时清除失效的确认
+	valid := make([]*Confirm, 0, len(confirms)+1)
+	for _, c := range confirms {
+		if c.TxHash == confirm.TxHash {
+			return nil
+		}
+		if c.BlockNumber > start {
+			valid = append(valid, c)
+		}
+	}
+	valid = append(valid, confirm)
+	logger.Info("[QUORUM] %s confirmed by %s, count: %d", string(key), confirm.Signer.Hex(), len(roundConfirms(valid, start, confirm.BlockNumber)))
+	return logW.saveConfirms(key, valid, manual)
+}
+
+//事件上报前检查确认数，达到门限时返回各节点签名信息，记录上报区块并清除本轮记录
+func (logW *EthEventLogWatcher) checkQuorum(stage string, hash, wdHash common.Hash, number uint64) ([]*comm.SignInfo, error) {
+	key := confirmKey(stage, hash, wdHash)
+	start, _, err := logW.roundStart(stage, hash, wdHash, logW.manual)
+	if err != nil {
+		return nil, err
+	}
+	confirms, err := logW.confirms(key, logW.manual)
+	if err != nil {
+		return nil, err
+	}
+	margin, err := logW.quorum.margin()
+	if err != nil {
+		return nil, err
+	}
+	//本轮确认均在事件所在区块及之前，门限高于合约时计入之后到达的确认
+	used := roundConfirms(confirms, start, number)
+	if int64(len(used)) < margin {
+		used = roundConfirms(confirms, start, math.MaxUint64)
+	}
+	if int64(len(used)) < margin {
+		logger.Warn("[QUORUM] %s confirmations %d, threshold %d", string(key), len(used), margin)
+		return nil, ErrQuorum
+	}
+
+	signInfos := make([]*comm.SignInfo, 0, len(used))
+	for _, c := range used {
+		signInfos = append(signInfos, &comm.SignInfo{AppId: c.Signer.Hex(), Sign: c.TxHash.Hex()})
+	}
+	if err = logW.closeRound(stage, hash, wdHash, number, confirms, used, logW.manual); err != nil {
+		logger.Error("close confirms[%s] error: %v", string(key), err)
+	}
+	return signInfos, nil
+}
+
+//start(不含)至end(含)区块内各节点的确认，每个节点只计一次
+func roundConfirms(confirms []*Confirm, start, end uint64) []*Confirm {
+	seen := make(map[common.Address]bool)
+	round := make([]*Confirm, 0, len(confirms))
+	for _, c := range confirms {
+		if c.BlockNumber <= start || c.BlockNumber > end || seen[c.Signer] {
+			continue
+		}
+		seen[c.Signer] = true
+		round = append(round, c)
+	}
+	return round
+}
+
+//同一hash的启用与禁用交替进行，一方上报后另一方开始新一轮确认
+var stageOpposite = map[string]string{
+	comm.REQ_HASH_ENABLE:  comm.REQ_HASH_DISABLE,
+	comm.REQ_HASH_DISABLE: comm.REQ_HASH_ENABLE,
+}
+
+//本轮确认的起始区块（不含）：本阶段或对方阶段最近上报的区块，此前的确认已失效；
+//新增及提现只上报一次，上报后closed为true，之后的确认均忽略
+func (logW *EthEventLogWatcher) roundStart(stage string, hash, wdHash common.Hash, manual *rescanState) (uint64, bool, error) {
+	start, err := logW.doneAt(confirmDoneKey(stage, hash, wdHash), manual)
+	if err != nil {
+		return 0, false, err
+	}
+	opposite, ok := stageOpposite[stage]
+	if !ok {
+		return start, start > 0, nil
+	}
+	n, err := logW.doneAt(confirmDoneKey(opposite, hash, wdHash), manual)
+	if err != nil {
+		return 0, false, err
+	}
+	if n > start {
+		start = n
+	}
+	return start, false, nil
+}
+
+//上报后记录上报区块（含计入的最后一个确认），保留之后区块中未计入的确认
+func (logW *EthEventLogWatcher) closeRound(stage string, hash, wdHash common.Hash, done uint64, confirms, used []*Confirm, manual *rescanState) error {
+	usedTx := make(map[common.Hash]bool)
+	for _, c := range used {
+		usedTx[c.TxHash] = true
+		if c.BlockNumber > done {
+			done = c.BlockNumber
+		}
+	}
+	rest := make([]*Confirm, 0)
+	for _, c := range confirms {
+		if !usedTx[c.TxHash] && c.BlockNumber > done {
+			rest = append(rest, c)
+		}
+	}
+	if err := logW.saveConfirms(confirmKey(stage, hash, wdHash), rest, manual); err != nil {
+		return err
+	}
+	return logW.setDone(confirmDoneKey(stage, hash, wdHash), done, manual)
+}
+
+//确认记录，dryRun时优先读取内存中的记录
+func (logW *EthEventLogWatcher) confirms(key []byte, manual *rescanState) ([]*Confirm, error) {
+	if manual != nil && manual.dryRun {
+		if confirms, ok := manual.confirms[string(key)]; ok {
+			return confirms, nil
+		}
+	}
+	confirms := make([]*Confirm, 0)
+	data, err := logW.ldb.GetByte(key)
+	if err == leveldb.ErrNotFound {
+		return confirms, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &confirms); err != nil {
+		return nil, err
+	}
+	return confirms, nil
+}
+
+//保存确认记录，为空时删除
+func (logW *EthEventLogWatcher) saveConfirms(key []byte, confirms []*Confirm, manual *rescanState) error {
+	if manual != nil && manual.dryRun {
+		manual.confirms[string(key)] = confirms
+		return nil
+	}
+	if len(confirms) == 0 {
+		return logW.DelKey(key)
+	}
+	data, err := json.Marshal(confirms)
+	if err != nil {
+		return err
+	}
+	return logW.PutByte(key, data)
+}
+
+//阶段最近上报的区块，未上报时为0
+func (logW *EthEventLogWatcher) doneAt(key []byte, manual *rescanState) (uint64, error) {
+	if manual != nil && manual.dryRun {
+		if n, ok := manual.done[string(key)]; ok {
+			return n, nil
+		}
+	}
+	data, err := logW.ldb.GetByte(key)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(data), 10, 64)
+}
+
+func (logW *EthEventLogWatcher) setDone(key []byte, number uint64, manual *rescanState) error {
+	if manual != nil && manual.dryRun {
+		manual.done[string(key)] = number
+		return nil
+	}
+	return logW.PutByte(key, []byte(strconv.FormatUint(number, 10)))
+}
+
+//清理游标前event_retention个区块之前的确认及上报记录
+func (logW *EthEventLogWatcher) pruneConfirms(cursor uint64) {
+	if cursor <= logW.eventRetention {
+		return
+	}
+	limit := cursor - logW.eventRetention
+	logW.handleLock.Lock()
+	defer logW.handleLock.Unlock()
+	logW.filterConfirms(func(c *Confirm) bool { return c.BlockNumber >= limit }, func(n uint64) bool { return n >= limit })
+}
+
+//按条件保留确认记录及上报区块记录，keep返回false的删除
+func (logW *EthEventLogWatcher) filterConfirms(keepConfirm func(c *Confirm) bool, keepDone func(n uint64) bool) {
+	resMap, err := logW.ldb.GetPrifix([]byte(comm.CONFIRM_PREFIX))
+	if err != nil {
+		logger.Error("load confirms error: %v", err)
+		return
+	}
+	for key, value := range resMap {
+		confirms := make([]*Confirm, 0)
+		if err = json.Unmarshal([]byte(value), &confirms); err != nil {
+			logger.Error("confirms[%s] unmarshal err: %v", key, err)
+			logW.DelKey([]byte(key))
+			continue
+		}
+		kept := make([]*Confirm, 0, len(confirms))
+		for _, c := range confirms {
+			if keepConfirm(c) {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == len(confirms) {
+			continue
+		}
+		if err = logW.saveConfirms([]byte(key), kept, nil); err != nil {
+			logger.Error("save confirms[%s] error: %v", key, err)
+		}
+	}
+
+	resMap, err = logW.ldb.GetPrifix([]byte(comm.CONFIRM_DONE_PREFIX))
+	if err != nil {
+		logger.Error("load confirm done error: %v", err)
+		return
+	}
+	for key, value := range resMap {
+		if n, err := strconv.ParseUint(value, 10, 64); err != nil || !keepDone(n) {
+			logW.DelKey([]byte(key))
+		}
+	}
+}
+
+func confirmKey(stage string, hash, wdHash common.Hash) []byte {
+	key := comm.CONFIRM_PREFIX + stage + "_" + hash.Hex()
+	if stage == comm.REQ_OUT_APPROVE {
+		key += "_" + wdHash.Hex()
+	}
+	return []byte(key)
+}
+
+func confirmDoneKey(stage string, hash, wdHash common.Hash) []byte {
+	return []byte(comm.CONFIRM_DONE_PREFIX + strings.TrimPrefix(string(confirmKey(stage, hash, wdHash)), comm.CONFIRM_PREFIX))
+}
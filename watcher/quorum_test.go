@@ -0,0 +1,119 @@
+package watcher
+
+import (
+	"testing"
+
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/db"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func newQuorumWatcher(t *testing.T, threshold int64) *EthEventLogWatcher {
+	ldb, err := db.InitDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ldb.Close() })
+	return &EthEventLogWatcher{ldb: ldb, quorum: &quorum{threshold: threshold}, eventRetention: 100}
+}
+
+func mustConfirm(t *testing.T, logW *EthEventLogWatcher, stage string, hash common.Hash, signer byte, number uint64, manual *rescanState) {
+	t.Helper()
+	confirm := &Confirm{Signer: common.Address{signer}, TxHash: common.Hash{signer, byte(number)}, BlockNumber: number}
+	if err := logW.addConfirm(stage, hash, common.Hash{}, confirm, manual); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countConfirms(t *testing.T, logW *EthEventLogWatcher, stage string, hash common.Hash, manual *rescanState) int {
+	t.Helper()
+	confirms, err := logW.confirms(confirmKey(stage, hash, common.Hash{}), manual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(confirms)
+}
+
+func TestDryRunConfirms(t *testing.T) {
+	logW := newQuorumWatcher(t, 2)
+	hash := common.Hash{1}
+	mustConfirm(t, logW, comm.REQ_HASH_ADD, hash, 1, 5, nil)
+
+	//dryRun时新确认只记在内存，预览按合并后的确认数判断
+	state := &rescanState{dryRun: true, confirms: make(map[string][]*Confirm), done: make(map[string]uint64)}
+	mustConfirm(t, logW, comm.REQ_HASH_ADD, hash, 2, 6, state)
+	logW.manual = state
+	if _, err := logW.checkQuorum(comm.REQ_HASH_ADD, hash, common.Hash{}, 6); err != nil {
+		t.Fatalf("dry run: got %v, want quorum", err)
+	}
+	//达到门限后与实际扫描一样记录已上报，之后的确认忽略
+	mustConfirm(t, logW, comm.REQ_HASH_ADD, hash, 3, 7, state)
+	if n := countConfirms(t, logW, comm.REQ_HASH_ADD, hash, state); n != 0 {
+		t.Fatalf("dry run confirms after forward: %d", n)
+	}
+	logW.manual = nil
+
+	//db中的记录不受影响
+	if n := countConfirms(t, logW, comm.REQ_HASH_ADD, hash, nil); n != 1 {
+		t.Fatalf("db confirms: %d", n)
+	}
+	if _, err := logW.checkQuorum(comm.REQ_HASH_ADD, hash, common.Hash{}, 6); err != ErrQuorum {
+		t.Fatalf("got %v, want %v", err, ErrQuorum)
+	}
+}
+
+func TestQuorumRounds(t *testing.T) {
+	logW := newQuorumWatcher(t, 2)
+	hash := common.Hash{1}
+	mustConfirm(t, logW, comm.REQ_HASH_ENABLE, hash, 1, 5, nil)
+	mustConfirm(t, logW, comm.REQ_HASH_ENABLE, hash, 2, 6, nil)
+	signInfos, err := logW.checkQuorum(comm.REQ_HASH_ENABLE, hash, common.Hash{}, 6)
+	if err != nil || len(signInfos) != 2 {
+		t.Fatalf("enable: %v, %d", err, len(signInfos))
+	}
+	//上报后重新扫描到的旧确认不再记录
+	mustConfirm(t, logW, comm.REQ_HASH_ENABLE, hash, 1, 5, nil)
+	//上报后到达的确认在合约中不生效，不计入下一轮
+	mustConfirm(t, logW, comm.REQ_HASH_ENABLE, hash, 3, 8, nil)
+	if n := countConfirms(t, logW, comm.REQ_HASH_ENABLE, hash, nil); n != 1 {
+		t.Fatalf("confirms after forward: %d, want 1", n)
+	}
+
+	mustConfirm(t, logW, comm.REQ_HASH_DISABLE, hash, 1, 10, nil)
+	mustConfirm(t, logW, comm.REQ_HASH_DISABLE, hash, 2, 10, nil)
+	if _, err = logW.checkQuorum(comm.REQ_HASH_DISABLE, hash, common.Hash{}, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	//禁用后重新启用，节点3在上一轮之后的确认已失效
+	mustConfirm(t, logW, comm.REQ_HASH_ENABLE, hash, 1, 12, nil)
+	if _, err = logW.checkQuorum(comm.REQ_HASH_ENABLE, hash, common.Hash{}, 12); err != ErrQuorum {
+		t.Fatalf("got %v, want %v", err, ErrQuorum)
+	}
+	mustConfirm(t, logW, comm.REQ_HASH_ENABLE, hash, 3, 13, nil)
+	if signInfos, err = logW.checkQuorum(comm.REQ_HASH_ENABLE, hash, common.Hash{}, 13); err != nil || len(signInfos) != 2 {
+		t.Fatalf("enable again: %v, %d", err, len(signInfos))
+	}
+}
+
+func TestPruneConfirms(t *testing.T) {
+	logW := newQuorumWatcher(t, 2)
+	hash := common.Hash{1}
+	mustConfirm(t, logW, comm.REQ_HASH_ADD, hash, 1, 5, nil)
+	mustConfirm(t, logW, comm.REQ_HASH_ADD, hash, 2, 150, nil)
+	mustConfirm(t, logW, comm.REQ_HASH_ENABLE, hash, 1, 20, nil)
+	if err := logW.setDone(confirmDoneKey(comm.REQ_HASH_DISABLE, hash, common.Hash{}), 30, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	logW.pruneConfirms(200)
+	if n := countConfirms(t, logW, comm.REQ_HASH_ADD, hash, nil); n != 1 {
+		t.Fatalf("add confirms: %d, want 1", n)
+	}
+	if n := countConfirms(t, logW, comm.REQ_HASH_ENABLE, hash, nil); n != 0 {
+		t.Fatalf("enable confirms: %d, want 0", n)
+	}
+	if n, err := logW.doneAt(confirmDoneKey(comm.REQ_HASH_DISABLE, hash, common.Hash{}), nil); err != nil || n != 0 {
+		t.Fatalf("disable done: %d, %v", n, err)
+	}
+}
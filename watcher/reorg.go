@@ -0,0 +1,232 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//上报log，并记录 evt_BLOCK_TXHASH_LOGINDEX 供分叉回滚及重新扫描去重使用
+//写入发件箱失败时返回错误，不记录evt_，游标不越过该区块
+func (logW *EthEventLogWatcher) forward(log *types.Log, grpcStream *comm.GrpcStream) error {
+	if logW.manual != nil {
+		logW.manual.record(log, RESCAN_FORWARD, grpcStream, nil)
+		if logW.manual.dryRun {
+			return nil
+		}
+	}
+	if _, err := comm.PushStream(grpcStream); err != nil {
+		logger.Error("land grpc stream to db error: %v", err)
+		return err
+	}
+	metrics.Events.WithLabelValues(grpcStream.Type).Inc()
+	grpcStreamJson, err := json.Marshal(grpcStream)
+	if err != nil {
+		logger.Error("EventStream marshal failed. cause:%v", err)
+		return err
+	}
+	if err = logW.PutByte(eventKey(log.BlockNumber, log.TxHash, log.Index), grpcStreamJson); err != nil {
+		logger.Error("land event to db error: %v", err)
+		return err
+	}
+	return nil
+}
+
+//上报已发送log失效
+func (logW *EthEventLogWatcher) revert(key []byte, value []byte) {
+	grpcStream := &comm.GrpcStream{}
+	if err := json.Unmarshal(value, grpcStream); err != nil {
+		logger.Error("event[%s] unmarshal err: %v", string(key), err)
+		return
+	}
+	grpcStream.Status = comm.HASH_STATUS_REVERTED
+	logger.Warn("[REORG] revert event: %s", string(key))
+	if _, err := comm.PushStream(grpcStream); err != nil {
+		logger.Error("land grpc stream to db error: %v", err)
+		return
+	}
+	if err := logW.DelKey(key); err != nil {
+		logger.Error("del event[%s] error: %v", string(key), err)
+	}
+}
+
+//回滚from(含)之后已上报的log
+func (logW *EthEventLogWatcher) revertFrom(from uint64) {
+	iter := logW.ldb.NewIterator(&util.Range{Start: []byte(fmt.Sprintf("%s%020d", comm.EVENT_LOG_PREFIX, from))}, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !strings.HasPrefix(string(iter.Key()), comm.EVENT_LOG_PREFIX) {
+			break
+		}
+		key := append([]byte{}, iter.Key()...)
+		value := append([]byte{}, iter.Value()...)
+		logW.revert(key, value)
+	}
+}
+
+//清除from(含)之后暂存的log，分叉回滚时使用
+func (logW *EthEventLogWatcher) dropPendingFrom(from uint64) {
+	iter := logW.ldb.NewIterator(&util.Range{Start: []byte(fmt.Sprintf("%s%020d", comm.QUORUM_PENDING_PREFIX, from))}, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !strings.HasPrefix(string(iter.Key()), comm.QUORUM_PENDING_PREFIX) {
+			break
+		}
+		logger.Warn("[REORG] drop pending log: %s", string(iter.Key()))
+		logW.DelKey(append([]byte{}, iter.Key()...))
+	}
+}
+
+//清除from(含)之后的确认及上报区块记录，分叉回滚时使用
+func (logW *EthEventLogWatcher) dropConfirmsFrom(from uint64) {
+	logW.filterConfirms(func(c *Confirm) bool { return c.BlockNumber < from }, func(n uint64) bool { return n < from })
+}
+
+//检查新区块父hash，发生分叉时回退游标并回滚已上报log
+//父区块hash未记录时（轮询或跳过的区块）向前获取区块头，与最近记录的区块hash比对
+func (logW *EthEventLogWatcher) checkReorg(head *types.Header) error {
+	number := head.Number.Uint64()
+	if number == 0 {
+		return nil
+	}
+	expected := head.ParentHash
+	var gap []*types.Header
+	n := number - 1
+	for {
+		local, ok := logW.blockHash(n)
+		if ok {
+			if local == expected {
+				logW.saveHeaders(gap)
+				return nil
+			}
+			logger.Warn("[REORG] block %d hash mismatch, local: %s, remote: %s", n, local.Hex(), expected.Hex())
+			break
+		}
+		//窗口内无记录，无法比对
+		if n == 0 || number-n >= uint64(logW.reorgWindow) {
+			logW.saveHeaders(gap)
+			return nil
+		}
+		header, err := logW.client.HeaderByNumber(context.Background(), new(big.Int).SetUint64(n))
+		if err != nil {
+			logger.Error("get header %d failed: %v", n, err)
+			return err
+		}
+		//获取期间节点切换了分支，下一个新区块时重新检查
+		if header.Hash() != expected {
+			return fmt.Errorf("block %d hash changed during reorg check: %s, expected %s", n, header.Hash().Hex(), expected.Hex())
+		}
+		gap = append(gap, header)
+		expected = header.ParentHash
+		n--
+	}
+	logW.saveHeaders(gap)
+
+	//查找共同祖先
+	ancestor := uint64(0)
+	for ; n > 0 && number-n <= uint64(logW.reorgWindow); n-- {
+		header, err := logW.client.HeaderByNumber(context.Background(), new(big.Int).SetUint64(n))
+		if err != nil {
+			logger.Error("get header %d failed: %v", n, err)
+			return err
+		}
+		if local, ok := logW.blockHash(n); ok && local == header.Hash() {
+			ancestor = n
+			break
+		}
+		logW.saveBlockHash(n, header.Hash())
+	}
+	if ancestor == 0 {
+		logger.Error("[REORG] common ancestor not found in last %d blocks", logW.reorgWindow)
+		if number > uint64(logW.reorgWindow) {
+			ancestor = number - uint64(logW.reorgWindow)
+		}
+	}
+	logger.Warn("[REORG] common ancestor: %d", ancestor)
+
+	cursor, err := ReadBlockNumberFromFile(logW.blkFile)
+	if err != nil {
+		return err
+	}
+	if cursor.Uint64() > ancestor {
+		logger.Warn("[REORG] rewind cursor %v -> %d", cursor, ancestor)
+		if err = WriteCheckpointBlockNumberToFile(logW.blkFile, new(big.Int).SetUint64(ancestor)); err != nil {
+			return err
+		}
+	}
+	logW.handleLock.Lock()
+	defer logW.handleLock.Unlock()
+	logW.revertFrom(ancestor + 1)
+	logW.dropPendingFrom(ancestor + 1)
+	logW.dropConfirmsFrom(ancestor + 1)
+	return nil
+}
+
+//清理游标前event_retention个区块之前的已上报log记录，早于此的区块重新扫描时无法去重，可能重复上报
+func (logW *EthEventLogWatcher) pruneEvents(cursor uint64) {
+	if cursor <= logW.eventRetention {
+		return
+	}
+	limit := []byte(fmt.Sprintf("%s%020d", comm.EVENT_LOG_PREFIX, cursor-logW.eventRetention))
+	iter := logW.ldb.NewIterator(&util.Range{Start: []byte(comm.EVENT_LOG_PREFIX), Limit: limit}, nil)
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		logger.Error("load events error: %v", err)
+		return
+	}
+	if batch.Len() == 0 {
+		return
+	}
+	if err := logW.ldb.Write(batch, nil); err != nil {
+		logger.Error("prune events error: %v", err)
+		return
+	}
+	logger.Info("prune %d events before block %d", batch.Len(), cursor-logW.eventRetention)
+}
+
+func (logW *EthEventLogWatcher) blockHash(number uint64) (common.Hash, bool) {
+	data, err := logW.ldb.GetByte(blockHashKey(number))
+	if err != nil {
+		return common.Hash{}, false
+	}
+	return common.BytesToHash(data), true
+}
+
+//记录区块hash，清理窗口外数据
+func (logW *EthEventLogWatcher) saveBlockHash(number uint64, hash common.Hash) {
+	if err := logW.PutByte(blockHashKey(number), hash.Bytes()); err != nil {
+		logger.Error("land block hash to db error: %v", err)
+	}
+	if number > uint64(logW.reorgWindow) {
+		logW.DelKey(blockHashKey(number - uint64(logW.reorgWindow)))
+	}
+}
+
+//记录向前获取的区块头hash
+func (logW *EthEventLogWatcher) saveHeaders(headers []*types.Header) {
+	for _, header := range headers {
+		logW.saveBlockHash(header.Number.Uint64(), header.Hash())
+	}
+}
+
+func blockHashKey(number uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", comm.BLOCK_HASH_PREFIX, number))
+}
+
+func eventKey(number uint64, txHash common.Hash, index uint) []byte {
+	return []byte(fmt.Sprintf("%s%020d_%s_%d", comm.EVENT_LOG_PREFIX, number, txHash.Hex(), index))
+}
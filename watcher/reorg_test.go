@@ -0,0 +1,142 @@
+package watcher
+
+import (
+	"context"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/boxproject/companion/comm"
+	"github.com/boxproject/companion/db"
+	"github.com/boxproject/companion/ethcli"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+//按区块号返回区块头的模拟节点
+type fakeChain struct {
+	lock    sync.Mutex
+	headers []*types.Header
+}
+
+//从fork(不含)之后按tag生成新分支
+func (f *fakeChain) build(fork, to uint64, tag byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.headers = f.headers[:fork+1]
+	for n := fork + 1; n <= to; n++ {
+		f.headers = append(f.headers, &types.Header{ParentHash: f.headers[n-1].Hash(), Number: new(big.Int).SetUint64(n), Difficulty: big.NewInt(1), Extra: []byte{tag}})
+	}
+}
+
+func (f *fakeChain) header(n uint64) *types.Header {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.headers[n]
+}
+
+func (f *fakeChain) GetBlockByNumber(ctx context.Context, number rpc.BlockNumber, full bool) (*types.Header, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if number < 0 {
+		return f.headers[len(f.headers)-1], nil
+	}
+	if int(number) >= len(f.headers) {
+		return nil, nil
+	}
+	return f.headers[number], nil
+}
+
+func newFakeChain(t *testing.T) (*fakeChain, *ethcli.Client) {
+	chain := &fakeChain{headers: []*types.Header{{Number: big.NewInt(0), Difficulty: big.NewInt(1)}}}
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", chain); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	client, err := ethcli.Dial(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return chain, client
+}
+
+func TestCheckReorgGap(t *testing.T) {
+	chain, client := newFakeChain(t)
+	chain.build(0, 10, 'a')
+	ldb, err := db.InitDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+	comm.Ldb = ldb
+	logW := &EthEventLogWatcher{client: client, ldb: ldb, reorgWindow: 20, blkFile: filepath.Join(t.TempDir(), "blk")}
+
+	//区块5之后的新区块未收到，9到达时向前补齐5-8
+	logW.saveBlockHash(5, chain.header(5).Hash())
+	if err = logW.handleHeadHash(chain.header(9)); err != nil {
+		t.Fatal(err)
+	}
+	for n := uint64(5); n <= 9; n++ {
+		if hash, ok := logW.blockHash(n); !ok || hash != chain.header(n).Hash() {
+			t.Fatalf("block %d hash not recorded", n)
+		}
+	}
+
+	//6之后分叉，新区块12的父区块未记录，比对到9时发现分叉，回退游标至共同祖先6
+	if err = WriteCheckpointBlockNumberToFile(logW.blkFile, big.NewInt(9)); err != nil {
+		t.Fatal(err)
+	}
+	chain.build(6, 12, 'b')
+	if err = logW.handleHeadHash(chain.header(12)); err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := ReadBlockNumberFromFile(logW.blkFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor.Uint64() != 6 {
+		t.Fatalf("cursor: got %v, want 6", cursor)
+	}
+	for n := uint64(6); n <= 12; n++ {
+		if hash, ok := logW.blockHash(n); !ok || hash != chain.header(n).Hash() {
+			t.Fatalf("block %d hash not updated", n)
+		}
+	}
+}
+
+//与handleHead一致：分叉检查后记录新区块hash
+func (logW *EthEventLogWatcher) handleHeadHash(head *types.Header) error {
+	if err := logW.checkReorg(head); err != nil {
+		return err
+	}
+	logW.saveBlockHash(head.Number.Uint64(), head.Hash())
+	return nil
+}
+
+func TestForwardOutboxFailure(t *testing.T) {
+	ldb, err := db.InitDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+	//发件箱写入失败
+	outbox, err := db.InitDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.Close()
+	comm.Ldb = outbox
+	logW := &EthEventLogWatcher{ldb: ldb}
+	log := &types.Log{BlockNumber: 3, Index: 1}
+	if err = logW.forward(log, &comm.GrpcStream{Type: comm.GRPC_HASH_ADD_LOG, BlockNumber: 3}); err == nil {
+		t.Fatal("forward succeeded with outbox closed")
+	}
+	if _, done, err := logW.forwarded(log); err != nil || done {
+		t.Fatalf("event recorded after outbox failure: %v, %v", done, err)
+	}
+}
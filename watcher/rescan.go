@@ -0,0 +1,167 @@
+package watcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/comm"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+//手动重新扫描时log的处理结果
+const (
+	RESCAN_FORWARD     = "forward"     //上报
+	RESCAN_SKIP        = "skip"        //已上报，跳过
+	RESCAN_DEAD_LETTER = "dead_letter" //写入死信记录
+	RESCAN_IGNORE      = "ignore"      //未通过确认检查，不上报
+	RESCAN_PENDING     = "pending"     //确认数未达门限，新区块时重新检查
+)
+
+var (
+	ErrRescanAhead = errors.New("rescan block is beyond cursor")
+	ErrRescanRange = errors.New("illegal rescan range")
+)
+
+//手动重新扫描的log
+type RescanEvent struct {
+	BlockNumber uint64           `json:"blockNumber"`
+	TxHash      string           `json:"txHash"`
+	LogIndex    uint             `json:"logIndex"`
+	Action      string           `json:"action"`
+	Stream      *comm.GrpcStream `json:"stream,omitempty"` //解析后的事件，跳过时为之前上报的内容
+	Err         string           `json:"err,omitempty"`
+}
+
+//手动重新扫描结果
+type RescanResult struct {
+	From   uint64         `json:"from"`
+	To     uint64         `json:"to"`
+	DryRun bool           `json:"dryRun"`
+	Events []*RescanEvent `json:"events"`
+}
+
+//重新扫描状态，dryRun时仅记录结果，不上报、不写死信及确认记录
+type rescanState struct {
+	dryRun   bool
+	events   []*RescanEvent
+	confirms map[string][]*Confirm //dryRun时的确认记录，与实际扫描一样统计但不写db
+	done     map[string]uint64     //dryRun时各阶段上报的区块
+}
+
+func (r *rescanState) record(log *types.Log, action string, stream *comm.GrpcStream, cause error) {
+	event := &RescanEvent{BlockNumber: log.BlockNumber, TxHash: log.TxHash.Hex(), LogIndex: log.Index, Action: action, Stream: stream}
+	if cause != nil {
+		event.Err = cause.Error()
+	}
+	r.events = append(r.events, event)
+}
+
+//当前游标
+func (logW *EthEventLogWatcher) Cursor() (uint64, error) {
+	cursor, err := ReadBlockNumberFromFile(logW.blkFile)
+	if err != nil {
+		return 0, err
+	}
+	return cursor.Uint64(), nil
+}
+
+//设置游标，下一个新区块时生效
+func (logW *EthEventLogWatcher) SetCursor(n uint64) {
+	atomic.StoreInt64(&logW.pendingCursor, int64(n)+1)
+	logger.Warn("[RESCAN] set cursor to %d at next head", n)
+}
+
+//从区块n起重新扫描，下一个新区块时回退游标至n-1
+func (logW *EthEventLogWatcher) RescanFrom(n uint64) error {
+	cursor, err := logW.Cursor()
+	if err != nil {
+		return err
+	}
+	if n > cursor+1 {
+		return fmt.Errorf("%v: %d > %d", ErrRescanAhead, n, cursor+1)
+	}
+	if n == 0 {
+		n = 1
+	}
+	logW.SetCursor(n - 1)
+	return nil
+}
+
+//执行待设置的游标
+func (logW *EthEventLogWatcher) applyCursor() error {
+	n := atomic.SwapInt64(&logW.pendingCursor, 0)
+	if n == 0 {
+		return nil
+	}
+	logger.Warn("[RESCAN] move cursor to %d", n-1)
+	return WriteCheckpointBlockNumberToFile(logW.blkFile, big.NewInt(n-1))
+}
+
+//重新处理[from, to]区块的log，不移动游标，已上报的log跳过；to不能超过游标
+//已上报记录仅保留游标前event_retention个区块，更早的log会重复上报
+func (logW *EthEventLogWatcher) RescanRange(from, to uint64, dryRun bool) (*RescanResult, error) {
+	cursor, err := logW.Cursor()
+	if err != nil {
+		return nil, err
+	}
+	if from == 0 || from > to {
+		return nil, fmt.Errorf("%v: %d - %d", ErrRescanRange, from, to)
+	}
+	if to > cursor {
+		return nil, fmt.Errorf("%v: %d > %d", ErrRescanAhead, to, cursor)
+	}
+	if cursor > logW.eventRetention && from < cursor-logW.eventRetention {
+		logger.Warn("[RESCAN] events before block %d are pruned and may be forwarded again", cursor-logW.eventRetention)
+	}
+	logger.Warn("[RESCAN] block %d - %d, dry run: %v", from, to, dryRun)
+
+	result := &RescanResult{From: from, To: to, DryRun: dryRun}
+	state := &rescanState{dryRun: dryRun, events: []*RescanEvent{}, confirms: make(map[string][]*Confirm), done: make(map[string]uint64)}
+	for start := from; start <= to; start += DEF_SCAN_WINDOW {
+		end := start + DEF_SCAN_WINDOW - 1
+		if end > to {
+			end = to
+		}
+		logs, err := logW.filterLogs(new(big.Int).SetUint64(start), new(big.Int).SetUint64(end))
+		if err != nil {
+			return nil, err
+		}
+		//与实时扫描相同，确认记录在handleLock下写入
+		if err = logW.trackConfirms(new(big.Int).SetUint64(start), new(big.Int).SetUint64(end), state); err != nil {
+			return nil, err
+		}
+		logW.handleLock.Lock()
+		logW.manual = state
+		err = logW.handleLogsLocked(logs)
+		logW.manual = nil
+		logW.handleLock.Unlock()
+		if err != nil {
+			result.Events = state.events
+			return result, err
+		}
+		logger.Info("[RESCAN] block %d - %d, logs: %d", start, end, len(logs))
+	}
+	result.Events = state.events
+	return result, nil
+}
+
+//log是否已上报，按 evt_BLOCK_TXHASH_LOGINDEX 记录判断，返回之前上报的内容
+func (logW *EthEventLogWatcher) forwarded(log *types.Log) (*comm.GrpcStream, bool, error) {
+	data, err := logW.ldb.GetByte(eventKey(log.BlockNumber, log.TxHash, log.Index))
+	if err == leveldb.ErrNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	stream := &comm.GrpcStream{}
+	if err = json.Unmarshal(data, stream); err != nil {
+		logger.Error("event unmarshal err: %v", err)
+		return nil, true, nil
+	}
+	return stream, true, nil
+}
@@ -0,0 +1,223 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	logger "github.com/alecthomas/log4go"
+	"github.com/boxproject/companion/util"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	DEF_SCAN_WINDOW     = 1000             //单次FilterLogs区块数上限
+	SCAN_MAX_RETRY      = 5                //单个窗口最大重试次数
+	SCAN_FILTER_TIMEOUT = 30 * time.Second //单次FilterLogs超时
+)
+
+//节点返回结果过多时的错误信息
+var tooManyResultsErrs = []string{
+	"too many results",
+	"query returned more than",
+	"limit exceeded",
+	"response size exceeded",
+	"block range",
+	"context deadline exceeded",
+}
+
+//按窗口扫描[from, to]区块log，结果过多时缩小窗口，每个窗口处理完后更新游标
+func (logW *EthEventLogWatcher) scanRange(from, to *big.Int) error {
+	if from.Cmp(to) > 0 {
+		return nil
+	}
+	total := new(big.Int).Sub(to, from).Int64() + 1
+	if total > 1 {
+		logger.Info("[SCAN] block %v - %v, total: %d", from, to, total)
+	}
+
+	window := int64(DEF_SCAN_WINDOW)
+	retries := 0
+	start := new(big.Int).Set(from)
+	for start.Cmp(to) <= 0 {
+		end := new(big.Int).Add(start, big.NewInt(window-1))
+		if end.Cmp(to) > 0 {
+			end.Set(to)
+		}
+
+		logs, err := logW.filterLogs(start, end)
+		if err == nil {
+			//先记录各节点确认，再处理log
+			err = logW.trackConfirms(start, end, nil)
+		}
+		if err != nil {
+			if isTooManyResults(err) && window > 1 {
+				window /= 2
+				logger.Warn("[SCAN] block %v - %v: %v, shrink window to %d", start, end, err, window)
+				continue
+			}
+			retries++
+			if retries > SCAN_MAX_RETRY {
+				logger.Error("[SCAN] block %v - %v failed after %d retries: %v", start, end, SCAN_MAX_RETRY, err)
+				return err
+			}
+			d := util.DefaultBackoff.Duration(retries)
+			logger.Error("[SCAN] block %v - %v: %v, retry[%d] after %v", start, end, err, retries, d)
+			select {
+			case <-logW.quitSignal:
+				return err
+			case <-time.After(d):
+			}
+			continue
+		}
+		retries = 0
+
+		if err = logW.handleLogs(logs); err != nil {
+			return err
+		}
+		//暂存的log在新确认记录后重新检查
+		if err = logW.recheckPending(end.Uint64()); err != nil {
+			return err
+		}
+		WriteCheckpointBlockNumberToFile(logW.blkFile, new(big.Int).Set(end))
+		logW.pruneEvents(end.Uint64())
+		logW.pruneConfirms(end.Uint64())
+
+		if total > 1 {
+			done := new(big.Int).Sub(end, from).Int64() + 1
+			logger.Info("[SCAN] block %v - %v, logs: %d, progress: %d/%d", start, end, len(logs), done, total)
+		}
+		start = end.Add(end, big.NewInt(1))
+		//逐步恢复窗口
+		if window < DEF_SCAN_WINDOW {
+			window *= 2
+			if window > DEF_SCAN_WINDOW {
+				window = DEF_SCAN_WINDOW
+			}
+		}
+	}
+	return nil
+}
+
+//按合约地址及关注的topic过滤
+func (logW *EthEventLogWatcher) filterLogs(from, to *big.Int) ([]types.Log, error) {
+	topics := make([]common.Hash, 0, len(logW.eventHandlerMap))
+	for topic := range logW.eventHandlerMap {
+		topics = append(topics, topic)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SCAN_FILTER_TIMEOUT)
+	defer cancel()
+	q := ethereum.FilterQuery{
+		FromBlock: from,
+		ToBlock:   to,
+		Addresses: logW.addresses,
+		Topics:    [][]common.Hash{topics},
+	}
+	//两个节点结果一致后再处理，不一致时按重试处理
+	if logW.appCfg.CrossCheckLogs {
+		return logW.client.FilterLogsChecked(ctx, q)
+	}
+	return logW.client.FilterLogs(ctx, q)
+}
+
+func (logW *EthEventLogWatcher) handleLogs(logs []types.Log) error {
+	logW.handleLock.Lock()
+	defer logW.handleLock.Unlock()
+	return logW.handleLogsLocked(logs)
+}
+
+func (logW *EthEventLogWatcher) handleLogsLocked(logs []types.Log) error {
+	for i := range logs {
+		log := &logs[i]
+		if log.Topics == nil || len(log.Topics) == 0 {
+			logger.Info("enventLog topics nil")
+			continue
+		}
+		if !logW.addressSet[log.Address] {
+			logger.Warn("reject log from unknown contract: %s, tx: %s", log.Address.Hex(), log.TxHash.Hex())
+			continue
+		}
+		//FilterLogs不返回被移除的log，分叉仅由checkReorg处理
+
+		handler, ok := logW.eventHandlerMap[log.Topics[0]]
+		if !ok {
+			logger.Info("false No ==> %s", log.Topics[0].Hex())
+			continue
+		}
+		logger.Info("true No ==> %s", log.Topics[0].Hex())
+		//已上报的log不再处理，游标回退或重新扫描时避免重复上报
+		stream, done, err := logW.forwarded(log)
+		if err != nil {
+			return err
+		}
+		if done {
+			logger.Info("skip forwarded log, block: %d, tx: %s, index: %d", log.BlockNumber, log.TxHash.Hex(), log.Index)
+			if logW.manual != nil {
+				logW.manual.record(log, RESCAN_SKIP, stream, nil)
+			}
+			continue
+		}
+		recorded := 0
+		if logW.manual != nil {
+			recorded = len(logW.manual.events)
+		}
+		if err := logW.dispatch(handler, log); err != nil {
+			logger.Error("log handler err: %s", err)
+			return err
+		}
+		if logW.manual != nil && len(logW.manual.events) == recorded {
+			logW.manual.record(log, RESCAN_IGNORE, nil, nil)
+		}
+	}
+	return nil
+}
+
+//调用事件处理，异常的log写入死信记录
+func (logW *EthEventLogWatcher) dispatch(handler EventHandler, log *types.Log) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logW.deadLetter(log, fmt.Errorf("handler panic: %v", r))
+			err = nil
+		}
+	}()
+	return handler(logW, log)
+}
+
+//按配置筛选关注的事件，topic可配置为事件签名或topic hash
+func filterEvents(events map[common.Hash]EventHandler, topics []string) (map[common.Hash]EventHandler, error) {
+	if len(topics) == 0 {
+		return events, nil
+	}
+	filtered := make(map[common.Hash]EventHandler)
+	for _, t := range topics {
+		var topic common.Hash
+		if strings.HasPrefix(t, "0x") {
+			if len(t) != 2*common.HashLength+2 {
+				return nil, fmt.Errorf("illegal topic: %s", t)
+			}
+			topic = common.HexToHash(t)
+		} else {
+			topic = signFunc(strings.Replace(t, " ", "", -1))
+		}
+		handler, ok := events[topic]
+		if !ok {
+			return nil, fmt.Errorf("unsupported topic: %s", t)
+		}
+		filtered[topic] = handler
+	}
+	return filtered, nil
+}
+
+func isTooManyResults(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range tooManyResultsErrs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -9,6 +9,7 @@ import (
 
 	logger "github.com/alecthomas/log4go"
 	"errors"
+	"github.com/boxproject/companion/metrics"
 )
 
 var digNoRWMutex sync.RWMutex
@@ -16,7 +17,11 @@ var digNoRWMutex sync.RWMutex
 func WriteCheckpointBlockNumberToFile(filePath string, blkNumber *big.Int) error {
 	digNoRWMutex.Lock()
 	defer digNoRWMutex.Unlock()
-	return ioutil.WriteFile(filePath, []byte(blkNumber.String()), 0755)
+	if err := ioutil.WriteFile(filePath, []byte(blkNumber.String()), 0755); err != nil {
+		return err
+	}
+	metrics.SetCursor(blkNumber.Uint64())
+	return nil
 }
 
 func ReadBlockNumberFromFile(filePath string) (*big.Int, error) {